@@ -0,0 +1,159 @@
+// Admin API for runtime configuration. Disabled unless auth.admin_token
+// (ADMIN_TOKEN) is set; callers authenticate with "Authorization: Bearer <token>".
+
+import express from "express";
+import { timingSafeEqual } from "node:crypto";
+import { settings, updateSettings } from "./settings.js";
+import { queueStats } from "./queue.js";
+import { config, reloadConfig } from "./config.js";
+import { cancelJob, getThumbnail, listJobs, runningJobs } from "./jobs.js";
+import { deletePreset, listPresets, savePreset } from "./presets.js";
+import { deleteProfile, listProfiles, saveProfile } from "./profiles.js";
+import { openCircuits, resetCircuit } from "./breaker.js";
+import { runJanitor } from "./retention.js";
+import { sendError } from "./errors.js";
+
+function checkToken(req, res, next) {
+  const expected = config.auth.admin_token;
+  if (!expected) return sendError(res, 404, "not_found", "admin API disabled");
+  const given = Buffer.from((req.get("authorization") || "").replace(/^Bearer\s+/i, ""));
+  const want = Buffer.from(expected);
+  if (given.length !== want.length || !timingSafeEqual(given, want)) {
+    return sendError(res, 401, "unauthorized", "invalid admin token");
+  }
+  next();
+}
+
+// Proxy credentials never leave the box
+function redacted() {
+  return {
+    ...settings,
+    proxies: settings.proxies.map(p => ({ ...p, password: p.password ? "***" : undefined }))
+  };
+}
+
+// status() supplies live numbers owned by the caller (warm contexts, etc.);
+// validatePreset(options) throws when a preset would not make a valid request
+export function adminRouter({ status = () => ({}), validatePreset = () => {} } = {}) {
+  const router = express.Router();
+  router.use(checkToken);
+
+  router.get("/config", (req, res) => {
+    res.json({ ok: true, data: redacted() });
+  });
+
+  router.patch("/config", (req, res) => {
+    try {
+      updateSettings(req.body || {});
+    } catch (err) {
+      return sendError(res, 400, "invalid_request", err.message);
+    }
+    console.log(`admin: updated ${Object.keys(req.body || {}).join(", ")}`);
+    res.json({ ok: true, data: redacted() });
+  });
+
+  // Re-read the config file + environment, same as SIGHUP
+  router.post("/reload", (req, res) => {
+    let changed;
+    try {
+      changed = reloadConfig();
+    } catch (err) {
+      return sendError(res, 400, "invalid_request", err.message);
+    }
+    console.log(`admin: config reloaded (${changed.join(", ") || "no changes"})`);
+    res.json({ ok: true, data: { changed } });
+  });
+
+  router.get("/status", (req, res) => {
+    res.json({ ok: true, data: { queue: queueStats(), ...status() } });
+  });
+
+  router.get("/circuits", (req, res) => {
+    res.json({ ok: true, data: { circuits: openCircuits() } });
+  });
+
+  // Close a host's circuit by hand, e.g. once the site is known to be back
+  router.delete("/circuits/:host", (req, res) => {
+    if (!resetCircuit(req.params.host)) return sendError(res, 404, "not_found", "no circuit for that host");
+    console.log(`admin: reset circuit for ${req.params.host}`);
+    res.json({ ok: true, data: { host: req.params.host } });
+  });
+
+  // All tenants' history plus what is running right now
+  router.get("/jobs", async (req, res) => {
+    const jobs = await listJobs({
+      tenant: req.query.tenant,
+      status: req.query.status,
+      url: req.query.url,
+      since: req.query.since,
+      limit: Math.min(500, Math.max(1, parseInt(req.query.limit, 10) || 100)),
+      offset: 0
+    });
+    const running = [...runningJobs.values()].map(({ request, ...job }) => job);
+    res.json({ ok: true, data: { running, jobs } });
+  });
+
+  // Run the retention janitor now instead of waiting for its interval
+  router.post("/retention/run", async (req, res) => {
+    const report = await runJanitor();
+    res.json({ ok: true, data: report });
+  });
+
+  // Any tenant's running job
+  router.delete("/jobs/:id", (req, res) => {
+    if (!cancelJob(req.params.id)) return sendError(res, 404, "not_found", "no running job with that id");
+    console.log(`admin: canceled job ${req.params.id}`);
+    res.json({ ok: true, data: { id: req.params.id, status: "canceled" } });
+  });
+
+  router.get("/thumbnails/:id", (req, res) => {
+    const thumb = getThumbnail(req.params.id);
+    if (!thumb) return sendError(res, 404, "not_found", "no thumbnail");
+    res.set("Content-Type", "image/jpeg").send(thumb);
+  });
+
+  router.get("/presets", (req, res) => {
+    res.json({ ok: true, data: { presets: listPresets() } });
+  });
+
+  router.put("/presets/:name", (req, res) => {
+    let options;
+    try {
+      validatePreset(req.body || {});
+      options = savePreset(req.params.name, req.body);
+    } catch (err) {
+      return sendError(res, 400, "invalid_request", err.message);
+    }
+    console.log(`admin: saved preset ${req.params.name}`);
+    res.json({ ok: true, data: { name: req.params.name, options } });
+  });
+
+  router.delete("/presets/:name", (req, res) => {
+    if (!deletePreset(req.params.name)) return sendError(res, 404, "not_found", "preset not found");
+    console.log(`admin: deleted preset ${req.params.name}`);
+    res.json({ ok: true, data: { name: req.params.name } });
+  });
+
+  router.get("/profiles", (req, res) => {
+    res.json({ ok: true, data: { profiles: listProfiles() } });
+  });
+
+  router.put("/profiles/:name", (req, res) => {
+    let profile;
+    try {
+      profile = saveProfile(req.params.name, req.body);
+    } catch (err) {
+      return sendError(res, 400, "invalid_request", err.message);
+    }
+    console.log(`admin: saved profile ${req.params.name}`);
+    res.json({ ok: true, data: { name: req.params.name, profile } });
+  });
+
+  router.delete("/profiles/:name", (req, res) => {
+    if (!deleteProfile(req.params.name)) return sendError(res, 404, "not_found", "profile not found");
+    console.log(`admin: deleted profile ${req.params.name}`);
+    res.json({ ok: true, data: { name: req.params.name } });
+  });
+
+  return router;
+}
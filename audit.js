@@ -0,0 +1,97 @@
+// Append-only audit trail of capture requests, one JSON line per request in
+// audit.file: who asked (tenant, key fingerprint, client IP), for which URL
+// with which options, how long it took, the status and a SHA-256 of the
+// response body that went back to the caller.
+
+import { createWriteStream } from "node:fs";
+import { createHash } from "node:crypto";
+import { config } from "./config.js";
+
+// Option fields that carry credentials and must never reach the log
+const SECRET_FIELDS = new Set(["password", "passphrase", "key_pem", "pfx_base64", "cert_pem", "body", "state"]);
+
+let stream = null;
+function auditStream() {
+  if (!config.audit.file) return null;
+  if (!stream || stream.path !== config.audit.file) {
+    stream?.end();
+    stream = createWriteStream(config.audit.file, { flags: "a" });
+    stream.on("error", err => console.error(`audit log: ${err.message}`));
+  }
+  return stream;
+}
+
+export function redactOptions(value) {
+  if (Array.isArray(value)) return value.map(redactOptions);
+  if (value && typeof value === "object") {
+    const out = {};
+    for (const [k, v] of Object.entries(value)) {
+      if (SECRET_FIELDS.has(k)) {
+        out[k] = "[redacted]";
+      } else if (k === "headers" && v && typeof v === "object") {
+        // header names are useful in the trail; values are often Authorization or cookies
+        out[k] = Object.fromEntries(Object.keys(v).map(h => [h, "[redacted]"]));
+      } else {
+        out[k] = redactOptions(v);
+      }
+    }
+    return out;
+  }
+  return value;
+}
+
+function keyFingerprint(req) {
+  const key = (req.get("authorization") || "").replace(/^Bearer\s+/i, "") || req.get("x-api-key");
+  return key ? createHash("sha256").update(key).digest("hex").slice(0, 12) : null;
+}
+
+export function auditLog(req, res, next) {
+  const out = auditStream();
+  if (!out) return next();
+
+  const started = Date.now();
+  const hash = createHash("sha256");
+  let bytes = 0;
+  // Hash at the socket-write level so streamed responses are covered too
+  const track = (chunk, encoding) => {
+    if (chunk == null || typeof chunk === "function") return;
+    const buf = Buffer.isBuffer(chunk) ? chunk : Buffer.from(chunk, typeof encoding === "string" ? encoding : "utf8");
+    hash.update(buf);
+    bytes += buf.length;
+  };
+  const write = res.write.bind(res);
+  const end = res.end.bind(res);
+  res.write = (chunk, encoding, cb) => {
+    track(chunk, encoding);
+    return write(chunk, encoding, cb);
+  };
+  res.end = (chunk, encoding, cb) => {
+    track(chunk, encoding);
+    return end(chunk, encoding, cb);
+  };
+
+  let written = false;
+  const record = () => {
+    if (written) return;
+    written = true;
+    const { url, ...options } = req.body || {};
+    out.write(JSON.stringify({
+      time: new Date(started).toISOString(),
+      endpoint: `${req.method} ${req.path}`,
+      tenant: req.tenant ? req.tenant.id : null,
+      api_key: keyFingerprint(req),
+      client_cert: req.client_cert ? req.client_cert.subject ?? req.client_cert.fingerprint256 : null,
+      client_ip: req.ip,
+      url: url ?? null,
+      options: redactOptions(options),
+      status: res.statusCode,
+      aborted: !res.writableFinished,
+      duration_ms: Date.now() - started,
+      response_bytes: bytes,
+      response_sha256: bytes ? hash.digest("hex") : null
+    }) + "\n");
+  };
+  res.on("finish", record);
+  res.on("close", record);
+  next();
+}
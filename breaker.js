@@ -0,0 +1,136 @@
+// Per-host circuit breaker. Outcomes of captures are kept per target host for
+// limits.breaker_window_ms; once at least breaker_min_failures of them failed
+// and the failure share reaches breaker_failure_rate, the host's circuit opens
+// and new captures of it are refused with circuit_open (before taking a pool
+// slot) for breaker_cooldown_ms. After that one trial capture is let through:
+// success closes the circuit, failure opens it again.
+//
+// Only failures that say something about the target count (timeouts,
+// connection and TLS errors, crashes); bad requests and quota errors do not.
+
+import { config } from "./config.js";
+import { sendError } from "./errors.js";
+
+const TARGET_FAILURES = new Set([
+  "nav_timeout", "timeout", "dns_failure", "connection_failed", "tls_error", "navigation_failed", "browser_crashed",
+  "height_detection_failed", "capture_failed"
+]);
+
+const circuits = new Map(); // host -> { outcomes: [{ at, failed }], opened_at, open_until, trial }
+
+function circuitFor(host) {
+  let circuit = circuits.get(host);
+  if (!circuit) {
+    circuit = { outcomes: [], opened_at: null, open_until: 0, trial: false };
+    circuits.set(host, circuit);
+  }
+  return circuit;
+}
+
+function prune(circuit, now) {
+  const since = now - config.limits.breaker_window_ms;
+  while (circuit.outcomes.length && circuit.outcomes[0].at < since) circuit.outcomes.shift();
+}
+
+// Forget hosts whose outcomes have all aged out and whose circuit is closed
+function sweep(now) {
+  for (const [host, circuit] of circuits) {
+    prune(circuit, now);
+    if (!circuit.outcomes.length && !circuit.opened_at) circuits.delete(host);
+  }
+}
+
+// trial: this was the one capture let through a half-open circuit
+function record(host, failed, trial) {
+  const now = Date.now();
+  sweep(now);
+  const circuit = circuitFor(host);
+  const { breaker_min_failures: minFailures, breaker_failure_rate: rate } = config.limits;
+  const cooldown = config.limits.breaker_cooldown_ms;
+  if (trial) {
+    circuit.trial = false;
+    if (failed) {
+      circuit.open_until = now + cooldown;
+      console.log(`breaker: ${host} still failing, open for another ${cooldown}ms`);
+    } else {
+      circuits.delete(host);
+      console.log(`breaker: ${host} recovered, circuit closed`);
+    }
+    return;
+  }
+  circuit.outcomes.push({ at: now, failed });
+  prune(circuit, now);
+  const failures = circuit.outcomes.filter(o => o.failed).length;
+  if (failures >= minFailures && failures / circuit.outcomes.length >= rate && circuit.open_until <= now) {
+    circuit.opened_at = new Date(now).toISOString();
+    circuit.open_until = now + cooldown;
+    console.log(`breaker: ${host} failed ${failures}/${circuit.outcomes.length} recent captures, open for ${cooldown}ms`);
+  }
+  if (!failures && circuit.open_until <= now) circuits.delete(host);
+}
+
+function hostOf(url) {
+  try {
+    return new URL(url).hostname.toLowerCase();
+  } catch (_) {
+    return null;
+  }
+}
+
+// Express middleware for capture endpoints; place before withSlot so a dead
+// host never occupies the pool
+export function circuitBreaker(req, res, next) {
+  const host = hostOf(req.body && req.body.url);
+  if (!host || config.limits.breaker_min_failures <= 0) return next();
+  const circuit = circuits.get(host);
+  const now = Date.now();
+  if (circuit && circuit.open_until > now) {
+    res.set("Retry-After", String(Math.ceil((circuit.open_until - now) / 1000)));
+    const until = new Date(circuit.open_until).toISOString();
+    return sendError(res, 503, "circuit_open", `captures of ${host} keep failing; circuit open until ${until}`);
+  }
+  const trial = !!(circuit && circuit.opened_at);
+  if (trial) {
+    // cooldown over: one trial capture at a time
+    if (circuit.trial) {
+      res.set("Retry-After", "5");
+      return sendError(res, 503, "circuit_open", `a trial capture of ${host} is in progress`);
+    }
+    circuit.trial = true;
+  }
+  let done = false;
+  const finish = () => {
+    if (done) return;
+    done = true;
+    if (res.writableFinished && res.statusCode < 400) {
+      record(host, false, trial);
+    } else if (res.writableFinished && TARGET_FAILURES.has(res.locals.error_code)) {
+      record(host, true, trial);
+    } else if (trial) {
+      // inconclusive (client went away, bad request, ...): the next request is the trial
+      circuit.trial = false;
+    }
+  };
+  res.on("finish", finish);
+  res.on("close", finish);
+  next();
+}
+
+// Hosts with an open (or half-open) circuit, for the admin API
+export function openCircuits() {
+  const now = Date.now();
+  return [...circuits.entries()]
+    .filter(([, c]) => c.opened_at)
+    .map(([host, c]) => ({
+      host,
+      opened_at: c.opened_at,
+      open_until: new Date(c.open_until).toISOString(),
+      state: c.open_until > now ? "open" : "half_open",
+      recent_failures: c.outcomes.filter(o => o.failed).length,
+      recent_captures: c.outcomes.length
+    }));
+}
+
+export function resetCircuit(host) {
+  return circuits.delete(host.toLowerCase());
+}
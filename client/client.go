@@ -0,0 +1,354 @@
+// Package client is a Go client for the scraper's HTTP API: typed requests
+// and results for /scrape, job lookup and cancellation, and helpers for the
+// base64 screenshot payload and stored result downloads.
+//
+// The service answers captures synchronously; ScrapeAsync runs a capture in
+// the background for callers that want to do other work meanwhile, and
+// WaitForJob polls the job history for a capture started elsewhere (another
+// process, a queue worker).
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one scraper instance (or a front door).
+type Client struct {
+	BaseURL    string // e.g. "http://scraper:8090"
+	APIKey     string // sent as a bearer token when set
+	HTTPClient *http.Client
+}
+
+// New returns a Client using http.DefaultClient.
+func New(baseURL, apiKey string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), APIKey: apiKey, HTTPClient: http.DefaultClient}
+}
+
+// ScrapeRequest is a /scrape request. Options carries anything without a
+// dedicated field; dedicated fields win on conflicts.
+type ScrapeRequest struct {
+	URL            string            `json:"url"`
+	ImageFormat    string            `json:"image_format,omitempty"`
+	ViewportWidth  int               `json:"viewport_width,omitempty"`
+	ViewportHeight int               `json:"viewport_height,omitempty"`
+	TimeoutMS      int               `json:"timeout_ms,omitempty"`
+	Priority       string            `json:"priority,omitempty"`
+	Preset         string            `json:"preset,omitempty"`
+	Profile        string            `json:"profile,omitempty"`
+	Store          bool              `json:"store,omitempty"`
+	CaptureRegion  string            `json:"capture_region,omitempty"`
+	Constraints    map[string]any    `json:"constraints,omitempty"`
+	Extract        map[string]any    `json:"extract,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Options        map[string]any    `json:"-"`
+}
+
+// MarshalJSON merges Options into the request body.
+func (r ScrapeRequest) MarshalJSON() ([]byte, error) {
+	type plain ScrapeRequest
+	fields, err := json.Marshal(plain(r))
+	if err != nil || len(r.Options) == 0 {
+		return fields, err
+	}
+	body := make(map[string]any, len(r.Options))
+	for k, v := range r.Options {
+		body[k] = v
+	}
+	var named map[string]any
+	if err := json.Unmarshal(fields, &named); err != nil {
+		return nil, err
+	}
+	for k, v := range named {
+		body[k] = v
+	}
+	return json.Marshal(body)
+}
+
+// StoredResult says where a store: true capture put its output.
+type StoredResult struct {
+	Backend     string `json:"backend"`
+	Key         string `json:"key"`
+	Bytes       int64  `json:"bytes"`
+	ContentType string `json:"content_type"`
+	URL         string `json:"url,omitempty"`  // signed download URL, when the backend can sign
+	Path        string `json:"path,omitempty"` // local backend
+	// ShareURL is the service's own signed link, when share links are enabled.
+	ShareURL       string `json:"share_url,omitempty"`
+	ShareExpiresAt string `json:"share_expires_at,omitempty"`
+}
+
+// Segment is one part of a capture split by max_segment_height_px.
+type Segment struct {
+	Index            int    `json:"index"`
+	TopPx            int    `json:"top_px"`
+	HeightPx         int    `json:"height_px"`
+	ScreenshotBase64 string `json:"screenshot_base64"`
+}
+
+// Result is the data of a successful JSON /scrape response. Raw holds the
+// whole object for fields without a typed counterpart.
+type Result struct {
+	JobID            string          `json:"-"`
+	ScreenshotBase64 string          `json:"screenshot_base64,omitempty"`
+	Segments         []Segment       `json:"segments,omitempty"`
+	ContentType      string          `json:"content_type,omitempty"`
+	Title            string          `json:"title,omitempty"`
+	FinalURL         string          `json:"final_url,omitempty"`
+	TotalHeightPX    int             `json:"total_height_px,omitempty"`
+	Fields           map[string]any  `json:"fields,omitempty"`
+	Result           *StoredResult   `json:"result,omitempty"`
+	Raw              json.RawMessage `json:"-"`
+}
+
+// Screenshot decodes the inline image; nil when the result has none (stored
+// or segmented captures).
+func (r *Result) Screenshot() ([]byte, error) {
+	if r.ScreenshotBase64 == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(r.ScreenshotBase64)
+}
+
+// SaveScreenshot writes the inline image to path.
+func (r *Result) SaveScreenshot(path string) error {
+	img, err := r.Screenshot()
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return fmt.Errorf("result has no inline screenshot")
+	}
+	return os.WriteFile(path, img, 0o644)
+}
+
+// Job is a job history record.
+type Job struct {
+	ID             string `json:"id"`
+	Tenant         string `json:"tenant"`
+	Endpoint       string `json:"endpoint"`
+	URL            string `json:"url"`
+	Status         string `json:"status"` // running, succeeded, failed, aborted or canceled
+	HTTPStatus     int    `json:"http_status"`
+	ResultLocation string `json:"result_location"`
+	Error          string `json:"error"`
+	CreatedAt      string `json:"created_at"`
+	FinishedAt     string `json:"finished_at"`
+	DurationMS     int64  `json:"duration_ms"`
+}
+
+// Error is a failure envelope from the service.
+type Error struct {
+	Status    int
+	Code      string `json:"code"`
+	Message   string `json:"error"`
+	Retryable bool   `json:"retryable"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("scraper: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	// the service gives up on work nobody is waiting for
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("X-Request-Deadline", strconv.FormatInt(deadline.UnixMilli(), 10))
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		failure := &Error{Status: res.StatusCode}
+		if err := json.NewDecoder(res.Body).Decode(failure); err != nil || failure.Code == "" {
+			failure.Code, failure.Message = "http_error", res.Status
+		}
+		return nil, failure
+	}
+	return res, nil
+}
+
+// data decodes the "data" member of a success envelope into out.
+func data(res *http.Response, out any) (json.RawMessage, error) {
+	defer res.Body.Close()
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		return nil, err
+	}
+	return envelope.Data, json.Unmarshal(envelope.Data, out)
+}
+
+// Scrape captures a page and returns the JSON result. Output formats other
+// than JSON are only supported together with Store.
+func (c *Client) Scrape(ctx context.Context, req ScrapeRequest) (*Result, error) {
+	res, err := c.do(ctx, http.MethodPost, "/scrape", req)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{JobID: res.Header.Get("X-Job-Id")}
+	raw, err := data(res, result)
+	result.Raw = raw
+	return result, err
+}
+
+// Pending is a capture running in the background.
+type Pending struct {
+	done   chan struct{}
+	result *Result
+	err    error
+}
+
+// ScrapeAsync starts Scrape in the background; cancel ctx to abandon it.
+func (c *Client) ScrapeAsync(ctx context.Context, req ScrapeRequest) *Pending {
+	p := &Pending{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.result, p.err = c.Scrape(ctx, req)
+	}()
+	return p
+}
+
+// Done is closed once the capture has finished.
+func (p *Pending) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait blocks until the capture has finished.
+func (p *Pending) Wait() (*Result, error) {
+	<-p.done
+	return p.result, p.err
+}
+
+// GetJob fetches a job history record.
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	res, err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	_, err = data(res, job)
+	return job, err
+}
+
+// WaitForJob polls a job every interval until it is no longer running.
+func (c *Client) WaitForJob(ctx context.Context, id string, interval time.Duration) (*Job, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		job, err := c.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status != "running" {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Share is a share link for a job's stored result.
+type Share struct {
+	Key       string `json:"key"`
+	URL       string `json:"url"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// ShareJob makes a new share link for a job's stored result, valid for ttl
+// rounded up to whole seconds (the server default when zero).
+func (c *Client) ShareJob(ctx context.Context, id string, ttl time.Duration) (*Share, error) {
+	body := map[string]int{}
+	if ttl > 0 {
+		body["ttl_s"] = int((ttl + time.Second - 1) / time.Second)
+	}
+	res, err := c.do(ctx, http.MethodPost, "/jobs/"+url.PathEscape(id)+"/share", body)
+	if err != nil {
+		return nil, err
+	}
+	share := &Share{}
+	_, err = data(res, share)
+	return share, err
+}
+
+// CancelJob aborts a queued or running capture.
+func (c *Client) CancelJob(ctx context.Context, id string) error {
+	res, err := c.do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Download copies a stored result from its signed URL (or else its share
+// URL) to w. Signed URLs carry their own authorization, so no API key is sent.
+func (c *Client) Download(ctx context.Context, stored *StoredResult, w io.Writer) error {
+	if stored == nil || (stored.URL == "" && stored.ShareURL == "") {
+		return fmt.Errorf("stored result has no download URL")
+	}
+	link := stored.URL
+	if link == "" {
+		link = stored.ShareURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", stored.Key, res.Status)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// DownloadFile is Download into a new file at path.
+func (c *Client) DownloadFile(ctx context.Context, stored *StoredResult, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := c.Download(ctx, stored, f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,77 @@
+// Negotiated gzip/deflate response compression (server.compression). Applies
+// to JSON and text bodies only; images, ZIP bundles and WARC files are already
+// compressed and pass through untouched. Works for both res.send() bodies and
+// streamed JSON, forwarding backpressure in both directions.
+
+import zlib from "node:zlib";
+import { config } from "./config.js";
+
+const COMPRESSIBLE = /^(application\/(json|xml|javascript|ld\+json)|text\/|image\/svg\+xml)/i;
+
+// Best of gzip/deflate the client accepts, honouring q-values; gzip wins ties
+function negotiate(header) {
+  let best = null;
+  let bestQ = 0;
+  for (const part of String(header || "").split(",")) {
+    const [name, ...params] = part.trim().toLowerCase().split(";");
+    const qParam = params.map(p => p.trim()).find(p => p.startsWith("q="));
+    const q = qParam ? parseFloat(qParam.slice(2)) : 1;
+    const c = name === "*" ? "gzip" : name;
+    if (((c === "gzip" || c === "deflate") && q > bestQ) || (c === "gzip" && q === bestQ && q > 0)) {
+      best = c;
+      bestQ = q;
+    }
+  }
+  return best;
+}
+
+export function compression(req, res, next) {
+  if (!config.server.compression) return next();
+  res.vary("Accept-Encoding");
+  const encoding = negotiate(req.get("accept-encoding"));
+  if (!encoding) return next();
+
+  const write = res.write.bind(res);
+  const end = res.end.bind(res);
+  let stream = null;
+  let decided = false;
+
+  // Decide once, just before the headers go out
+  const decide = () => {
+    decided = true;
+    const length = Number(res.get("Content-Length"));
+    if (req.method === "HEAD" || res.statusCode === 204 || res.statusCode === 304 ||
+        res.get("Content-Encoding") || !COMPRESSIBLE.test(res.get("Content-Type") || "") ||
+        (length && length < config.server.compression_min_bytes)) {
+      return;
+    }
+    stream = encoding === "gzip" ? zlib.createGzip() : zlib.createDeflate();
+    res.set("Content-Encoding", encoding);
+    res.removeHeader("Content-Length");
+    stream.on("data", chunk => {
+      if (!write(chunk)) stream.pause();
+    });
+    stream.on("end", () => end());
+    // The socket drained: let zlib continue; zlib drained: wake streaming writers
+    res.on("drain", () => stream.resume());
+    stream.on("drain", () => res.emit("drain"));
+    res.on("close", () => stream.destroy());
+  };
+
+  res.write = (chunk, enc, cb) => {
+    if (!decided) decide();
+    if (!stream) return write(chunk, enc, cb);
+    return stream.write(chunk, typeof enc === "string" ? enc : undefined, typeof enc === "function" ? enc : cb);
+  };
+  res.end = (chunk, enc, cb) => {
+    if (typeof chunk === "function") [cb, chunk] = [chunk, undefined];
+    if (typeof enc === "function") [cb, enc] = [enc, undefined];
+    if (!decided) decide();
+    if (!stream) return end(chunk, enc, cb);
+    if (cb) res.once("finish", cb);
+    if (chunk != null) stream.end(chunk, enc);
+    else stream.end();
+    return res;
+  };
+  next();
+}
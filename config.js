@@ -0,0 +1,267 @@
+// Service configuration: built-in defaults, then the TOML (or JSON) file named by
+// CONFIG_FILE (default ./config.toml when present), then environment overrides.
+//
+// Any key can be overridden as SCRAPER_<SECTION>_<KEY>, e.g.
+// SCRAPER_POOL_MAX_CONCURRENCY=8. The older single-purpose variables (PORT,
+// ADMIN_TOKEN, TENANTS_FILE, ...) are still honoured via ENV_ALIASES.
+//
+// reloadConfig() (SIGHUP or POST /admin/reload) re-reads everything but only
+// applies the RELOADABLE sections; the rest need a restart.
+
+import { existsSync, readFileSync } from "node:fs";
+import { parseToml } from "./toml.js";
+
+const DEFAULTS = {
+  server: {
+    port: 8090,
+    host: "0.0.0.0",
+    json_limit: "10mb", // largest accepted request body
+    stream_threshold_bytes: 1048576, // stream JSON responses carrying more image data than this
+    compression: true, // gzip/deflate JSON and text responses when the client accepts it
+    compression_min_bytes: 1024,
+    tls_cert_file: "", // serve HTTPS when both cert and key are set
+    tls_key_file: "",
+    tls_client_ca_file: "", // CA bundle for verifying client certificates
+    tls_client_auth: "none" // "none", "optional" or "require"
+  },
+  chrome: {
+    args: ["--no-sandbox", "--disable-gpu"],
+    executable_path: "",
+    client_certs_file: ""
+  },
+  pool: {
+    max_concurrency: 4,
+    queue_timeout_ms: 60000,
+    batch_promote_ms: 30000, // priority: "batch" waiters this old are admitted ahead of interactive ones
+    max_warm_contexts: 20,
+    reuse_browser: false,
+    proxies: []
+  },
+  limits: {
+    default_timeout_ms: 30000,
+    blocked_domains: [
+      "googletagmanager.com",
+      "google-analytics.com",
+      "facebook.com/tr",
+      "hotjar.com",
+      "segment.com",
+      "mixpanel.com",
+      "fullstory.com"
+    ],
+    blocked_targets: [],
+    idempotency_ttl_ms: 600000,
+    idempotency_max_entries: 1000, // remembered responses; the least recently used go first
+    idempotency_max_bytes: 268435456, // ...and their total body size
+    idempotency_max_body_bytes: 10485760, // larger responses are not remembered; a repeat runs again
+    max_document_bytes: 52428800, // largest non-HTML main document (PDF, image, JSON) returned as content
+    breaker_min_failures: 5, // failures within the window before a host's circuit can open; 0 disables
+    breaker_failure_rate: 0.8, // ...and the share of the window's captures that failed
+    breaker_window_ms: 60000,
+    breaker_cooldown_ms: 60000 // how long an open circuit refuses captures before a trial one
+  },
+  cors: {
+    allowed_origins: [], // e.g. ["https://tools.example.com", "https://*.example.com"]
+    allowed_methods: ["GET", "POST", "PUT", "PATCH", "DELETE"],
+    allowed_headers: ["Authorization", "Content-Type", "X-API-Key", "Idempotency-Key", "X-Request-Deadline",
+      "If-None-Match"],
+    exposed_headers: ["X-Job-Id", "Idempotent-Replayed", "Retry-After", "ETag"],
+    allow_credentials: false,
+    max_age_s: 600
+  },
+  storage: {
+    usage_file: "",
+    presets_file: "",
+    profiles_file: ""
+  },
+  auth: {
+    admin_token: "",
+    tenants_file: ""
+  },
+  audit: {
+    file: ""
+  },
+  jobs: {
+    driver: "", // "", "sqlite" or "postgres"
+    sqlite_path: "jobs.db",
+    postgres_url: ""
+  },
+  evidence: {
+    key_file: "",
+    tsa_url: ""
+  },
+  ocr: {
+    engine: "tesseract",
+    endpoint: "",
+    tesseract_bin: "tesseract"
+  },
+  pdf: {
+    poppler_bin_dir: "" // pdfinfo / pdftotext / pdftoppm; empty searches PATH
+  },
+  results: {
+    backend: "", // "", "local", "s3", "gcs" or "azure"; see storage.js
+    dir: "results", // local: root directory
+    bucket: "", // s3/gcs bucket, azure container
+    prefix: "", // prepended to every key, e.g. "scrapes/"
+    path_template: "{tenant}/{id}.{ext}", // also {host}, {hash}, {fanout}, {date}, {time}
+    region: "", // s3
+    endpoint: "", // s3-compatible services (MinIO, R2, ...)
+    azure_connection_string: "",
+    url_ttl_s: 3600, // lifetime of signed download URLs
+    share_secret: "", // HMAC key for the service's own share links (share.js); empty disables them
+    share_ttl_s: 86400, // default lifetime of a share link
+    share_max_ttl_s: 2592000, // longest lifetime a caller may ask for
+    public_url: "" // base of share links, e.g. "https://scraper.example.com"; default: the request's host
+  },
+  retention: {
+    ttl_days: 0, // job records and stored results older than this are deleted
+    max_count: 0, // per tenant: only the newest this many are kept
+    max_bytes: 0, // per tenant: stored results past this total go, oldest first
+    interval_ms: 3600000 // how often the janitor runs; 0 disables it
+  },
+  kafka: {
+    brokers: [], // e.g. ["kafka-1:9092"]; empty disables the result sink
+    topic: "scrape-results",
+    client_id: "website-scraper",
+    only_succeeded: false, // publish failed jobs too unless set
+    ssl: false,
+    sasl_mechanism: "", // "plain", "scram-sha-256" or "scram-sha-512"
+    username: "",
+    password: ""
+  },
+  worker: {
+    source: "", // "nats", "sqs" or "pubsub"; empty: HTTP only. See worker.js
+    tags: [], // capabilities matched against request constraints, e.g. ["region:eu", "stealth"]
+    api_key: "", // tenant key for queued requests without an X-Api-Key header
+    max_in_flight: 4, // queued requests captured at once
+    nats_servers: [], // e.g. ["nats://nats:4222"]
+    nats_stream: "SCRAPES",
+    nats_consumer: "scraper", // durable consumer name, created if missing
+    nats_subject: "", // filter for a new consumer, e.g. "scrape.requests"
+    sqs_queue_url: "",
+    sqs_region: "",
+    pubsub_subscription: "" // name or projects/<project>/subscriptions/<name>
+  },
+  dispatch: {
+    front_door: false, // forward every capture to a peer instead of capturing here
+    peers: [] // [{ url, tags, api_key?, name? }]: where requests this instance's tags cannot serve go
+  },
+  tracing: {
+    enabled: false, // also on when OTEL_EXPORTER_OTLP_ENDPOINT is set
+    service_name: "website-scraper"
+  }
+};
+
+const RELOADABLE = ["pool", "limits", "auth", "audit", "cors", "retention"];
+
+const ENV_ALIASES = {
+  PORT: "server.port",
+  TLS_CERT_FILE: "server.tls_cert_file",
+  TLS_KEY_FILE: "server.tls_key_file",
+  MAX_CONCURRENCY: "pool.max_concurrency",
+  ADMIN_TOKEN: "auth.admin_token",
+  TENANTS_FILE: "auth.tenants_file",
+  AUDIT_LOG_FILE: "audit.file",
+  USAGE_FILE: "storage.usage_file",
+  PRESETS_FILE: "storage.presets_file",
+  PROFILES_FILE: "storage.profiles_file",
+  CLIENT_CERTS_FILE: "chrome.client_certs_file",
+  EVIDENCE_KEY_FILE: "evidence.key_file",
+  EVIDENCE_TSA_URL: "evidence.tsa_url",
+  OCR_ENGINE: "ocr.engine",
+  OCR_ENDPOINT: "ocr.endpoint",
+  TESSERACT_BIN: "ocr.tesseract_bin",
+  POPPLER_BIN_DIR: "pdf.poppler_bin_dir",
+  RESULTS_BACKEND: "results.backend",
+  AZURE_STORAGE_CONNECTION_STRING: "results.azure_connection_string",
+  KAFKA_BROKERS: "kafka.brokers",
+  WORKER_SOURCE: "worker.source",
+  NATS_URL: "worker.nats_servers",
+  SQS_QUEUE_URL: "worker.sqs_queue_url",
+  WORKER_TAGS: "worker.tags",
+  RESULTS_SHARE_SECRET: "results.share_secret"
+};
+
+// Coerce an env string to the type of the default it replaces
+function coerce(raw, example, name) {
+  if (typeof example === "number") {
+    const n = Number(raw);
+    if (Number.isNaN(n)) throw new Error(`${name} must be a number`);
+    return n;
+  }
+  if (typeof example === "boolean") return /^(1|true|yes|on)$/i.test(raw);
+  if (Array.isArray(example)) {
+    return raw.trim().startsWith("[") ? JSON.parse(raw) : raw.split(",").map(s => s.trim()).filter(Boolean);
+  }
+  return raw;
+}
+
+function setPath(cfg, path, raw, name) {
+  const [section, key] = path.split(".");
+  if (!(section in DEFAULTS) || !(key in DEFAULTS[section])) return;
+  cfg[section][key] = coerce(raw, DEFAULTS[section][key], name);
+}
+
+function readFile(file) {
+  const text = readFileSync(file, "utf8");
+  return file.endsWith(".json") ? JSON.parse(text) : parseToml(text);
+}
+
+function configFile() {
+  if (process.env.CONFIG_FILE) return process.env.CONFIG_FILE;
+  return existsSync("config.toml") ? "config.toml" : null;
+}
+
+function load() {
+  const cfg = structuredClone(DEFAULTS);
+  const file = configFile();
+  if (file) {
+    const fromFile = readFile(file);
+    for (const [section, values] of Object.entries(fromFile)) {
+      if (!(section in DEFAULTS)) throw new Error(`${file}: unknown config section [${section}]`);
+      for (const [key, value] of Object.entries(values)) {
+        if (!(key in DEFAULTS[section])) throw new Error(`${file}: unknown key ${section}.${key}`);
+        cfg[section][key] = value;
+      }
+    }
+  }
+  for (const [name, path] of Object.entries(ENV_ALIASES)) {
+    if (process.env[name] !== undefined) setPath(cfg, path, process.env[name], name);
+  }
+  for (const [name, raw] of Object.entries(process.env)) {
+    const m = /^SCRAPER_([A-Z]+)_([A-Z0-9_]+)$/.exec(name);
+    if (m) setPath(cfg, `${m[1].toLowerCase()}.${m[2].toLowerCase()}`, raw, name);
+  }
+  return cfg;
+}
+
+export const config = load();
+
+const listeners = [];
+const checks = [];
+
+// fn(config) runs after every successful reload; check(config), when given,
+// runs against the new config first and throws to refuse the whole reload
+export function onConfigReload(fn, check) {
+  listeners.push(fn);
+  if (check) checks.push(check);
+}
+
+// Returns the reloadable keys whose value changed. Nothing is applied unless
+// the new config loads and passes every check.
+export function reloadConfig() {
+  const fresh = load();
+  const next = { ...config };
+  for (const section of RELOADABLE) next[section] = fresh[section];
+  for (const check of checks) check(next);
+  const changed = [];
+  for (const section of RELOADABLE) {
+    for (const key of Object.keys(fresh[section])) {
+      if (JSON.stringify(fresh[section][key]) !== JSON.stringify(config[section][key])) {
+        changed.push(`${section}.${key}`);
+      }
+    }
+  }
+  Object.assign(config, next);
+  for (const fn of listeners) fn(config);
+  return changed;
+}
@@ -0,0 +1,39 @@
+// CORS for browser-based callers. Off until cors.allowed_origins lists at least
+// one origin ("*" allows any, "https://*.example.com" a subdomain wildcard).
+// Preflights are answered here with 204 and cached for cors.max_age_s.
+
+import { config } from "./config.js";
+
+function originAllowed(origin) {
+  return config.cors.allowed_origins.some(rule => {
+    if (rule === "*") return true;
+    if (rule.includes("://*.")) {
+      const [scheme, suffix] = rule.split("://*.");
+      return origin.startsWith(`${scheme}://`) && origin.endsWith(`.${suffix}`);
+    }
+    return rule === origin;
+  });
+}
+
+export function cors(req, res, next) {
+  const origin = req.get("origin");
+  const { allowed_origins, allowed_methods, allowed_headers, exposed_headers, allow_credentials, max_age_s } = config.cors;
+  if (!origin || allowed_origins.length === 0) return next();
+  res.vary("Origin");
+  if (!originAllowed(origin)) return next();
+
+  // Credentialed requests may not use the "*" wildcard, so always echo the origin
+  res.set("Access-Control-Allow-Origin", origin);
+  if (allow_credentials) res.set("Access-Control-Allow-Credentials", "true");
+  if (exposed_headers.length) res.set("Access-Control-Expose-Headers", exposed_headers.join(", "));
+
+  if (req.method === "OPTIONS" && req.get("access-control-request-method")) {
+    res.set("Access-Control-Allow-Methods", allowed_methods.join(", "));
+    res.set("Access-Control-Allow-Headers", allowed_headers.length
+      ? allowed_headers.join(", ")
+      : req.get("access-control-request-headers") || "");
+    res.set("Access-Control-Max-Age", String(max_age_s));
+    return res.status(204).end();
+  }
+  next();
+}
@@ -0,0 +1,83 @@
+// Caller deadlines. A request may say when its caller stops listening, either
+// as X-Request-Deadline (absolute: ISO 8601, or Unix time in s or ms) or as
+// grpc-timeout (relative, e.g. "30S", "500m", as Go/gRPC gateways forward a
+// context deadline). Past the deadline, or once the client disconnects, the
+// request's abort signal fires: a queued request leaves the queue and a
+// running capture has its pages closed instead of finishing unread work.
+// res.locals.cancel(reason) fires the same signal on demand (DELETE /jobs/:id).
+
+import { ScrapeError, sendError } from "./errors.js";
+
+const GRPC_UNITS = { H: 3600000, M: 60000, S: 1000, m: 1, u: 0.001, n: 0.000001 };
+
+// Deadline as epoch ms, null when none was given; throws on a malformed header
+export function parseDeadline(req, now = Date.now()) {
+  const absolute = req.get("x-request-deadline");
+  if (absolute) {
+    const trimmed = absolute.trim();
+    let at;
+    if (/^\d+(\.\d+)?$/.test(trimmed)) {
+      const n = Number(trimmed);
+      at = n < 1e11 ? n * 1000 : n; // small values are seconds
+    } else {
+      at = Date.parse(trimmed);
+    }
+    if (!Number.isFinite(at)) throw new Error("X-Request-Deadline must be an ISO 8601 time or a Unix timestamp");
+    return at;
+  }
+  const relative = req.get("grpc-timeout");
+  if (relative) {
+    const m = /^(\d{1,8})([HMSmun])$/.exec(relative.trim());
+    if (!m) throw new Error("grpc-timeout must be 1-8 digits followed by H, M, S, m, u or n");
+    return now + Number(m[1]) * GRPC_UNITS[m[2]];
+  }
+  return null;
+}
+
+// Express middleware: sets res.locals.deadline (epoch ms or null) and
+// res.locals.abort, an AbortSignal for the work done on this request's
+// behalf; its reason is the ScrapeError to answer with
+export function deadline(req, res, next) {
+  let at;
+  try {
+    at = parseDeadline(req);
+  } catch (err) {
+    return sendError(res, 400, "invalid_request", err.message);
+  }
+  if (at !== null && at <= Date.now()) {
+    return sendError(res, 504, "deadline_exceeded", "the request deadline has already passed");
+  }
+  const controller = new AbortController();
+  let timer = null;
+  if (at !== null) {
+    // setTimeout caps out at ~24.8 days; anything longer is as good as none
+    const wait = at - Date.now();
+    if (wait < 2 ** 31) {
+      timer = setTimeout(() => {
+        controller.abort(new ScrapeError("deadline_exceeded", "request deadline exceeded", 504));
+      }, wait);
+      timer.unref();
+    }
+  }
+  res.on("close", () => {
+    clearTimeout(timer);
+    if (!res.writableFinished) controller.abort(new ScrapeError("deadline_exceeded", "client disconnected", 504));
+  });
+  res.on("finish", () => clearTimeout(timer));
+  res.locals.deadline = at;
+  res.locals.abort = controller.signal;
+  res.locals.cancel = reason => controller.abort(reason);
+  next();
+}
+
+// Answer a request whose work was cut short by res.locals.abort
+export function sendAborted(res) {
+  const reason = res.locals.abort.reason;
+  return sendError(res, reason.status || 504, reason.code || "deadline_exceeded", reason.message);
+}
+
+// Longest a step may take given the deadline, never more than timeoutMs
+export function remainingMs(res, timeoutMs) {
+  const at = res.locals.deadline;
+  return at == null ? timeoutMs : Math.max(1, Math.min(timeoutMs, at - Date.now()));
+}
@@ -0,0 +1,151 @@
+// Capability routing across a fleet of scrapers. Each instance advertises
+// worker.tags, e.g. ["region:eu", "stealth", "chrome:124"]. A request may
+// carry constraints, e.g. { region: "eu", needs: ["stealth"] }: every key but
+// needs must match a "key:value" tag and every entry of needs a bare tag.
+// When this instance falls short the request is forwarded to a capable peer
+// from dispatch.peers and the peer's response relayed unchanged. Queue
+// workers do not forward; they hand the message back for another worker.
+//
+// capture_region: "de" is shorthand for constraints: { region: "de" }, for
+// capturing geo-personalized pages from the right vantage point. With
+// dispatch.front_door set this instance captures nothing itself: every
+// request goes to a peer, and X-Capture-Region says where it ran.
+
+import { Readable } from "node:stream";
+import { config } from "./config.js";
+import { sendError } from "./errors.js";
+import { sendAborted } from "./deadline.js";
+
+const FORWARDED_HEADER = "x-scraper-forwarded";
+// fetch has already decoded the body and the relay re-frames it
+const DROPPED_HEADERS = new Set([
+  "connection", "keep-alive", "transfer-encoding", "content-encoding", "content-length"
+]);
+
+// Normalize a request's constraints to { key: value, needs: [...] }; throws
+// on malformed input, null when there are none
+export function parseConstraints(value) {
+  if (value == null) return null;
+  if (typeof value !== "object" || Array.isArray(value)) throw new Error("constraints must be an object");
+  const out = { needs: [] };
+  for (const [key, v] of Object.entries(value)) {
+    if (key === "needs") {
+      const needs = typeof v === "string" ? [v] : v;
+      if (!Array.isArray(needs) || !needs.every(n => typeof n === "string" && n)) {
+        throw new Error("constraints.needs must be a tag or a list of tags");
+      }
+      out.needs = needs;
+    } else if (typeof v === "string" && v) {
+      out[key] = v;
+    } else {
+      throw new Error(`constraints.${key} must be a non-empty string`);
+    }
+  }
+  return out;
+}
+
+// Constraints of a /scrape body, capture_region folded in as region
+export function requestConstraints(body) {
+  const constraints = parseConstraints(body.constraints);
+  const region = body.capture_region;
+  if (region == null) return constraints;
+  if (typeof region !== "string" || !/^[a-z0-9-]+$/i.test(region)) {
+    throw new Error("capture_region must be a region or country code like \"de\" or \"eu-west\"");
+  }
+  const out = constraints || { needs: [] };
+  if (out.region && out.region.toLowerCase() !== region.toLowerCase()) {
+    throw new Error(`capture_region "${region}" contradicts constraints.region "${out.region}"`);
+  }
+  out.region = region.toLowerCase();
+  return out;
+}
+
+// Whether tags meet parsed constraints
+export function satisfies(constraints, tags) {
+  if (!constraints) return true;
+  const have = new Set(tags);
+  return Object.entries(constraints).every(([key, v]) =>
+    key === "needs" ? v.every(tag => have.has(tag)) : have.has(`${key}:${v}`));
+}
+
+export function localTags() {
+  return config.worker.tags;
+}
+
+let nextPeer = 0;
+
+// Peers able to take the request, rotated so load spreads across them
+function candidates(constraints) {
+  const peers = config.dispatch.peers.filter(p => satisfies(constraints, p.tags || []));
+  const start = nextPeer++ % Math.max(1, peers.length);
+  return [...peers.slice(start), ...peers.slice(0, start)];
+}
+
+function forwardHeaders(req, res, peer) {
+  const headers = { "Content-Type": "application/json", [FORWARDED_HEADER]: "1" };
+  if (peer.api_key) headers.Authorization = `Bearer ${peer.api_key}`;
+  else if (req.get("authorization")) headers.Authorization = req.get("authorization");
+  else if (req.get("x-api-key")) headers["X-Api-Key"] = req.get("x-api-key");
+  for (const name of ["idempotency-key", "traceparent", "tracestate"]) {
+    if (req.get(name)) headers[name] = req.get(name);
+  }
+  if (res.locals.deadline != null) headers["X-Request-Deadline"] = String(res.locals.deadline);
+  return headers;
+}
+
+async function relay(upstream, res, peer) {
+  res.status(upstream.status);
+  for (const [name, value] of upstream.headers) {
+    // the job the caller can look up and cancel is the one recorded here
+    if (!DROPPED_HEADERS.has(name) && name !== "x-job-id") res.set(name, value);
+  }
+  res.set("X-Capture-Worker", peer.name || new URL(peer.url).host);
+  const region = (peer.tags || []).find(tag => tag.startsWith("region:"));
+  if (region) res.set("X-Capture-Region", region.slice("region:".length));
+  if (!upstream.body) return res.end();
+  Readable.fromWeb(upstream.body).on("error", () => res.destroy()).pipe(res);
+}
+
+// Express middleware for capture endpoints; place after resolvePreset, so a
+// preset's constraints and capture_region route the request, and after
+// trackJob and admitCapture, so a forwarded capture is recorded and counts
+// against the caller's tenant here (the peer only sees dispatch.peers'
+// api_key), and before circuitBreaker and withSlot, which guard local captures
+export async function dispatch(req, res, next) {
+  let constraints;
+  try {
+    constraints = requestConstraints(req.options ?? req.body ?? {});
+  } catch (err) {
+    return sendError(res, 400, "invalid_request", err.message);
+  }
+  if (!config.dispatch.front_door && satisfies(constraints, localTags())) return next();
+  const { needs = [], ...keys } = constraints || {};
+  const wanted = JSON.stringify(needs.length ? { ...keys, needs } : keys);
+  // a peer that was sent this request should have matched; never bounce it on
+  if (req.get(FORWARDED_HEADER)) {
+    return sendError(res, 422, "no_capable_worker", `forwarded request does not match this worker's tags: ${wanted}`);
+  }
+  const peers = candidates(constraints);
+  if (!peers.length) return sendError(res, 422, "no_capable_worker", `no worker satisfies constraints ${wanted}`);
+  for (const peer of peers) {
+    let upstream;
+    try {
+      upstream = await fetch(new URL(req.originalUrl, peer.url), {
+        method: req.method,
+        headers: forwardHeaders(req, res, peer),
+        body: JSON.stringify(req.body),
+        signal: res.locals.abort
+      });
+    } catch (err) {
+      if (res.locals.abort?.aborted) {
+        if (!res.writableEnded) sendAborted(res);
+        return;
+      }
+      console.error(`dispatch: ${peer.url}: ${err.message}`);
+      continue;
+    }
+    return relay(upstream, res, peer);
+  }
+  res.set("Retry-After", "5");
+  return sendError(res, 502, "worker_unavailable", `no worker satisfying ${wanted} could be reached`);
+}
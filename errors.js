@@ -0,0 +1,85 @@
+// Machine-readable error codes. Every failure envelope is
+//   { ok: false, error: "<human text>", code: "<code>", retryable: <bool> }
+// so clients can branch on the failure class instead of parsing messages.
+// retryable means the same request may well succeed if sent again later.
+
+export const ERROR_CODES = {
+  invalid_request: false,
+  body_too_large: false,
+  unauthorized: false,
+  not_found: false,
+  blocked_by_policy: false,
+  idempotency_conflict: false,
+  quota_exceeded: false,
+  concurrency_limited: true,
+  queue_timeout: true,
+  circuit_open: true,
+  no_capable_worker: false,
+  worker_unavailable: true,
+  deadline_exceeded: false,
+  canceled: false,
+  nav_timeout: true,
+  timeout: true,
+  wait_timeout: true,
+  dns_failure: false,
+  connection_failed: true,
+  tls_error: false,
+  proxy_error: true,
+  navigation_aborted: false,
+  navigation_failed: true,
+  browser_crashed: true,
+  height_detection_failed: true,
+  capture_failed: true,
+  encode_error: false,
+  storage_failed: true,
+  internal_error: false
+};
+
+export class ScrapeError extends Error {
+  constructor(code, message, status) {
+    super(message);
+    this.code = code;
+    this.status = status;
+  }
+}
+
+export function errorBody(code, message) {
+  return { ok: false, error: message, code, retryable: ERROR_CODES[code] ?? false };
+}
+
+export function sendError(res, status, code, message) {
+  res.locals.error_code = code; // for middleware that looks at how a request ended (breaker.js)
+  return res.status(status).json(errorBody(code, message));
+}
+
+// Chrome network error -> code
+const NET_ERRORS = [
+  [/ERR_NAME_NOT_RESOLVED|ERR_NAME_RESOLUTION_FAILED/, "dns_failure"],
+  [/ERR_CERT_|ERR_SSL_|ERR_BAD_SSL/, "tls_error"],
+  [/ERR_PROXY_|ERR_TUNNEL_CONNECTION_FAILED|ERR_SOCKS_/, "proxy_error"],
+  [/ERR_CONNECTION_|ERR_TIMED_OUT|ERR_ADDRESS_UNREACHABLE|ERR_NETWORK_CHANGED|ERR_EMPTY_RESPONSE|ERR_INTERNET_DISCONNECTED/,
+    "connection_failed"],
+  [/ERR_ABORTED|ERR_BLOCKED_BY_|ERR_INVALID_URL|ERR_UNSAFE_/, "navigation_aborted"]
+];
+
+// Pipeline stage (jobs.setStage) -> code for otherwise unrecognised errors
+const STAGE_CODES = {
+  navigating: "navigation_failed",
+  scrolling: "capture_failed",
+  capturing: "capture_failed",
+  encoding: "encode_error"
+};
+
+// Best-effort classification of an error thrown during a capture
+export function classifyError(err, stage) {
+  if (err instanceof ScrapeError) return err.code;
+  const message = String(err && err.message);
+  if (/Target (page, context or browser )?(has been |)closed|Browser (has been )?closed|crash/i.test(message)) {
+    return "browser_crashed";
+  }
+  for (const [pattern, code] of NET_ERRORS) {
+    if (pattern.test(message)) return code;
+  }
+  if (err && err.name === "TimeoutError") return stage === "navigating" ? "nav_timeout" : "timeout";
+  return STAGE_CODES[stage] || "internal_error";
+}
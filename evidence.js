@@ -0,0 +1,119 @@
+// Evidence mode: tamper-evident capture bundles.
+// The manifest of SHA-256 digests is signed with the server key (evidence.key_file)
+// and/or timestamped by an RFC 3161 authority (evidence.tsa_url).
+
+import { createHash, createPrivateKey, createPublicKey, randomBytes, sign } from "node:crypto";
+import { readFileSync } from "node:fs";
+import { config } from "./config.js";
+
+const SHA256_OID = Buffer.from("0609608648016503040201", "hex"); // 2.16.840.1.101.3.4.2.1
+
+let signingKey = null;
+if (config.evidence.key_file) {
+  signingKey = createPrivateKey(readFileSync(config.evidence.key_file));
+}
+
+export function sha256(data) {
+  return createHash("sha256").update(data).digest("hex");
+}
+
+// DER helpers, just enough to build a TimeStampReq
+function der(tag, body) {
+  let len;
+  if (body.length < 0x80) len = Buffer.from([body.length]);
+  else if (body.length < 0x100) len = Buffer.from([0x81, body.length]);
+  else len = Buffer.from([0x82, body.length >> 8, body.length & 0xff]);
+  return Buffer.concat([Buffer.from([tag]), len, body]);
+}
+
+function derInteger(buf) {
+  // keep it positive
+  return der(0x02, buf[0] & 0x80 ? Buffer.concat([Buffer.from([0]), buf]) : buf);
+}
+
+function timeStampRequest(digest, nonce) {
+  const algorithm = der(0x30, Buffer.concat([SHA256_OID, Buffer.from([0x05, 0x00])]));
+  const imprint = der(0x30, Buffer.concat([algorithm, der(0x04, digest)]));
+  return der(0x30, Buffer.concat([
+    derInteger(Buffer.from([1])),
+    imprint,
+    derInteger(nonce),
+    Buffer.from([0x01, 0x01, 0xff]) // certReq TRUE
+  ]));
+}
+
+// PKIStatusInfo.status is the first INTEGER inside the response; 0/1 mean granted
+function timeStampStatus(resp) {
+  let i = 0;
+  const skipHeader = () => {
+    i++;
+    const first = resp[i++];
+    if (first & 0x80) i += first & 0x7f;
+  };
+  skipHeader(); // TimeStampResp
+  skipHeader(); // PKIStatusInfo
+  if (resp[i] !== 0x02) return null;
+  return resp[i + 2];
+}
+
+async function requestTimestamp(tsaUrl, digest, timeoutMs) {
+  const nonce = randomBytes(8);
+  const resp = await fetch(tsaUrl, {
+    method: "POST",
+    headers: { "Content-Type": "application/timestamp-query" },
+    body: timeStampRequest(digest, nonce),
+    signal: AbortSignal.timeout(timeoutMs)
+  });
+  if (!resp.ok) throw new Error(`TSA responded ${resp.status}`);
+  const body = Buffer.from(await resp.arrayBuffer());
+  const status = timeStampStatus(body);
+  return {
+    tsa_url: tsaUrl,
+    status,
+    granted: status === 0 || status === 1,
+    nonce: nonce.toString("hex"),
+    response_base64: body.toString("base64")
+  };
+}
+
+// Build the signed manifest for a capture; images is a list of encoded buffers
+export async function buildEvidence({ url, final_url, captured_at, software, images, html, timeoutMs = 10000 }) {
+  const manifest = {
+    url,
+    final_url,
+    captured_at,
+    software,
+    image_sha256: images.map(sha256),
+    html_sha256: sha256(html)
+  };
+  const manifestBytes = Buffer.from(JSON.stringify(manifest), "utf8");
+  const digest = createHash("sha256").update(manifestBytes).digest();
+
+  const bundle = {
+    manifest,
+    manifest_sha256: digest.toString("hex"),
+    rendered_html: html,
+    signature: null,
+    timestamp: null
+  };
+
+  if (signingKey) {
+    const keyType = signingKey.asymmetricKeyType;
+    const algorithm = keyType === "ed25519" || keyType === "ed448" ? null : "sha256";
+    bundle.signature = {
+      algorithm: algorithm ? `${keyType}-sha256` : keyType,
+      public_key_pem: createPublicKey(signingKey).export({ type: "spki", format: "pem" }),
+      value_base64: sign(algorithm, manifestBytes, signingKey).toString("base64")
+    };
+  }
+
+  if (config.evidence.tsa_url) {
+    try {
+      bundle.timestamp = await requestTimestamp(config.evidence.tsa_url, digest, timeoutMs);
+    } catch (err) {
+      bundle.timestamp = { tsa_url: config.evidence.tsa_url, granted: false, error: err.message };
+    }
+  }
+
+  return bundle;
+}
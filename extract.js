@@ -0,0 +1,612 @@
+// Structured extraction from the rendered DOM. Each helper runs a
+// self-contained function in the page and returns plain JSON.
+
+// Run fn(elements, arg) in the page over everything matching selector. The
+// selector goes through Playwright, so besides CSS it may be XPath
+// ("xpath=//td[2]", or any selector starting with "//" or "..").
+export async function evaluateMatches(page, selector, fn, arg) {
+  const handles = await page.$$(selector);
+  try {
+    return await page.evaluate(fn, [handles, arg]);
+  } finally {
+    await Promise.all(handles.map(h => h.dispose?.()));
+  }
+}
+
+function toCsv(rows) {
+  return rows
+    .map(row => row.map(cell => (/[",\n\r]/.test(cell) ? `"${cell.replace(/"/g, '""')}"` : cell)).join(","))
+    .join("\r\n");
+}
+
+// Tables with colspan/rowspan expanded into a rectangular grid
+export async function extractTables(page, { selector = "table", format = "rows" } = {}) {
+  const tables = await evaluateMatches(page, selector, ([matches]) => matches.filter(el => el.tagName === "TABLE").map((table, index) => {
+    const grid = [];
+    const rows = Array.from(table.rows);
+    rows.forEach((tr, r) => {
+      grid[r] = grid[r] || [];
+      let c = 0;
+      for (const cell of Array.from(tr.cells)) {
+        while (grid[r][c] !== undefined) c++;
+        const text = (cell.innerText || cell.textContent || "").replace(/\s+/g, " ").trim();
+        const rowspan = Math.max(1, Math.min(cell.rowSpan || 1, rows.length - r));
+        const colspan = Math.max(1, Math.min(cell.colSpan || 1, 1000));
+        for (let dr = 0; dr < rowspan; dr++) {
+          grid[r + dr] = grid[r + dr] || [];
+          for (let dc = 0; dc < colspan; dc++) grid[r + dr][c + dc] = text;
+        }
+        c += colspan;
+      }
+    });
+    const width = Math.max(0, ...grid.map(row => row.length));
+    const normalized = grid.map(row => Array.from({ length: width }, (_, i) => row[i] ?? ""));
+    const first = rows[0];
+    const hasHeader = !!first && (first.parentElement?.tagName === "THEAD" ||
+      Array.from(first.cells).every(cell => cell.tagName === "TH"));
+    return {
+      index,
+      id: table.id || null,
+      caption: table.caption ? table.caption.innerText.trim() : null,
+      headers: hasHeader ? normalized[0] : null,
+      rows: hasHeader ? normalized.slice(1) : normalized
+    };
+  }));
+
+  if (format !== "csv") return tables;
+  return tables.map(({ headers, rows, ...t }) => ({ ...t, csv: toCsv(headers ? [headers, ...rows] : rows) }));
+}
+
+// Every anchor with an href, absolutized and classified against the page host
+export async function extractLinks(page) {
+  return page.evaluate(() => {
+    const bareHost = host => host.replace(/^www\./, "");
+    const pageHost = bareHost(location.hostname);
+    return Array.from(document.querySelectorAll("a[href]")).map(a => {
+      let type = "other";
+      if (/^https?:$/.test(a.protocol)) type = bareHost(a.hostname) === pageHost ? "internal" : "external";
+      return {
+        href: a.href,
+        text: (a.innerText || a.textContent || "").replace(/\s+/g, " ").trim(),
+        title: a.title || null,
+        rel: a.rel ? a.rel.split(/\s+/).filter(Boolean) : [],
+        target: a.target || null,
+        type
+      };
+    });
+  });
+}
+
+// Readability-style main article: score paragraph containers, keep the best one
+export async function extractArticle(page) {
+  return page.evaluate(() => {
+    const meta = (...names) => {
+      for (const n of names) {
+        const el = document.querySelector(`meta[property="${n}"], meta[name="${n}"], meta[itemprop="${n}"]`);
+        if (el && el.content) return el.content.trim();
+      }
+      return null;
+    };
+    const clean = t => (t || "").replace(/[ \t\f\v ]+/g, " ").replace(/\n\s*\n+/g, "\n\n").trim();
+
+    let ld = {};
+    for (const s of document.querySelectorAll('script[type="application/ld+json"]')) {
+      try {
+        const items = [].concat(JSON.parse(s.textContent)).flatMap(x => x["@graph"] || [x]);
+        const article = items.find(x => /Article|BlogPosting|NewsArticle/.test([].concat(x["@type"]).join(" ")));
+        if (article) { ld = article; break; }
+      } catch (_) {}
+    }
+    const ldAuthor = [].concat(ld.author || []).map(a => (typeof a === "string" ? a : a.name)).filter(Boolean).join(", ");
+
+    const POSITIVE = /article|body|content|entry|main|page|post|story|text|blog/i;
+    const NEGATIVE = /comment|footer|footnote|sidebar|side|nav|menu|ad-|ads|promo|related|share|social|sponsor|widget|banner|header|masthead|cookie|modal|popup/i;
+    const classWeight = el => {
+      const s = `${el.className || ""} ${el.id || ""}`;
+      return (POSITIVE.test(s) ? 25 : 0) - (NEGATIVE.test(s) ? 25 : 0);
+    };
+
+    const scores = new Map();
+    for (const p of document.querySelectorAll("p, pre, td, blockquote")) {
+      const text = (p.innerText || "").trim();
+      if (text.length < 25) continue;
+      const score = 1 + text.split(",").length + Math.min(3, Math.floor(text.length / 100));
+      const parent = p.parentElement;
+      const grand = parent && parent.parentElement;
+      if (parent) scores.set(parent, (scores.get(parent) ?? classWeight(parent)) + score);
+      if (grand) scores.set(grand, (scores.get(grand) ?? classWeight(grand)) + score / 2);
+    }
+
+    let best = null, bestScore = 0;
+    for (const [el, score] of scores) {
+      // penalize link-heavy blocks (menus, tag clouds)
+      const text = el.innerText || "";
+      const linkText = Array.from(el.querySelectorAll("a")).reduce((n, a) => n + (a.innerText || "").length, 0);
+      const adjusted = score * (1 - (text.length ? linkText / text.length : 0));
+      if (adjusted > bestScore) { best = el; bestScore = adjusted; }
+    }
+    const root = best || document.querySelector("article, main, [role=main]") || document.body;
+
+    const blocks = Array.from(root.querySelectorAll("h1, h2, h3, h4, p, li, pre, blockquote"))
+      .filter(el => !NEGATIVE.test(`${el.className || ""} ${el.id || ""}`))
+      .map(el => clean(el.innerText))
+      .filter(Boolean);
+    const text = blocks.length ? blocks.join("\n\n") : clean(root.innerText);
+
+    const leadImg = meta("og:image", "twitter:image") ||
+      [].concat(ld.image || []).map(i => (typeof i === "string" ? i : i.url)).find(Boolean) ||
+      Array.from(root.querySelectorAll("img")).find(img => img.naturalWidth >= 300)?.src ||
+      null;
+    const timeEl = document.querySelector("time[datetime]");
+
+    return {
+      title: meta("og:title", "twitter:title") || ld.headline || document.querySelector("h1")?.innerText.trim() || document.title,
+      byline: meta("author", "article:author") || ldAuthor ||
+        clean(document.querySelector('[rel="author"], [itemprop="author"], .byline, .author')?.innerText) || null,
+      published_at: meta("article:published_time", "datePublished", "date") || ld.datePublished ||
+        (timeEl && timeEl.getAttribute("datetime")) || null,
+      lead_image_url: leadImg ? new URL(leadImg, location.href).href : null,
+      excerpt: meta("description", "og:description") || text.slice(0, 300),
+      text,
+      length: text.length
+    };
+  });
+}
+
+const STOPWORDS = {
+  en: ["the", "and", "of", "to", "in", "is", "that", "for", "with", "on", "are", "this", "you", "it"],
+  es: ["de", "la", "que", "el", "en", "los", "del", "las", "por", "con", "una", "para", "es", "se"],
+  fr: ["le", "la", "les", "des", "et", "est", "une", "pour", "dans", "que", "du", "pas", "sur", "vous"],
+  de: ["der", "die", "und", "das", "ist", "nicht", "mit", "den", "sie", "ein", "auf", "für", "von", "sich"],
+  it: ["il", "di", "che", "la", "per", "non", "una", "sono", "del", "della", "con", "gli", "le", "è"],
+  pt: ["de", "que", "não", "para", "uma", "com", "os", "do", "da", "em", "as", "por", "mais", "você"],
+  nl: ["de", "het", "een", "van", "en", "is", "dat", "niet", "met", "voor", "op", "zijn", "ook", "wij"],
+  vi: ["và", "của", "là", "các", "có", "được", "cho", "không", "những", "một", "này", "với", "người", "trong"],
+  id: ["yang", "dan", "di", "ini", "itu", "dengan", "untuk", "tidak", "dari", "dalam", "akan", "pada", "juga", "ada"]
+};
+
+const SCRIPTS = [
+  ["ja", /[぀-ヿ]/g],
+  ["ko", /[가-힯]/g],
+  ["zh", /[一-鿿]/g],
+  ["ru", /[Ѐ-ӿ]/g],
+  ["ar", /[؀-ۿ]/g],
+  ["he", /[֐-׿]/g],
+  ["th", /[฀-๿]/g],
+  ["hi", /[ऀ-ॿ]/g],
+  ["el", /[Ͱ-Ͽ]/g]
+];
+
+// Script ranges first, then stopword frequency for Latin-script languages
+export function detectLanguage(text) {
+  const sample = text.slice(0, 20000);
+  const letters = (sample.match(/\p{L}/gu) || []).length;
+  if (!letters) return { language: null, confidence: 0 };
+  for (const [lang, re] of SCRIPTS) {
+    const hits = (sample.match(re) || []).length;
+    if (hits / letters > 0.3) return { language: lang, confidence: Math.min(1, +(hits / letters).toFixed(2)) };
+  }
+  const words = sample.toLowerCase().split(/[^\p{L}]+/u).filter(Boolean);
+  let best = null, bestHits = 0, total = 0;
+  for (const [lang, list] of Object.entries(STOPWORDS)) {
+    const set = new Set(list);
+    const hits = words.reduce((n, w) => n + (set.has(w) ? 1 : 0), 0);
+    total += hits;
+    if (hits > bestHits) { best = lang; bestHits = hits; }
+  }
+  return { language: best, confidence: total ? +(bestHits / total).toFixed(2) : 0 };
+}
+
+// Visible text plus the declared language and h1-h3 outline
+export async function extractText(page) {
+  const raw = await page.evaluate(() => ({
+    text: (document.body?.innerText || "").trim(),
+    declared_language: document.documentElement.lang ||
+      document.querySelector('meta[http-equiv="content-language" i]')?.content || null,
+    headings: Array.from(document.querySelectorAll("h1, h2, h3"))
+      .map(h => ({ level: +h.tagName[1], text: (h.innerText || "").replace(/\s+/g, " ").trim() }))
+      .filter(h => h.text)
+  }));
+  return { ...raw, stats: contentStats(raw.text, raw.declared_language, raw.headings) };
+}
+
+// Line-oriented text rendering for diffing runs: one block per line,
+// whitespace collapsed, "#" heading, "-" list and "|" table-cell markers,
+// links as [text](href). Hidden and non-content elements are skipped.
+export async function textSnapshot(page) {
+  const lines = await page.evaluate(() => {
+    const SKIP = new Set(["SCRIPT", "STYLE", "NOSCRIPT", "TEMPLATE", "SVG", "CANVAS", "IFRAME", "OBJECT", "HEAD"]);
+    const BLOCK = new Set(["ADDRESS", "ARTICLE", "ASIDE", "BLOCKQUOTE", "CAPTION", "DD", "DETAILS", "DIALOG", "DIV", "DL",
+      "DT", "FIELDSET", "FIGCAPTION", "FIGURE", "FOOTER", "FORM", "HEADER", "HR", "LEGEND", "MAIN", "NAV", "OL", "P",
+      "PRE", "SECTION", "SUMMARY", "TABLE", "TBODY", "TFOOT", "THEAD", "UL"]);
+    const hidden = el => {
+      if (el.hidden || el.getAttribute("aria-hidden") === "true") return true;
+      if (typeof getComputedStyle !== "function") return false;
+      const cs = getComputedStyle(el);
+      return cs.display === "none" || cs.visibility === "hidden";
+    };
+    const out = [];
+    let line = "";
+    let prefix = "";
+    const flush = () => {
+      const text = line.replace(/\s+/g, " ").replace(/\s*\|\s*$/, "").trim();
+      if (text) out.push(prefix + text);
+      line = "";
+    };
+    const walk = (node, depth) => {
+      if (node.nodeType === 3) {
+        line += node.nodeValue;
+        return;
+      }
+      if (node.nodeType !== 1 || SKIP.has(node.tagName) || hidden(node)) return;
+      const tag = node.tagName;
+      const children = () => node.childNodes.forEach(child => walk(child, depth));
+      if (tag === "BR") return flush();
+      if (tag === "IMG") {
+        const alt = (node.getAttribute("alt") || "").trim();
+        if (alt) line += ` [image: ${alt}] `;
+        return;
+      }
+      if (tag === "A" && node.getAttribute("href")) {
+        const before = line;
+        line = "";
+        children();
+        const text = line.replace(/\s+/g, " ").trim();
+        line = before + (text ? ` [${text}](${node.href}) ` : "");
+        return;
+      }
+      const heading = /^H([1-6])$/.exec(tag);
+      if (heading || tag === "LI" || tag === "TR") {
+        flush();
+        const outer = prefix;
+        prefix = heading ? `${"#".repeat(+heading[1])} ` : tag === "LI" ? `${"  ".repeat(depth)}- ` : "| ";
+        node.childNodes.forEach(child => walk(child, tag === "LI" ? depth + 1 : depth));
+        flush();
+        prefix = outer;
+        return;
+      }
+      if (tag === "TD" || tag === "TH") {
+        children();
+        line += " | ";
+        return;
+      }
+      if (BLOCK.has(tag)) {
+        flush();
+        children();
+        flush();
+        return;
+      }
+      children();
+    };
+    if (document.title) out.push(`title: ${document.title.replace(/\s+/g, " ").trim()}`);
+    if (document.body) walk(document.body, 0);
+    flush();
+    return out;
+  });
+  return lines.join("\n") + "\n";
+}
+
+export function contentStats(text, declaredLanguage, headings) {
+  const detected = detectLanguage(text);
+  return {
+    language: detected.language || (declaredLanguage ? declaredLanguage.split(/[-_]/)[0].toLowerCase() : null),
+    language_confidence: detected.confidence,
+    declared_language: declaredLanguage,
+    word_count: (text.match(/[\p{L}\p{N}]+/gu) || []).length,
+    character_count: text.length,
+    headings
+  };
+}
+
+const MAX_ICON_BYTES = 5 * 1024 * 1024;
+
+// Best favicon/apple-touch-icon and the og:image, downloaded through the
+// page's own context so cookies and auth carry over
+export async function fetchIcons(page, timeoutMs) {
+  const found = await page.evaluate(() => {
+    const abs = href => { try { return new URL(href, document.baseURI).href; } catch (_) { return null; } };
+    const icons = Array.from(document.querySelectorAll('link[rel~="icon" i], link[rel~="apple-touch-icon" i], link[rel~="apple-touch-icon-precomposed" i]'))
+      .map(link => {
+        const sizes = (link.getAttribute("sizes") || "").toLowerCase();
+        const size = sizes === "any" ? 1024 : Math.max(0, ...sizes.split(/\s+/).map(s => parseInt(s, 10) || 0));
+        const svg = /svg/.test(link.type) || /\.svg(\?|$)/i.test(link.href);
+        return { url: abs(link.getAttribute("href")), rel: link.rel, size: svg ? 1024 : size || (/apple/i.test(link.rel) ? 180 : 16) };
+      })
+      .filter(i => i.url);
+    const og = document.querySelector('meta[property="og:image" i], meta[name="og:image" i], meta[name="twitter:image" i]');
+    return {
+      icons,
+      fallback: abs("/favicon.ico"),
+      og_image: og && og.content ? abs(og.content) : null
+    };
+  });
+
+  const download = async url => {
+    try {
+      const resp = await page.context().request.get(url, { timeout: timeoutMs, maxRedirects: 5 });
+      const body = await resp.body();
+      if (!resp.ok() || body.length === 0 || body.length > MAX_ICON_BYTES) return null;
+      return {
+        url,
+        status: resp.status(),
+        content_type: resp.headers()["content-type"] || null,
+        bytes: body.length,
+        base64: body.toString("base64")
+      };
+    } catch (_) {
+      return null;
+    }
+  };
+
+  const candidates = found.icons.sort((a, b) => b.size - a.size).map(i => i.url);
+  candidates.push(found.fallback);
+  let favicon = null;
+  for (const url of [...new Set(candidates)]) {
+    if ((favicon = await download(url))) break;
+  }
+  return {
+    favicon,
+    og_image: found.og_image ? await download(found.og_image) : null
+  };
+}
+
+// OpenGraph / Twitter card / basic meta for link previews
+export async function extractOpenGraph(page) {
+  return page.evaluate(() => {
+    const pick = (...names) => {
+      for (const n of names) {
+        const el = document.querySelector(`meta[property="${n}" i], meta[name="${n}" i]`);
+        if (el && el.content) return el.content.trim();
+      }
+      return null;
+    };
+    const abs = href => { try { return href ? new URL(href, document.baseURI).href : null; } catch (_) { return null; } };
+    const og = {};
+    for (const el of document.querySelectorAll('meta[property^="og:" i], meta[name^="twitter:" i]')) {
+      const key = el.getAttribute("property") || el.getAttribute("name");
+      if (el.content && !(key in og)) og[key.toLowerCase()] = el.content.trim();
+    }
+    return {
+      title: pick("og:title", "twitter:title") || document.title || null,
+      description: pick("og:description", "twitter:description", "description"),
+      site_name: pick("og:site_name", "application-name") || location.hostname,
+      image_url: abs(pick("og:image", "og:image:url", "twitter:image")),
+      canonical_url: abs(document.querySelector('link[rel="canonical" i]')?.getAttribute("href")) || location.href,
+      type: pick("og:type"),
+      twitter_card: pick("twitter:card"),
+      og
+    };
+  });
+}
+
+const AVAILABILITY = {
+  instock: "in_stock",
+  outofstock: "out_of_stock",
+  soldout: "out_of_stock",
+  preorder: "preorder",
+  presale: "preorder",
+  backorder: "backorder",
+  limitedavailability: "limited",
+  instoreonly: "in_store_only",
+  onlineonly: "in_stock",
+  discontinued: "discontinued"
+};
+
+function normalizeAvailability(value) {
+  if (!value) return null;
+  const key = String(value).replace(/^.*[/#]/, "").replace(/[\s_-]/g, "").toLowerCase();
+  return AVAILABILITY[key] || (/^(available|yes|true)$/.test(key) ? "in_stock" : key || null);
+}
+
+// Product record from JSON-LD Product/Offer, microdata and OpenGraph product
+// tags, first source wins per field; sources lists which ones contributed
+export async function extractProduct(page) {
+  const raw = await page.evaluate(() => {
+    const abs = href => { try { return href ? new URL(href, document.baseURI).href : null; } catch (_) { return null; } };
+    const first = v => (Array.isArray(v) ? v[0] : v);
+    const text = v => (v == null ? null : typeof v === "object" ? v.name ?? v["@value"] ?? null : String(v).trim() || null);
+    const images = v => [].concat(v || []).map(i => abs(typeof i === "object" ? i.url || i.contentUrl : i)).filter(Boolean);
+
+    // JSON-LD: find the first node typed Product anywhere in any script
+    let ld = null;
+    const visit = node => {
+      if (ld || !node || typeof node !== "object") return;
+      if (Array.isArray(node)) return node.forEach(visit);
+      const types = [].concat(node["@type"] || []).map(String);
+      if (types.some(t => /(^|\/)(Product|ProductGroup|IndividualProduct)$/.test(t))) { ld = node; return; }
+      Object.values(node).forEach(visit);
+    };
+    for (const script of document.querySelectorAll('script[type="application/ld+json" i]')) {
+      try { visit(JSON.parse(script.textContent)); } catch (_) {}
+    }
+    const fromLd = ld && (() => {
+      const offers = [].concat(ld.offers || []).flatMap(o => (o && o["@type"] === "AggregateOffer" && o.offers ? [].concat(o.offers) : [o]));
+      const offer = offers.find(o => o && (o.price != null || o.lowPrice != null || o.priceSpecification)) || offers[0] || {};
+      const spec = first(offer.priceSpecification) || {};
+      return {
+        name: text(ld.name),
+        price: offer.price ?? offer.lowPrice ?? spec.price ?? null,
+        currency: offer.priceCurrency ?? spec.priceCurrency ?? null,
+        availability: text(offer.availability),
+        images: images(ld.image),
+        brand: text(first(ld.brand)),
+        sku: text(ld.sku ?? ld.mpn ?? ld.gtin13 ?? ld.gtin ?? null),
+        url: abs(offer.url || ld.url)
+      };
+    })();
+
+    // Microdata: itemscope itemtype=".../Product"
+    const item = document.querySelector('[itemscope][itemtype$="/Product" i], [itemscope][itemtype*="schema.org/Product" i]');
+    const prop = (root, name) => {
+      const el = root && root.querySelector(`[itemprop="${name}"]`);
+      if (!el) return null;
+      return el.getAttribute("content") ?? el.getAttribute("href") ?? el.getAttribute("src") ?? el.textContent.trim();
+    };
+    const fromMicrodata = item && {
+      name: prop(item, "name"),
+      price: prop(item, "price") ?? prop(item, "lowPrice"),
+      currency: prop(item, "priceCurrency"),
+      availability: prop(item, "availability"),
+      images: Array.from(item.querySelectorAll('[itemprop="image"]'))
+        .map(el => abs(el.getAttribute("content") || el.getAttribute("src") || el.getAttribute("href"))).filter(Boolean),
+      brand: prop(item, "brand"),
+      sku: prop(item, "sku"),
+      url: abs(prop(item, "url"))
+    };
+
+    const meta = (...names) => {
+      for (const n of names) {
+        const el = document.querySelector(`meta[property="${n}" i], meta[name="${n}" i]`);
+        if (el && el.content) return el.content.trim();
+      }
+      return null;
+    };
+    const ogImage = meta("og:image", "og:image:url");
+    const ogPrice = meta("product:price:amount", "og:price:amount", "product:sale_price:amount");
+    const fromOg = (ogPrice || meta("og:type") === "product") && {
+      name: meta("og:title"),
+      price: ogPrice,
+      currency: meta("product:price:currency", "og:price:currency", "product:sale_price:currency"),
+      availability: meta("product:availability", "og:availability"),
+      images: ogImage ? [abs(ogImage)] : [],
+      brand: meta("product:brand", "og:brand"),
+      sku: meta("product:retailer_item_id"),
+      url: abs(meta("og:url"))
+    };
+    return { jsonld: fromLd, microdata: fromMicrodata, opengraph: fromOg };
+  });
+
+  const sources = Object.entries(raw).filter(([, record]) => record);
+  if (!sources.length) return null;
+  const pick = field => {
+    for (const [, record] of sources) {
+      const value = record[field];
+      if (value != null && value !== "" && !(Array.isArray(value) && !value.length)) return value;
+    }
+    return null;
+  };
+  const price = pick("price");
+  return {
+    name: pick("name"),
+    price: price == null ? null : typeof price === "number" ? price : parseNumber(String(price)),
+    currency: pick("currency") ? String(pick("currency")).toUpperCase() : null,
+    availability: normalizeAvailability(pick("availability")),
+    images: [...new Set(sources.flatMap(([, record]) => record.images || []))],
+    brand: pick("brand"),
+    sku: pick("sku"),
+    url: pick("url"),
+    sources: sources.map(([name]) => name)
+  };
+}
+
+// First number in text, whatever the grouping: "$1,299.00", "1.299,00 €", "CHF 1'299.50"
+export function parseNumber(text) {
+  const m = text.match(/-?\d[\d.,\s']*/);
+  if (!m) return null;
+  let s = m[0].replace(/[\s']/g, "").replace(/[.,]$/, "");
+  const lastDot = s.lastIndexOf(".");
+  const lastComma = s.lastIndexOf(",");
+  if (lastDot >= 0 && lastComma >= 0) {
+    const decimal = lastDot > lastComma ? "." : ",";
+    s = s.split(decimal === "." ? "," : ".").join("").replace(",", ".");
+  } else if (lastComma >= 0) {
+    // a lone group of three after the comma(s) reads as thousands: 1,299 / 1,299,000
+    s = /^-?\d{1,3}(,\d{3})+$/.test(s) ? s.replace(/,/g, "") : s.replace(",", ".");
+  } else if (lastDot >= 0 && (s.match(/\./g) || []).length > 1) {
+    s = s.replace(/\./g, "");
+  }
+  const n = Number(s);
+  return Number.isFinite(n) ? n : null;
+}
+
+const MAX_STYLED_ELEMENTS = 200;
+
+// Resolved (getComputedStyle) values for each element matching each selector
+export async function extractComputedStyles(page, { selectors = [], properties = [] }) {
+  const results = [];
+  for (const selector of selectors) {
+    try {
+      results.push({ selector, ...await evaluateMatches(page, selector, stylesOf, { properties, limit: MAX_STYLED_ELEMENTS }) });
+    } catch (err) {
+      results.push({ selector, error: err.message, elements: [] });
+    }
+  }
+  return results;
+}
+
+// In-page: computed styles for the first `limit` matches
+function stylesOf([nodes, { properties, limit }]) {
+  return {
+    matched: nodes.length,
+    elements: nodes.slice(0, limit).map(el => {
+      const cs = getComputedStyle(el);
+      const styles = {};
+      for (const prop of properties) styles[prop] = cs.getPropertyValue(prop);
+      return {
+        tag: el.tagName.toLowerCase(),
+        id: el.id || null,
+        classes: Array.from(el.classList),
+        text: (el.innerText || el.textContent || "").replace(/\s+/g, " ").trim().slice(0, 120),
+        styles
+      };
+    })
+  };
+}
+
+// Font families actually used by text on the page, joined with the
+// document.fonts load status of any matching web font faces
+export async function fontInventory(page) {
+  return page.evaluate(async () => {
+    await document.fonts.ready.catch(() => {});
+    const unquote = f => f.trim().replace(/^["']|["']$/g, "");
+    const GENERIC = new Set(["serif", "sans-serif", "monospace", "cursive", "fantasy", "system-ui", "ui-sans-serif",
+      "ui-serif", "ui-monospace", "ui-rounded", "emoji", "math", "fangsong", "-apple-system", "blinkmacsystemfont"]);
+
+    const faces = new Map();
+    for (const face of document.fonts) {
+      const family = unquote(face.family);
+      if (!faces.has(family.toLowerCase())) faces.set(family.toLowerCase(), []);
+      faces.get(family.toLowerCase()).push({ weight: face.weight, style: face.style, status: face.status });
+    }
+
+    const usage = new Map();
+    const walker = document.createTreeWalker(document.body || document.documentElement, NodeFilter.SHOW_TEXT);
+    const seen = new Set();
+    while (walker.nextNode()) {
+      const el = walker.currentNode.parentElement;
+      if (!el || seen.has(el) || !walker.currentNode.textContent.trim()) continue;
+      seen.add(el);
+      const cs = getComputedStyle(el);
+      if (cs.display === "none" || cs.visibility === "hidden") continue;
+      const stack = cs.fontFamily;
+      const entry = usage.get(stack) || { stack, families: stack.split(",").map(unquote), elements: 0 };
+      entry.elements++;
+      usage.set(stack, entry);
+    }
+
+    const families = new Map();
+    for (const { families: list, elements } of usage.values()) {
+      list.forEach((family, position) => {
+        const key = family.toLowerCase();
+        const f = families.get(key) || { family, elements: 0, primary_elements: 0 };
+        f.elements += elements;
+        if (position === 0) f.primary_elements += elements;
+        families.set(key, f);
+      });
+    }
+
+    return {
+      families: Array.from(families.entries()).map(([key, f]) => {
+        const webFaces = faces.get(key) || [];
+        let status = "system";
+        if (GENERIC.has(key)) status = "generic";
+        else if (webFaces.some(x => x.status === "loaded")) status = "loaded";
+        else if (webFaces.some(x => x.status === "error")) status = "error";
+        else if (webFaces.length) status = "unloaded";
+        else if (!document.fonts.check(`16px "${f.family}"`)) status = "unavailable";
+        return { ...f, webfont: webFaces.length > 0, status, faces: webFaces };
+      }).sort((a, b) => b.elements - a.elements),
+      stacks: Array.from(usage.values()).map(({ stack, elements }) => ({ stack, elements }))
+    };
+  });
+}
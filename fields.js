@@ -0,0 +1,175 @@
+// Named field extraction: extract: { price: { selector, attribute, regex, ... } }.
+// Each field's raw strings come from the page and are then cleaned up here,
+// in order: trim -> regex (group 1 by default, the whole match without groups) ->
+// JSONPath (into parsed JSON, e.g. a ld+json script tag) -> type ("string",
+// "number", "integer", "boolean", "date").
+// A field given as a bare string is just { selector }.
+
+import { Script, createContext } from "node:vm";
+import { evaluateMatches, parseNumber } from "./extract.js";
+
+const TYPES = ["string", "number", "integer", "boolean", "date"];
+const MAX_FIELDS = 100;
+// Caller regexes run against page text on the event loop; both bounds keep a
+// catastrophically backtracking pattern from stalling the server
+const MAX_REGEX_INPUT = 100000;
+const REGEX_TIMEOUT_MS = 50;
+const regexScript = new Script("re.exec(value)");
+const regexSandbox = createContext({});
+
+// Normalize the extract option into { name: spec }; throws on malformed specs
+export function fieldSpecs(extract) {
+  if (extract == null) return {};
+  if (typeof extract !== "object" || Array.isArray(extract)) throw new Error("extract must be an object of field name -> spec");
+  const entries = Object.entries(extract);
+  if (entries.length > MAX_FIELDS) throw new Error(`extract: at most ${MAX_FIELDS} fields`);
+  const specs = {};
+  for (const [name, value] of entries) {
+    const spec = typeof value === "string" ? { selector: value } : value;
+    if (!spec || typeof spec !== "object") throw new Error(`extract.${name} must be a selector or an object`);
+    const { regex, json_path, type = "string" } = spec;
+    // Default to the first capture group, or the whole match when there is none
+    let group = 0;
+    if (regex != null) {
+      try {
+        group = new RegExp(`${regex}|`).exec("").length > 1 ? 1 : 0;
+      } catch (err) {
+        throw new Error(`extract.${name}.regex: ${err.message}`);
+      }
+    }
+    if (spec.group !== undefined) group = spec.group;
+    if (!(Number.isInteger(group) || typeof group === "string")) throw new Error(`extract.${name}.group must be an index or a name`);
+    if (json_path != null) parseJsonPath(json_path, `extract.${name}.json_path`);
+    if (!TYPES.includes(type)) throw new Error(`extract.${name}.type must be one of ${TYPES.join(", ")}`);
+    specs[name] = { attribute: "text", all: false, trim: true, group, type, ...spec };
+  }
+  return specs;
+}
+
+// In-page: the requested attribute of each match ("text", "html" or any attribute/property)
+function valuesOf([nodes, attribute]) {
+  return nodes.map(el => {
+    if (attribute === "text") return el.innerText || el.textContent || "";
+    if (attribute === "html") return el.innerHTML;
+    const value = el.getAttribute(attribute) ?? el[attribute];
+    return value == null ? null : String(value);
+  });
+}
+
+// { fields, errors } for the page's current document
+export async function extractFields(page, specs) {
+  const fields = {};
+  const errors = {};
+  for (const [name, spec] of Object.entries(specs)) {
+    try {
+      const raw = await evaluateMatches(page, spec.selector, valuesOf, spec.attribute);
+      const values = raw.filter(v => v != null).map(v => postProcess(v, spec)).filter(v => v !== undefined);
+      fields[name] = spec.all ? values : values.length ? values[0] : null;
+    } catch (err) {
+      fields[name] = spec.all ? [] : null;
+      errors[name] = err.message;
+    }
+  }
+  return { fields, errors: Object.keys(errors).length ? errors : undefined };
+}
+
+// undefined drops the value (regex did not match), null keeps an unparseable one
+function postProcess(raw, spec) {
+  let value = spec.trim ? raw.replace(/\s+/g, " ").trim() : raw;
+  if (spec.regex != null) {
+    if (value.length > MAX_REGEX_INPUT) throw new Error(`value over ${MAX_REGEX_INPUT} characters; regex not applied`);
+    const match = execBounded(new RegExp(spec.regex), value);
+    if (!match) return undefined;
+    value = typeof spec.group === "string" ? match.groups?.[spec.group] : match[spec.group];
+    if (value === undefined) return undefined;
+  }
+  if (spec.json_path != null) {
+    value = queryJsonPath(JSON.parse(value), spec.json_path);
+    if (value === undefined) return undefined;
+  }
+  return convert(value, spec.type);
+}
+
+function execBounded(re, value) {
+  regexSandbox.re = re;
+  regexSandbox.value = value;
+  try {
+    return regexScript.runInContext(regexSandbox, { timeout: REGEX_TIMEOUT_MS });
+  } catch (err) {
+    if (err.code === "ERR_SCRIPT_EXECUTION_TIMEOUT") throw new Error(`regex ran longer than ${REGEX_TIMEOUT_MS}ms`);
+    throw err;
+  } finally {
+    regexSandbox.re = regexSandbox.value = null;
+  }
+}
+
+function convert(value, type) {
+  if (type === "string") return value == null || typeof value === "object" ? value : String(value);
+  if (Array.isArray(value)) return value.map(v => convert(v, type));
+  if (value == null) return null;
+  if (type === "number" || type === "integer") {
+    const n = typeof value === "number" ? value : parseNumber(String(value));
+    if (n == null) return null;
+    return type === "integer" ? Math.round(n) : n;
+  }
+  if (type === "boolean") {
+    if (typeof value === "boolean") return value;
+    const s = String(value).trim().toLowerCase();
+    if (["true", "yes", "1", "on", "y"].includes(s)) return true;
+    if (["false", "no", "0", "off", "n", ""].includes(s)) return false;
+    return null;
+  }
+  // date: ISO 8601 in UTC
+  const t = typeof value === "number" ? value : Date.parse(String(value));
+  return Number.isFinite(t) ? new Date(t).toISOString() : null;
+}
+
+// JSONPath subset: $, .key, ['key'], [n], [*], .*, ..key
+function parseJsonPath(path, field = "json_path") {
+  if (typeof path !== "string" || !path.startsWith("$")) throw new Error(`${field} must start with "$"`);
+  const steps = [];
+  const re = /\.\.([A-Za-z_$][\w$-]*|\*)|\.([A-Za-z_$][\w$-]*|\*)|\[(\d+|\*|'[^']*'|"[^"]*")\]/y;
+  re.lastIndex = 1;
+  while (re.lastIndex < path.length) {
+    const start = re.lastIndex;
+    const m = re.exec(path);
+    if (!m || m.index !== start) throw new Error(`${field}: cannot parse ${path} at ${start}`);
+    if (m[1] !== undefined) steps.push({ deep: true, key: m[1] });
+    else if (m[2] !== undefined) steps.push({ key: m[2] });
+    else if (/^\d+$/.test(m[3])) steps.push({ index: Number(m[3]) });
+    else steps.push({ key: m[3] === "*" ? "*" : m[3].slice(1, -1) });
+  }
+  return steps;
+}
+
+function descendants(value, out = []) {
+  if (value && typeof value === "object") {
+    out.push(value);
+    for (const v of Object.values(value)) descendants(v, out);
+  }
+  return out;
+}
+
+// A single match is returned as-is, several (wildcards, ..) as an array
+export function queryJsonPath(root, path) {
+  let nodes = [root];
+  let multiple = false;
+  for (const step of parseJsonPath(path)) {
+    if (step.deep) {
+      multiple = true;
+      nodes = nodes.flatMap(n => descendants(n));
+    }
+    if (step.index !== undefined) {
+      nodes = nodes.filter(Array.isArray).map(n => n[step.index]);
+    } else if (step.key === "*") {
+      multiple = true;
+      nodes = nodes.filter(n => n && typeof n === "object").flatMap(n => Object.values(n));
+    } else {
+      nodes = nodes.filter(n => n && typeof n === "object" && !Array.isArray(n) && Object.hasOwn(n, step.key))
+        .map(n => n[step.key]);
+    }
+    nodes = nodes.filter(n => n !== undefined);
+  }
+  if (multiple) return nodes;
+  return nodes.length ? nodes[0] : undefined;
+}
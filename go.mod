@@ -0,0 +1,3 @@
+module github.com/bqthang0307/Website-Scrape---Golang
+
+go 1.21
@@ -0,0 +1,155 @@
+// engine: "http" — a plain HTTP fetch with no browser. Redirects are followed
+// by hand so every hop is checked against the target blocklist, bodies are
+// decompressed by fetch itself, and extraction runs the same in-page helpers
+// from extract.js against a jsdom document (optional dependency).
+
+import { isBlockedTarget } from "./settings.js";
+import { ScrapeError } from "./errors.js";
+
+const MAX_REDIRECTS = 10;
+const MAX_BODY_BYTES = 50 * 1024 * 1024;
+const DEFAULT_USER_AGENT = "Mozilla/5.0 (compatible; website-scraper)";
+// Caller headers that still go out after a redirect to another origin; the rest
+// (Authorization, cookies, API keys) are meant for the origin that was asked for
+const PORTABLE_HEADERS = new Set(["user-agent", "accept", "accept-language", "save-data"]);
+
+async function readBody(response) {
+  const chunks = [];
+  let size = 0;
+  for await (const chunk of response.body || []) {
+    size += chunk.length;
+    if (size > MAX_BODY_BYTES) throw new ScrapeError("navigation_failed", `response body exceeds ${MAX_BODY_BYTES} bytes`);
+    chunks.push(Buffer.from(chunk));
+  }
+  return Buffer.concat(chunks);
+}
+
+// Fetch url, following redirects. Returns the final response plus each hop
+// as a WARC-ready exchange.
+// abort: optional AbortSignal from the caller (deadline.js)
+export async function fetchDocument(url, { method = "GET", headers = {}, body, auth, timeoutMs, abort }) {
+  const signal = abort ? AbortSignal.any([AbortSignal.timeout(timeoutMs), abort]) : AbortSignal.timeout(timeoutMs);
+  const origin = new URL(url).origin;
+  const redirects = [];
+  const exchanges = [];
+  let current = url;
+  let currentMethod = method;
+  let currentBody = body;
+  for (;;) {
+    const target = new URL(current);
+    if (isBlockedTarget(target.hostname)) {
+      throw new ScrapeError("blocked_by_policy", `captures of ${target.hostname} are blocked`, 403);
+    }
+    const sameOrigin = target.origin === origin;
+    const requestHeaders = { "user-agent": DEFAULT_USER_AGENT, accept: "*/*" };
+    for (const [name, value] of Object.entries(headers)) {
+      if (sameOrigin || PORTABLE_HEADERS.has(name.toLowerCase())) requestHeaders[name] = value;
+    }
+    // credentials stay on the original origin, as with the browser's http_auth
+    if (auth && target.origin === (auth.origin || origin)) {
+      requestHeaders.authorization = `Basic ${Buffer.from(`${auth.username}:${auth.password ?? ""}`).toString("base64")}`;
+    }
+    let response;
+    try {
+      response = await fetch(current, {
+        method: currentMethod,
+        headers: requestHeaders,
+        body: currentBody,
+        redirect: "manual",
+        signal
+      });
+    } catch (err) {
+      if (err.name === "TimeoutError") throw new ScrapeError("nav_timeout", `fetching ${current} timed out after ${timeoutMs}ms`);
+      throw new ScrapeError("connection_failed", `fetching ${current} failed: ${err.cause?.message || err.message}`);
+    }
+    const responseBody = await readBody(response);
+    exchanges.push({
+      url: current,
+      method: currentMethod,
+      requestHeaders,
+      postData: currentBody == null ? null : Buffer.from(currentBody),
+      status: response.status,
+      statusText: response.statusText,
+      responseHeaders: Object.fromEntries(response.headers),
+      body: responseBody,
+      date: new Date().toISOString()
+    });
+
+    const location = response.headers.get("location");
+    if (response.status >= 300 && response.status < 400 && location) {
+      if (redirects.length >= MAX_REDIRECTS) throw new ScrapeError("navigation_failed", `more than ${MAX_REDIRECTS} redirects`);
+      redirects.push({ url: current, status: response.status });
+      current = new URL(location, current).href;
+      if (response.status === 303 || ((response.status === 301 || response.status === 302) && currentMethod === "POST")) {
+        currentMethod = "GET";
+        currentBody = undefined;
+      }
+      continue;
+    }
+    return {
+      url: current,
+      status: response.status,
+      headers: Object.fromEntries(response.headers),
+      body: responseBody,
+      redirects,
+      exchanges
+    };
+  }
+}
+
+const MIN_STATIC_TEXT = 500;
+
+// Heuristic for engine: "auto": does the served HTML already carry the page's
+// text, or is it an app shell waiting for JavaScript?
+export function looksStatic(html) {
+  const text = html
+    .replace(/<(script|style|noscript|template)\b[\s\S]*?<\/\1\s*>/gi, " ")
+    .replace(/<[^>]+>/g, " ")
+    .replace(/&[a-z0-9#]+;/gi, " ")
+    .replace(/\s+/g, " ")
+    .trim();
+  if (text.length < MIN_STATIC_TEXT) return false;
+  return !/\b(enable|requires?) javascript\b|javascript (is )?(required|disabled)/i.test(text);
+}
+
+let jsdom = null;
+async function loadJsdom() {
+  if (!jsdom) {
+    try {
+      jsdom = await import("jsdom");
+    } catch (_) {
+      throw new ScrapeError("invalid_request", "extraction with engine: \"http\" requires the jsdom package", 400);
+    }
+  }
+  return jsdom;
+}
+
+// Just enough of Playwright's Page for the extract.js helpers: evaluate runs
+// the function with document/window/location bound to the parsed document.
+// Nothing is laid out, so innerText falls back to textContent.
+export async function documentPage(html, url) {
+  const { JSDOM } = await loadJsdom();
+  const { window } = new JSDOM(html, { url });
+  if (!("innerText" in window.HTMLElement.prototype)) {
+    Object.defineProperty(window.HTMLElement.prototype, "innerText", {
+      get() { return this.textContent; }
+    });
+  }
+  return {
+    evaluate: async (fn, arg) => {
+      const bound = new Function("window", "document", "location", `return (${fn.toString()});`);
+      return bound(window, window.document, window.location)(arg);
+    },
+    // Playwright's selector syntax, reduced to CSS and XPath
+    $$: async selector => {
+      const xpath = selector.startsWith("xpath=") ? selector.slice(6) : /^\(*(\/\/|\.\.)/.test(selector) ? selector : null;
+      if (xpath == null) return Array.from(window.document.querySelectorAll(selector));
+      const found = window.document.evaluate(xpath, window.document, null, window.XPathResult.ORDERED_NODE_SNAPSHOT_TYPE, null);
+      return Array.from({ length: found.snapshotLength }, (_, i) => found.snapshotItem(i)).filter(n => n.nodeType === 1);
+    },
+    url: () => url,
+    title: async () => window.document.title,
+    content: async () => html,
+    close: () => window.close()
+  };
+}
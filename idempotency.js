@@ -0,0 +1,133 @@
+// Idempotency-Key support for capture endpoints. The first request with a given
+// key (per tenant) runs normally and its final response is remembered for
+// limits.idempotency_ttl_ms; repeats within that window get the same status,
+// headers and body back (Idempotent-Replayed: true) without touching Chrome.
+// A repeat that arrives while the original is still running waits for it.
+// Reusing a key with a different request body is a 422. 429/5xx responses and
+// canceled jobs are not remembered so the caller's retry gets a fresh attempt.
+// Remembered responses are bounded by count and total size (least recently
+// used dropped first); one over idempotency_max_body_bytes is not kept at all.
+
+import { createHash } from "node:crypto";
+import { config } from "./config.js";
+import { sendError } from "./errors.js";
+
+const REPLAYED_HEADERS = ["content-type", "content-disposition", "x-job-id"];
+
+// Insertion order doubles as recency: a replay moves its entry to the end
+const entries = new Map();
+let storedBytes = 0;
+
+function forget(id) {
+  const entry = entries.get(id);
+  if (!entry) return;
+  entries.delete(id);
+  storedBytes -= entry.bytes;
+}
+
+function sweep() {
+  const now = Date.now();
+  for (const [key, entry] of entries) {
+    if (entry.expires && entry.expires < now) forget(key);
+  }
+}
+
+// Drop the least recently used finished entries until both caps hold; running
+// ones stay, since repeats are waiting on them
+function evict() {
+  const { idempotency_max_entries: maxEntries, idempotency_max_bytes: maxBytes } = config.limits;
+  for (const [key, entry] of entries) {
+    if (entries.size <= maxEntries && storedBytes <= maxBytes) return;
+    if (entry.expires) forget(key);
+  }
+}
+
+function fingerprint(req) {
+  return createHash("sha256").update(`${req.method} ${req.path}\n${JSON.stringify(req.body || {})}`).digest("hex");
+}
+
+function replay(res, stored) {
+  for (const [name, value] of Object.entries(stored.headers)) res.set(name, value);
+  res.set("Idempotent-Replayed", "true");
+  return res.status(stored.status).send(stored.body);
+}
+
+// Express middleware; place after authenticate so keys are scoped per tenant
+export async function idempotency(req, res, next) {
+  const key = req.get("idempotency-key");
+  if (!key || config.limits.idempotency_ttl_ms <= 0) return next();
+  if (key.length > 255) {
+    return sendError(res, 400, "invalid_request", "Idempotency-Key must be at most 255 characters");
+  }
+  sweep();
+
+  const id = `${req.tenant ? req.tenant.id : ""}\n${key}`;
+  const print = fingerprint(req);
+  const existing = entries.get(id);
+  if (existing) {
+    if (existing.fingerprint !== print) {
+      return sendError(res, 422, "idempotency_conflict", "Idempotency-Key was already used with a different request");
+    }
+    const stored = await existing.done;
+    if (stored) {
+      if (entries.get(id) === existing) {
+        entries.delete(id);
+        entries.set(id, existing);
+      }
+      return replay(res, stored);
+    }
+    // The original failed in a way we don't remember; fall through and run again
+  }
+
+  let settle;
+  const entry = { fingerprint: print, expires: 0, bytes: 0, done: new Promise(resolve => { settle = resolve; }) };
+  forget(id);
+  entries.set(id, entry);
+
+  // Collected at the write level so streamed JSON is remembered as well; null
+  // once the body outgrows idempotency_max_body_bytes
+  let chunks = [];
+  let size = 0;
+  const keep = (chunk, encoding) => {
+    if (chunk == null || typeof chunk === "function" || !chunks) return;
+    const buf = Buffer.isBuffer(chunk) ? chunk : Buffer.from(chunk, typeof encoding === "string" ? encoding : "utf8");
+    size += buf.length;
+    if (size > config.limits.idempotency_max_body_bytes) chunks = null;
+    else chunks.push(buf);
+  };
+  const write = res.write.bind(res);
+  const end = res.end.bind(res);
+  res.write = (chunk, encoding, cb) => {
+    keep(chunk, encoding);
+    return write(chunk, encoding, cb);
+  };
+  res.end = (chunk, encoding, cb) => {
+    keep(chunk, encoding);
+    return end(chunk, encoding, cb);
+  };
+
+  let settled = false;
+  const finish = () => {
+    if (settled) return;
+    settled = true;
+    const remember = res.statusCode !== 429 && res.statusCode < 500 && res.locals.error_code !== "canceled";
+    if (res.writableFinished && remember && chunks && entries.get(id) === entry) {
+      const headers = {};
+      for (const name of REPLAYED_HEADERS) {
+        const value = res.get(name);
+        if (value) headers[name] = value;
+      }
+      entry.expires = Date.now() + config.limits.idempotency_ttl_ms;
+      entry.bytes = size;
+      storedBytes += size;
+      settle({ status: res.statusCode, headers, body: Buffer.concat(chunks) });
+      evict();
+    } else {
+      if (entries.get(id) === entry) forget(id);
+      settle(null);
+    }
+  };
+  res.on("finish", finish);
+  res.on("close", finish);
+  next();
+}
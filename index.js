@@ -1,206 +1,3007 @@
 import express from "express";
 import { chromium } from "playwright";
 import sharp from "sharp";
+import http from "node:http";
+import https from "node:https";
+import { readFileSync } from "node:fs";
+import { createHash } from "node:crypto";
+import { buildXmpPacket, embedXmp } from "./xmp.js";
+import { buildEvidence } from "./evidence.js";
+import { runOcr } from "./ocr.js";
+import { pdfInfo, pdfPages, pdfText } from "./pdf.js";
+import { documentPage, fetchDocument, looksStatic } from "./httpfetch.js";
+import { extractFields, fieldSpecs } from "./fields.js";
+import { MAX_PAGES, paginateBrowser, paginateHttp } from "./paginate.js";
+import { perceptualHashes } from "./phash.js";
+import { createZip } from "./zip.js";
+import { createWarc } from "./warc.js";
+import { watchSecurity } from "./security.js";
+import { admitCapture, authenticate, chargePixels, chargeTransfer, tenantsEnabled, usageReport } from "./tenants.js";
+import { isBlockedTarget, nextProxy, settings } from "./settings.js";
+import { PRIORITIES, acquireSlot, queueStats, releaseSlot, withSlot } from "./queue.js";
+import { adminRouter } from "./admin.js";
+import { circuitBreaker } from "./breaker.js";
+import { deadline, remainingMs, sendAborted } from "./deadline.js";
+import { registerResultStore, startJanitor } from "./retention.js";
+import { resultKey, resultStorage, storageEnabled, tenantOfKey } from "./storage.js";
+import { startResultSink } from "./kafka.js";
+import { startWorker } from "./worker.js";
+import { dispatch } from "./dispatch.js";
+import { shareUrl, sharingEnabled, verifyShare } from "./share.js";
+import { config, reloadConfig } from "./config.js";
+import { auditLog, redactOptions } from "./audit.js";
+import { idempotency } from "./idempotency.js";
+import { listPresets, resolvePreset, withPreset } from "./presets.js";
+import { applyFingerprint, getProfile, listProfiles } from "./profiles.js";
+import { browserProxy, checkProxy } from "./proxyauth.js";
+import { summarize, watchTransfer } from "./transfer.js";
+import { watchResources } from "./resources.js";
+import { Base64Value, sendJson } from "./jsonstream.js";
+import { compression } from "./compression.js";
+import { cors } from "./cors.js";
+import { ScrapeError, classifyError, errorBody, sendError } from "./errors.js";
+import { cancelJob, getJob, listJobs, runningJobs, setStage, setThumbnail, trackJob } from "./jobs.js";
+import { dashboardHtml } from "./ui.js";
+import { traceAttributes, traceRequest, traceStage } from "./tracing.js";
+import { runShutdownHooks } from "./shutdown.js";
+import {
+  evaluateMatches,
+  extractArticle,
+  extractComputedStyles,
+  extractLinks,
+  extractOpenGraph,
+  extractProduct,
+  extractTables,
+  extractText,
+  fetchIcons,
+  fontInventory,
+  textSnapshot
+} from "./extract.js";
+
+const SERVICE_VERSION = JSON.parse(readFileSync(new URL("./package.json", import.meta.url), "utf8")).version;
+const SOFTWARE = `website-scraper/${SERVICE_VERSION}`;
 
 const app = express();
-app.use(express.json({ limit: "10mb" }));
 
-app.post("/scrape", async (req, res) => {
-  const {
-    url,
-    timeout_ms = 30000,
-    viewport_width = 1280,
-    viewport_height = 1024,
-    settle_delay_ms = 300,
-    overlap_px = 140,
-    image_format = "jpeg", // "png" or "jpeg"
-    jpeg_quality = 85,
-  } = req.body;
+const EXTENSIONS = { jpeg: "jpg", png: "png", webp: "webp", avif: "avif" };
+const CONTENT_TYPES = { jpeg: "image/jpeg", png: "image/png", webp: "image/webp", avif: "image/avif" };
+const DEFAULT_SNAPSHOT_STYLES = [
+  "display",
+  "visibility",
+  "opacity",
+  "position",
+  "z-index",
+  "color",
+  "background-color",
+  "font-family",
+  "font-size",
+  "font-weight"
+];
+// Chrome DevTools throttling presets; throughput in kbit/s
+const NETWORK_PRESETS = {
+  "offline": { offline: true, latency_ms: 0, download_kbps: 0, upload_kbps: 0 },
+  "slow-3g": { latency_ms: 2000, download_kbps: 400, upload_kbps: 400 },
+  "fast-3g": { latency_ms: 562.5, download_kbps: 1440, upload_kbps: 675 },
+  "slow-4g": { latency_ms: 150, download_kbps: 1600, upload_kbps: 750 },
+  "4g": { latency_ms: 20, download_kbps: 9000, upload_kbps: 9000 }
+};
+const MIN_AUTO_QUALITY = 30;
+const MIN_AUTO_SCALE = 0.25;
+
+// Sharp encoder options for the requested output format
+function encodeOptions(enc, quality = enc.quality) {
+  if (enc.format === "jpeg") return { quality, progressive: enc.progressive, mozjpeg: enc.progressive };
+  if (enc.format === "webp") return { quality };
+  if (enc.format === "png" && enc.png_palette) {
+    // libimagequant (pngquant) quantization down to an indexed palette
+    return { palette: true, colours: enc.png_colors, quality, dither: 1.0, compressionLevel: 9 };
+  }
+  if (enc.format === "avif") {
+    // speed 0 (slowest/smallest) .. 9 (fastest) maps onto sharp's effort 9 .. 0
+    return { quality, effort: 9 - Math.min(9, Math.max(0, enc.avif_speed)) };
+  }
+  return {};
+}
+
+async function encodeAt(master, enc, quality, scale) {
+  let img = sharp(master, { limitInputPixels: false });
+  if (scale < 1) {
+    const meta = await img.metadata();
+    img = img.resize({ width: Math.max(1, Math.round(meta.width * scale)) });
+  }
+  // JPEG has no alpha channel; transparent captures would otherwise turn black
+  if (enc.format === "jpeg") img = img.flatten({ background: "#ffffff" });
+  if (enc.metadata) img = img.withExif(exifFor(enc.metadata));
+  const out = await img.toFormat(enc.format, encodeOptions(enc, quality)).toBuffer();
+  return enc.metadata ? embedXmp(out, enc.format, buildXmpPacket(enc.metadata)) : out;
+}
+
+// Describe the capture in EXIF so the file stays self-describing on its own
+function exifFor(m) {
+  const d = new Date(m.captured_at);
+  const pad = n => String(n).padStart(2, "0");
+  const exifDate = `${d.getUTCFullYear()}:${pad(d.getUTCMonth() + 1)}:${pad(d.getUTCDate())} ` +
+    `${pad(d.getUTCHours())}:${pad(d.getUTCMinutes())}:${pad(d.getUTCSeconds())}`;
+  return {
+    IFD0: {
+      ImageDescription: m.url,
+      Software: m.software,
+      DateTime: exifDate
+    },
+    IFD2: {
+      DateTimeOriginal: exifDate,
+      UserComment: `viewport=${m.viewport.width}x${m.viewport.height}`
+    }
+  };
+}
+
+// Encode the lossless master; with target_max_bytes, binary-search the quality
+// and then (optionally) downscale until the output fits
+async function encodeImage(master, enc) {
+  const result = await encodeFitting(master, enc);
+  // Embedded metadata carries the capture time, so the bytes differ between
+  // captures of identical pixels; contentTag hashes the master and encoding instead
+  if (enc.metadata) {
+    result.digest = createHash("sha256").update(master)
+      .update(`${enc.format} ${enc.png_palette ? "palette" : ""} ${result.quality} ${result.scale}`).digest();
+  }
+  return result;
+}
+
+async function encodeFitting(master, enc) {
+  let buffer = await encodeAt(master, enc, enc.quality, 1);
+  if (!enc.target_max_bytes || buffer.length <= enc.target_max_bytes) {
+    return { buffer, quality: enc.quality, scale: 1 };
+  }
+  const lossy = enc.format !== "png" || enc.png_palette;
+  let scale = 1;
+  while (true) {
+    if (lossy) {
+      let lo = MIN_AUTO_QUALITY, hi = enc.quality - 1, best = null;
+      while (lo <= hi) {
+        const q = Math.floor((lo + hi) / 2);
+        const out = await encodeAt(master, enc, q, scale);
+        if (out.length <= enc.target_max_bytes) { best = { buffer: out, quality: q }; lo = q + 1; }
+        else { buffer = out; hi = q - 1; }
+      }
+      if (best) return { ...best, scale };
+    }
+    if (!enc.allow_downscale || scale * 0.75 < MIN_AUTO_SCALE) {
+      return { buffer, quality: lossy ? Math.min(enc.quality, MIN_AUTO_QUALITY) : enc.quality, scale, target_met: false };
+    }
+    scale *= 0.75;
+    buffer = await encodeAt(master, enc, enc.quality, scale);
+    if (buffer.length <= enc.target_max_bytes) return { buffer, quality: enc.quality, scale };
+  }
+}
+
+// network_conditions is a preset name or { preset?, offline, latency_ms, download_kbps, upload_kbps }
+function resolveNetworkConditions(value) {
+  const spec = typeof value === "string" ? { preset: value } : value;
+  const base = spec.preset ? NETWORK_PRESETS[spec.preset] : {};
+  if (!base) throw new Error(`unknown network_conditions preset: ${spec.preset}`);
+  const c = { offline: false, latency_ms: 0, download_kbps: -1, upload_kbps: -1, ...base, ...spec };
+  const toBytes = kbps => (kbps > 0 ? (kbps * 1000) / 8 : -1);
+  return {
+    offline: !!c.offline,
+    latency: c.latency_ms,
+    downloadThroughput: toBytes(c.download_kbps),
+    uploadThroughput: toBytes(c.upload_kbps)
+  };
+}
+
+// Rewrite the very first main-frame document request into a POST (form submits,
+// report generators); redirects and later navigations are left untouched
+async function postNavigation(page, { body, content_type }) {
+  const { postData, contentType } = encodePostBody(body, content_type);
+  let used = false;
+  await page.route("**/*", route => {
+    const request = route.request();
+    if (used || !request.isNavigationRequest() || request.frame() !== page.mainFrame()) return route.fallback();
+    used = true;
+    return route.fallback({
+      method: "POST",
+      postData,
+      headers: { ...request.headers(), "content-type": contentType }
+    });
+  });
+}
+
+// body option -> wire string; objects are form-urlencoded unless content_type says JSON
+function encodePostBody(body, content_type) {
+  let contentType = content_type;
+  let postData = body ?? "";
+  if (typeof postData === "object") {
+    contentType ||= "application/x-www-form-urlencoded";
+    postData = contentType.includes("json")
+      ? JSON.stringify(postData)
+      : new URLSearchParams(postData).toString();
+  }
+  return { postData, contentType: contentType || "application/x-www-form-urlencoded" };
+}
+
+// Structured UA Client Hints -> Emulation.setUserAgentOverride userAgentMetadata
+function userAgentMetadata(hints, browserVersion) {
+  const major = browserVersion.split(".")[0];
+  const brands = hints.brands || [
+    { brand: "Chromium", version: major },
+    { brand: "Google Chrome", version: major },
+    { brand: "Not=A?Brand", version: "99" }
+  ];
+  return {
+    brands,
+    fullVersionList: hints.full_version_list || brands.map(b => ({
+      brand: b.brand,
+      version: b.version === major ? browserVersion : `${b.version}.0.0.0`
+    })),
+    fullVersion: hints.full_version || browserVersion,
+    platform: hints.platform ?? "Windows",
+    platformVersion: hints.platform_version ?? "10.0.0",
+    architecture: hints.architecture ?? "x86",
+    model: hints.model ?? "",
+    mobile: !!hints.mobile,
+    bitness: hints.bitness ?? "64",
+    wow64: !!hints.wow64
+  };
+}
+
+// Accepts "#rgb", "#rrggbb", "#rrggbbaa" or { r, g, b, a } (a in 0..1)
+function parseColor(value) {
+  if (value && typeof value === "object") {
+    return { r: value.r | 0, g: value.g | 0, b: value.b | 0, a: value.a ?? 1 };
+  }
+  const m = /^#?([0-9a-f]{3}|[0-9a-f]{6}|[0-9a-f]{8})$/i.exec(String(value));
+  if (!m) throw new Error(`invalid background_color: ${value}`);
+  let hex = m[1];
+  if (hex.length === 3) hex = hex.split("").map(c => c + c).join("");
+  const n = i => parseInt(hex.slice(i, i + 2), 16);
+  return { r: n(0), g: n(2), b: n(4), a: hex.length === 8 ? n(6) / 255 : 1 };
+}
+
+// Absolute page-space boxes for every element matching each selector
+async function collectLayout(page, selectors, originX = 0) {
+  const groups = [];
+  for (const selector of selectors) {
+    try {
+      groups.push({ selector, elements: await evaluateMatches(page, selector, boxesOf, originX) });
+    } catch (err) {
+      groups.push({ selector, error: err.message, elements: [] });
+    }
+  }
+  return groups;
+}
+
+// In-page: visible boxes of the matched elements in page (image) space
+function boxesOf([nodes, originX]) {
+  return nodes.map(el => {
+    const r = el.getBoundingClientRect();
+    return {
+      tag: el.tagName.toLowerCase(),
+      text: (el.innerText || el.textContent || "").trim().slice(0, 500),
+      x: Math.round(r.left + window.scrollX + originX),
+      y: Math.round(r.top + window.scrollY),
+      width: Math.round(r.width),
+      height: Math.round(r.height)
+    };
+  }).filter(e => e.width > 0 && e.height > 0);
+}
+
+// Crop a region out of the image, clamped to its edges on every side; a
+// region with nothing left inside the image is the caller's error (400)
+async function cropImage(master, clip) {
+  const { width, height } = await sharp(master, { limitInputPixels: false }).metadata();
+  const left = Math.max(0, Math.round(clip.x));
+  const top = Math.max(0, Math.round(clip.y));
+  const region = {
+    x: left,
+    y: top,
+    width: Math.min(Math.round(clip.x + clip.width), width) - left,
+    height: Math.min(Math.round(clip.y + clip.height), height) - top
+  };
+  if (region.width <= 0 || region.height <= 0) {
+    throw new ScrapeError("invalid_request", `clip lies outside the ${width}x${height} page`, 400);
+  }
+  const buffer = await sharp(master, { limitInputPixels: false })
+    .extract({ left, top, width: region.width, height: region.height })
+    .png()
+    .toBuffer();
+  return { buffer, region };
+}
+
+const MAX_POPUP_CAPTURES = 10;
+
+// popups: "all": a full-page image of every window the page opened, up to
+// MAX_POPUP_CAPTURES; each is billed to the tenant like the main capture
+async function capturePopups(popups, enc, timeoutMs, tenant) {
+  const out = [];
+  for (const [i, popup] of popups.entries()) {
+    if (i >= MAX_POPUP_CAPTURES) {
+      out.push({ url: popup.url(), error: `not captured: only the first ${MAX_POPUP_CAPTURES} popups are` });
+      continue;
+    }
+    if (popup.isClosed()) {
+      out.push({ url: popup.url(), error: "closed before it could be captured" });
+      continue;
+    }
+    try {
+      await popup.waitForLoadState("load", { timeout: Math.min(timeoutMs, 10000) }).catch(() => {});
+      const png = await popup.screenshot({ fullPage: true, type: "png" });
+      const { width, height } = await sharp(png).metadata();
+      chargePixels(tenant, width * height);
+      const encoded = await encodeImage(png, { ...enc, target_max_bytes: 0 });
+      out.push({
+        url: popup.url(),
+        title: await popup.title(),
+        content_type: CONTENT_TYPES[enc.format],
+        screenshot_base64: new Base64Value(encoded.buffer, encoded.digest)
+      });
+    } catch (err) {
+      out.push({ url: popup.url(), error: err.message });
+    }
+  }
+  return out;
+}
+
+// The request's quality setting for an image format
+function qualityFor(options, format) {
+  return { jpeg: options.jpeg_quality, webp: options.webp_quality, avif: options.avif_quality, png: options.png_quality }[format];
+}
+
+// captures entries -> { name: encoded crop }. Regions are page coordinates;
+// when the main image was clipped they are taken relative to that clip and
+// cut down to it (the master is the clip), and one left with no area is a 400.
+async function encodeCaptures(master, options, enc, boxes, clipRegion) {
+  const out = {};
+  for (const entry of options.captures) {
+    let region = entry.clip;
+    if (entry.selector != null) {
+      const box = boxes.find(b => b.selector === entry.selector)?.elements[0];
+      if (!box) {
+        out[entry.name] = { error: `no visible element matches ${entry.selector}` };
+        continue;
+      }
+      const pad = Math.max(0, entry.padding_px || 0);
+      region = { x: Math.max(0, box.x - pad), y: Math.max(0, box.y - pad), width: box.width + 2 * pad, height: box.height + 2 * pad };
+    }
+    if (region && clipRegion) region = { ...region, x: region.x - clipRegion.x, y: region.y - clipRegion.y };
+    const format = entry.format || options.image_format;
+    try {
+      const crop = region ? await cropImage(master, region) : { buffer: master, region: null };
+      const encoded = await encodeImage(crop.buffer, {
+        ...enc,
+        format,
+        quality: entry.quality ?? qualityFor(options, format),
+        target_max_bytes: 0
+      });
+      const { width, height } = await sharp(encoded.buffer).metadata();
+      out[entry.name] = {
+        screenshot_base64: new Base64Value(encoded.buffer, encoded.digest),
+        content_type: CONTENT_TYPES[format],
+        region: crop.region,
+        width_px: width,
+        height_px: height,
+        bytes: encoded.buffer.length
+      };
+    } catch (err) {
+      if (err instanceof ScrapeError) throw new ScrapeError(err.code, `captures.${entry.name}: ${err.message}`, err.status);
+      out[entry.name] = { error: err.message };
+    }
+  }
+  return out;
+}
+
+const OUTPUT_FORMATS = [...Object.keys(CONTENT_TYPES), "pdf"];
+
+// Chrome stamps every PDF with its creation time; hash it without the dates
+function pdfDigest(pdf) {
+  const undated = pdf.toString("latin1").replace(/\/(CreationDate|ModDate)\s*\(D:[^)]*\)/g, "/$1()");
+  return createHash("sha256").update(undated, "latin1").digest();
+}
+
+// PDF pages top out at 200 inches; longer pages are cut off there
+const MAX_PDF_HEIGHT_PX = 19200;
+
+// outputs: the same capture in further formats. Images are re-encoded from
+// the master (image_format reuses the main encode); "pdf" is Chrome's
+// rendering of the already loaded page as one page-sized sheet.
+async function encodeOutputs(page, master, encoded, options, enc, pageHeight) {
+  const out = {};
+  for (const format of options.outputs) {
+    try {
+      if (format === "pdf") {
+        // screen styles, like the screenshot, unless print was asked for
+        if (options.emulate_media !== "print") await page.emulateMedia({ media: "screen" });
+        const pdf = await page.pdf({
+          width: `${options.viewport_width}px`,
+          height: `${Math.max(1, Math.min(pageHeight, MAX_PDF_HEIGHT_PX))}px`,
+          printBackground: true,
+          pageRanges: "1"
+        });
+        await page.emulateMedia({ media: options.emulate_media });
+        out.pdf = {
+          data_base64: new Base64Value(pdf, pdfDigest(pdf)),
+          content_type: "application/pdf",
+          bytes: pdf.length
+        };
+        continue;
+      }
+      const result = format === options.image_format && encoded
+        ? encoded
+        : await encodeImage(master, { ...enc, format, quality: qualityFor(options, format) });
+      const { width, height } = await sharp(result.buffer).metadata();
+      out[format] = {
+        screenshot_base64: new Base64Value(result.buffer, result.digest),
+        content_type: CONTENT_TYPES[format],
+        width_px: width,
+        height_px: height,
+        bytes: result.buffer.length
+      };
+    } catch (err) {
+      out[format] = { error: err.message };
+    }
+  }
+  return out;
+}
+
+// Page-space boxes relative to a clip region's origin
+function shiftLayout(layout, region) {
+  return layout.map(group => ({
+    ...group,
+    elements: group.elements.map(e => ({ ...e, x: e.x - region.x, y: e.y - region.y }))
+  }));
+}
+
+// Map page-space boxes into the encoded image (downscaling, segment offsets)
+function scaleLayout(layout, scale, segmentHeight) {
+  return layout.map(group => ({
+    ...group,
+    elements: group.elements.map(e => {
+      const box = {
+        ...e,
+        x: Math.round(e.x * scale),
+        y: Math.round(e.y * scale),
+        width: Math.round(e.width * scale),
+        height: Math.round(e.height * scale)
+      };
+      if (segmentHeight) {
+        box.segment_index = Math.floor(e.y / segmentHeight);
+        box.segment_y = e.y - box.segment_index * segmentHeight;
+      }
+      return box;
+    })
+  }));
+}
+
+function escapeSvg(value) {
+  return String(value).replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;");
+}
+
+// Outline every box from collectLayout with a labelled rectangle, drawn onto the master
+async function annotateImage(master, meta, groups, specs) {
+  const shapes = [];
+  groups.forEach((group, i) => {
+    const { color, label } = specs[i];
+    for (const e of group.elements) {
+      const labelWidth = Math.min(e.width + 200, 8 + label.length * 7);
+      const labelY = e.y >= 18 ? e.y - 18 : e.y;
+      shapes.push(
+        `<rect x="${e.x}" y="${e.y}" width="${e.width}" height="${e.height}" fill="none" stroke="${color}" stroke-width="3"/>`,
+        `<rect x="${e.x}" y="${labelY}" width="${labelWidth}" height="18" fill="${color}"/>`,
+        `<text x="${e.x + 4}" y="${labelY + 13}" font-family="sans-serif" font-size="12" fill="#ffffff">${escapeSvg(label)}</text>`
+      );
+    }
+  });
+  if (shapes.length === 0) return master;
+  const svg = `<svg xmlns="http://www.w3.org/2000/svg" width="${meta.width}" height="${meta.height}">${shapes.join("")}</svg>`;
+  return sharp(master, { limitInputPixels: false })
+    .composite([{ input: Buffer.from(svg), top: 0, left: 0, limitInputPixels: false }])
+    .png()
+    .toBuffer();
+}
+
+function asList(value) {
+  if (value == null) return [];
+  return Array.isArray(value) ? value : [value];
+}
+
+// Start watching for wait_for_request / wait_for_response URL substrings before
+// navigation so calls made during load are not missed. The returned function
+// resolves once all have been seen (responses: body fully received) and throws
+// wait_timeout for any that never showed up within timeoutMs.
+function watchNetwork(page, { wait_for_request, wait_for_response }, timeoutMs) {
+  const waits = [
+    ...asList(wait_for_request).map(pattern =>
+      page.waitForRequest(r => r.url().includes(pattern), { timeout: timeoutMs })
+        .then(() => null, () => `request ${pattern}`)),
+    ...asList(wait_for_response).map(pattern =>
+      page.waitForResponse(r => r.url().includes(pattern), { timeout: timeoutMs })
+        .then(r => r.finished())
+        .then(() => null, () => `response ${pattern}`))
+  ];
+  return async () => {
+    const missed = (await Promise.all(waits)).filter(Boolean);
+    if (missed.length) {
+      throw new ScrapeError("wait_timeout", `no matching ${missed.join(", ")} within ${timeoutMs} ms`);
+    }
+  };
+}
+
+// Wait for document.fonts.ready, then until every named family has a loaded
+// face (asking for each so unused-yet families start loading). Returns which
+// families made it; a timeout is reported, not thrown, and the capture goes on.
+async function waitForFonts(page, families, timeoutMs) {
+  await page.evaluate(ms => Promise.race([
+    document.fonts.ready.then(() => {}),
+    new Promise(resolve => setTimeout(resolve, ms))
+  ]), timeoutMs).catch(() => {});
+  if (families.length === 0) return undefined;
+  const loadedFamilies = () => page.evaluate(async names => {
+    const strip = f => f.replace(/^["']|["']$/g, "").toLowerCase();
+    await Promise.all(names.map(n => document.fonts.load(`16px "${n}"`).catch(() => [])));
+    const loaded = new Set([...document.fonts].filter(f => f.status === "loaded").map(f => strip(f.family)));
+    return names.filter(n => loaded.has(strip(n)));
+  }, families);
+  const deadline = Date.now() + timeoutMs;
+  let loaded = await loadedFamilies();
+  while (loaded.length < families.length && Date.now() < deadline) {
+    await page.waitForTimeout(100);
+    loaded = await loadedFamilies();
+  }
+  return { loaded, missing: families.filter(f => !loaded.includes(f)) };
+}
+
+const STATE_VERSION = 1;
+
+// Replayable session state: Playwright's storageState (cookies, localStorage)
+// plus the sessionStorage of the page's own origin, which it does not cover
+async function exportState(context, page) {
+  const { cookies, origins } = await context.storageState();
+  const session = await page.evaluate(() => ({
+    origin: location.origin,
+    entries: Object.entries(sessionStorage).map(([name, value]) => ({ name, value }))
+  })).catch(() => null);
+  const merged = origins.map(o => ({ ...o, sessionStorage: [] }));
+  if (session && session.entries.length) {
+    const own = merged.find(o => o.origin === session.origin);
+    if (own) own.sessionStorage = session.entries;
+    else merged.push({ origin: session.origin, localStorage: [], sessionStorage: session.entries });
+  }
+  return { version: STATE_VERSION, exported_at: new Date().toISOString(), cookies, origins: merged };
+}
+
+// Init script: seed sessionStorage for matching origins once per tab
+function restoreSessionStorage(origins) {
+  const own = origins.find(o => o.origin === location.origin);
+  if (!own || !own.sessionStorage || sessionStorage.getItem("__scraper_state_restored")) return;
+  for (const { name, value } of own.sessionStorage) sessionStorage.setItem(name, value);
+  sessionStorage.setItem("__scraper_state_restored", "1");
+}
+
+function checkState(state) {
+  if (state == null) return;
+  if (typeof state !== "object" || state.version !== STATE_VERSION ||
+      !Array.isArray(state.cookies) || !Array.isArray(state.origins) ||
+      !state.origins.every(o => o && typeof o.origin === "string")) {
+    throw requestError(`state must be a version ${STATE_VERSION} blob from return_state`);
+  }
+  state.cookies.forEach((cookie, i) => {
+    if (!cookie || typeof cookie !== "object" || typeof cookie.name !== "string" || !cookie.name ||
+        typeof cookie.value !== "string") {
+      throw requestError(`state.cookies[${i}] needs a string name and value`);
+    }
+    // Playwright scopes a cookie by url, or by domain and path together
+    const scoped = typeof cookie.url === "string" ||
+      (typeof cookie.domain === "string" && cookie.domain && typeof cookie.path === "string" && cookie.path);
+    if (!scoped) throw requestError(`state.cookies[${i}] needs a domain and path`);
+    if (cookie.sameSite != null && !["Strict", "Lax", "None"].includes(cookie.sameSite)) {
+      throw requestError(`state.cookies[${i}].sameSite must be Strict, Lax or None`);
+    }
+  });
+}
+
+// Body of a main-frame response; downloads have none in the page, so fetch
+// again through the context (same cookies, credentials and certificates).
+// Either way no more than limits.max_document_bytes is handed on.
+async function documentBody(context, response, timeoutMs) {
+  const limit = config.limits.max_document_bytes;
+  const tooLarge = () => new ScrapeError("navigation_failed", `${response.url()} is larger than ${limit} bytes`);
+  const body = await response.body().catch(() => null);
+  if (body) {
+    if (body.length > limit) throw tooLarge();
+    return body;
+  }
+  const refetched = await context.request.get(response.url(), { timeout: timeoutMs });
+  try {
+    if (!refetched.ok()) {
+      throw new ScrapeError("navigation_failed", `refetching ${response.url()} returned HTTP ${refetched.status()}`);
+    }
+    if (Number(refetched.headers()["content-length"]) > limit) throw tooLarge();
+    const refetchedBody = await refetched.body();
+    if (refetchedBody.length > limit) throw tooLarge();
+    return refetchedBody;
+  } finally {
+    await refetched.dispose().catch(() => {});
+  }
+}
+
+// Non-HTML main documents returned as content rather than screenshotted
+const DOCUMENT_TYPES = [
+  [/^application\/(x-)?pdf\b/i, "pdf"],
+  [/^application\/xhtml\+xml\b/i, null],
+  [/^image\//i, "image"],
+  [/^(application|text)\/([\w.-]+\+)?json\b/i, "json"],
+  [/^(application|text)\/([\w.-]+\+)?xml\b/i, "xml"]
+];
+
+function documentKind(contentType) {
+  const match = DOCUMENT_TYPES.find(([pattern]) => pattern.test(contentType));
+  return match ? match[1] : null;
+}
+
+// File extension for a document's content type, e.g. "image/svg+xml" -> "svg"
+function documentExtension(contentType) {
+  const subtype = contentType.split(";")[0].trim().split("/")[1] || "bin";
+  if (/json$/i.test(subtype)) return "json";
+  if (/^svg/i.test(subtype)) return "svg";
+  if (/xml$/i.test(subtype)) return "xml";
+  const ext = subtype.replace(/^x-/, "").toLowerCase();
+  return ext === "jpeg" ? "jpg" : ext;
+}
+
+async function describeDocument(kind, contentType, raw) {
+  const document = {
+    content_type: contentType.split(";")[0].trim(),
+    bytes: raw.length,
+    data_base64: new Base64Value(raw)
+  };
+  if (kind === "image") {
+    const meta = await sharp(raw).metadata().catch(() => null);
+    if (meta) Object.assign(document, { width_px: meta.width, height_px: meta.height, format: meta.format });
+  } else if (kind === "json") {
+    try {
+      document.json = JSON.parse(raw.toString("utf8"));
+    } catch (err) {
+      document.parse_error = err.message;
+    }
+  } else if (kind === "xml") {
+    document.text = raw.toString("utf8");
+  }
+  return document;
+}
+
+function isPdf(buf) {
+  return buf.subarray(0, 5).toString("latin1") === "%PDF-";
+}
+
+// The PDF itself, its text layer and optional page rasters in place of a screenshot
+async function capturePdf(req, pdf, options, enc, finalUrl) {
+  const timeoutMs = Math.min(options.timeout_ms, 60000);
+  const info = await pdfInfo(pdf, timeoutMs).catch(() => null);
+  const document = {
+    content_type: "application/pdf",
+    bytes: pdf.length,
+    pages: info ? info.pages : null,
+    title: info ? info.title : null,
+    encrypted: info ? info.encrypted : null,
+    data_base64: new Base64Value(pdf)
+  };
+  if (options.pdf_text) {
+    // the raw file is still useful without poppler, so report rather than fail
+    try {
+      document.text = await pdfText(pdf, timeoutMs);
+    } catch (err) {
+      document.text_error = err.message;
+    }
+  }
+
+  let pages;
+  const count = Math.min(options.pdf_pages, info ? info.pages : options.pdf_pages);
+  if (count > 0) {
+    pages = [];
+    const rasters = await pdfPages(pdf, { count, dpi: options.pdf_dpi, timeoutMs });
+    for (const [index, png] of rasters.entries()) {
+      const { width, height } = await sharp(png).metadata();
+      chargePixels(req.tenant, width * height);
+      const encoded = await encodeImage(png, enc);
+      pages.push({
+        index,
+        screenshot_base64: new Base64Value(encoded.buffer, encoded.digest),
+        width_px: width,
+        height_px: height,
+        bytes: encoded.buffer.length
+      });
+    }
+  }
+
+  return {
+    document,
+    pages,
+    content_type: pages ? CONTENT_TYPES[options.image_format] : undefined,
+    title: document.title,
+    final_url: finalUrl
+  };
+}
+
+// Scroll offsets that cover total with viewport-sized tiles overlapping by
+// overlap; the last tile is aligned to the far edge
+function tileOffsets(total, size, overlap) {
+  const offsets = [0];
+  const step = Math.max(1, size - overlap);
+  while (offsets[offsets.length - 1] + size < total) {
+    offsets.push(Math.min(offsets[offsets.length - 1] + step, total - size));
+  }
+  return offsets;
+}
+
+// Swap every <video> for a still: its poster image, or else the first frame
+// drawn onto a canvas (a cross-origin frame taints the canvas but still
+// renders). Returns what was done per video.
+function substituteVideoPosters(page, timeoutMs) {
+  return page.evaluate(async timeout => {
+    const when = (el, event) => new Promise((resolve, reject) => {
+      const timer = setTimeout(() => reject(new Error("timeout")), timeout);
+      el.addEventListener(event, () => { clearTimeout(timer); resolve(); }, { once: true });
+      el.addEventListener("error", () => { clearTimeout(timer); reject(new Error("error")); }, { once: true });
+    });
+    const swap = (video, replacement) => {
+      const style = getComputedStyle(video);
+      replacement.className = video.className;
+      replacement.style.cssText = video.style.cssText;
+      replacement.style.width = `${video.offsetWidth}px`;
+      replacement.style.height = `${video.offsetHeight}px`;
+      replacement.style.objectFit = style.objectFit === "fill" ? "contain" : style.objectFit;
+      video.replaceWith(replacement);
+    };
+    const report = [];
+    for (const video of Array.from(document.querySelectorAll("video"))) {
+      const src = video.currentSrc || video.src || video.querySelector("source")?.src || null;
+      if (video.poster) {
+        const img = document.createElement("img");
+        img.src = video.poster;
+        swap(video, img);
+        await img.decode().catch(() => {});
+        report.push({ src, method: "poster" });
+        continue;
+      }
+      try {
+        video.muted = true;
+        video.preload = "auto";
+        if (video.readyState < 2) {
+          const loaded = when(video, "loadeddata");
+          video.load();
+          await loaded;
+        }
+        const seeked = when(video, "seeked");
+        video.currentTime = Math.min(0.1, video.duration || 0);
+        await seeked;
+        const canvas = document.createElement("canvas");
+        canvas.width = video.videoWidth;
+        canvas.height = video.videoHeight;
+        canvas.getContext("2d").drawImage(video, 0, 0);
+        swap(video, canvas);
+        report.push({ src, method: "frame" });
+      } catch (_) {
+        report.push({ src, method: "none" });
+      }
+    }
+    return report;
+  }, timeoutMs);
+}
+
+const ANIMATION_TYPES = { gif: "image/gif", webp: "image/webp" };
+
+// Screenshot one element frames times, interval_ms apart, and assemble the
+// frames into a looping animated GIF or WebP (frames share the first's size).
+// Stops early rather than run past budgetMs; every frame is billed as pixels.
+async function recordAnimation(page, { selector, frames = 10, interval_ms = 200, format = "gif" }, budgetMs, tenant) {
+  const stopAt = Date.now() + budgetMs;
+  const target = page.locator(selector).first();
+  await target.scrollIntoViewIfNeeded();
+  const shots = [];
+  for (let i = 0; i < frames; i++) {
+    if (i) {
+      if (Date.now() + interval_ms >= stopAt) break;
+      await page.waitForTimeout(interval_ms);
+    }
+    shots.push(await target.screenshot({ animations: "allow" }));
+  }
+  frames = shots.length;
+  const { width, height } = await sharp(shots[0]).metadata();
+  chargePixels(tenant, width * height * frames);
+  const raw = await Promise.all(shots.map(shot => sharp(shot)
+    .resize(width, height, { fit: "contain", background: { r: 255, g: 255, b: 255, alpha: 1 } })
+    .ensureAlpha()
+    .raw()
+    .toBuffer()));
+  const strip = sharp(Buffer.concat(raw), { raw: { width, height: height * frames, channels: 4, pageHeight: height } });
+  const buffer = format === "webp"
+    ? await strip.webp({ loop: 0, delay: interval_ms, quality: 80 }).toBuffer()
+    : await strip.gif({ loop: 0, delay: interval_ms }).toBuffer();
+  return { selector, content_type: ANIMATION_TYPES[format], frames, width, height, data_base64: new Base64Value(buffer) };
+}
+
+// Make WebGL canvases keep their drawing buffer so toDataURL() sees what is on
+// screen; must run as an init script, before the page creates its contexts
+function preserveCanvasBuffers() {
+  const getContext = HTMLCanvasElement.prototype.getContext;
+  HTMLCanvasElement.prototype.getContext = function (type, attrs) {
+    if (/webgl/i.test(type)) attrs = { ...attrs, preserveDrawingBuffer: true };
+    return getContext.call(this, type, attrs);
+  };
+}
+
+// Poll every visible canvas until its pixels have been identical for
+// stable_frames consecutive samples, or give up after timeout_ms (never
+// longer than budgetMs, what is left of the capture's time)
+async function waitForCanvas(page, spec, budgetMs) {
+  const { stable_frames = 3, interval_ms = 100, timeout_ms = 10000 } = spec === true ? {} : spec;
+  return page.evaluate(async ({ frames, interval, timeout }) => {
+    const started = performance.now();
+    const signature = () => Array.from(document.querySelectorAll("canvas"))
+      .filter(c => c.width * c.height > 0)
+      .map(c => {
+        try {
+          const data = c.toDataURL();
+          let h = 0x811c9dc5;
+          for (let i = 0; i < data.length; i += 7) h = Math.imul(h ^ data.charCodeAt(i), 0x01000193);
+          return `${data.length}:${h >>> 0}`;
+        } catch (_) {
+          return "tainted";
+        }
+      });
+    let previous = signature().join();
+    let same = 0;
+    while (same < frames && performance.now() - started < timeout) {
+      await new Promise(resolve => requestAnimationFrame(() => setTimeout(resolve, interval)));
+      const current = signature().join();
+      same = current === previous ? same + 1 : 0;
+      previous = current;
+    }
+    return {
+      canvases: document.querySelectorAll("canvas").length,
+      stable: same >= frames,
+      waited_ms: Math.round(performance.now() - started)
+    };
+  }, { frames: stable_frames, interval: interval_ms, timeout: Math.min(timeout_ms, budgetMs) });
+}
+
+// Nested { role, name, value, states, children } tree from CDP's flat AX node list;
+// ignored nodes are dropped and their children hoisted to the nearest kept ancestor
+async function accessibilityTree(cdp) {
+  const { nodes } = await cdp.send("Accessibility.getFullAXTree");
+  const byId = new Map(nodes.map(n => [n.nodeId, n]));
+  const build = node => {
+    const children = (node.childIds || []).map(id => byId.get(id)).filter(Boolean).flatMap(build);
+    if (node.ignored) return children;
+    const states = {};
+    for (const p of node.properties || []) states[p.name] = p.value?.value;
+    const out = { role: node.role?.value ?? null, name: node.name?.value || "" };
+    if (node.value?.value !== undefined) out.value = node.value.value;
+    if (node.description?.value) out.description = node.description.value;
+    if (Object.keys(states).length) out.states = states;
+    if (node.backendDOMNodeId) out.dom_node_id = node.backendDOMNodeId;
+    if (children.length) out.children = children;
+    return [out];
+  };
+  const root = nodes.find(n => !n.parentId) || nodes[0];
+  return root ? build(root)[0] ?? null : null;
+}
+
+// Slice a tall image into consecutive top-to-bottom pages of at most maxHeight px
+async function splitSegments(master, meta, maxHeight, enc) {
+  const segments = [];
+  for (let top = 0; top < meta.height; top += maxHeight) {
+    const height = Math.min(maxHeight, meta.height - top);
+    const slice = await sharp(master, { limitInputPixels: false })
+      .extract({ left: 0, top, width: meta.width, height })
+      .png()
+      .toBuffer();
+    const { buffer, digest } = await encodeImage(slice, enc);
+    segments.push({
+      index: segments.length,
+      top_px: top,
+      height_px: height,
+      screenshot_base64: new Base64Value(buffer, digest)
+    });
+  }
+  return segments;
+}
+
+// stderr, when given, collects Chrome's own process output (debug mode);
+// proxy defaults to the next one from the pool
+async function launchBrowser(extraArgs = [], stderr = null, requestedProxy = nextProxy()) {
+  const { proxy, close } = await browserProxy(requestedProxy);
+  let browser;
+  try {
+    browser = await chromium.launch({
+      headless: true,
+      args: [...config.chrome.args, ...extraArgs],
+      executablePath: config.chrome.executable_path || undefined,
+      proxy,
+      logger: stderr
+        ? { isEnabled: name => name === "browser", log: (name, severity, message) => stderr.push(String(message)) }
+        : undefined
+    });
+  } catch (err) {
+    close();
+    throw err;
+  }
+  browser.on("disconnected", close);
+  return browser;
+}
+
+// Server-configured client certificates for mTLS targets, from a JSON file
+// (chrome.client_certs_file) of
+// [{ origin, cert_path, key_path } | { origin, pfx_path, passphrase }]
+const SERVER_CLIENT_CERTS = config.chrome.client_certs_file
+  ? JSON.parse(readFileSync(config.chrome.client_certs_file, "utf8")).map(c => ({
+      origin: c.origin,
+      certPath: c.cert_path,
+      keyPath: c.key_path,
+      pfxPath: c.pfx_path,
+      passphrase: c.passphrase
+    }))
+  : [];
+
+// Per-request certificates arrive inline: { origin, cert_pem, key_pem } or { origin, pfx_base64, passphrase }
+function clientCertificates(requested = []) {
+  const inline = requested.map(c => {
+    if (!c.origin) throw new Error("client_certificates entries need an origin");
+    return {
+      origin: c.origin,
+      cert: c.cert_pem ? Buffer.from(c.cert_pem) : undefined,
+      key: c.key_pem ? Buffer.from(c.key_pem) : undefined,
+      pfx: c.pfx_base64 ? Buffer.from(c.pfx_base64, "base64") : undefined,
+      passphrase: c.passphrase
+    };
+  });
+  // request-supplied certs win over server defaults for the same origin
+  const origins = new Set(inline.map(c => c.origin));
+  return [...inline, ...SERVER_CLIENT_CERTS.filter(c => !origins.has(c.origin))];
+}
+
+const HOST_PATTERN = /^[a-z0-9*.-]+(:\d+)?$|^\[[0-9a-f:]+\](:\d+)?$|^[0-9a-f:]+$/i;
+
+// { "www.example.com": "10.0.0.12", "*.cdn.example.com": "staging-cdn.internal" }
+// -> --host-resolver-rules="MAP www.example.com 10.0.0.12, MAP ..."
+function hostResolverArgs(hostRules) {
+  const entries = Object.entries(hostRules || {});
+  if (entries.length === 0) return [];
+  const rules = entries.map(([from, to]) => {
+    if (!HOST_PATTERN.test(from) || !HOST_PATTERN.test(String(to))) {
+      throw new Error(`invalid host_rules entry: ${from} -> ${to}`);
+    }
+    return `MAP ${from} ${to}`;
+  });
+  return [`--host-resolver-rules=${rules.join(", ")}`];
+}
+
+// use_browser_cache captures share one long-lived browser and keep a warm
+// context (cookies + Chrome's HTTP cache) per origin and context options
+const WARM_CONTEXT_IDLE_MS = 10 * 60 * 1000;
+let sharedBrowser = null;
+const warmContexts = new Map();
+
+function getSharedBrowser() {
+  if (!sharedBrowser) {
+    sharedBrowser = launchBrowser().then(browser => {
+      browser.on("disconnected", () => {
+        sharedBrowser = null;
+        warmContexts.clear();
+      });
+      return browser;
+    }, err => {
+      sharedBrowser = null;
+      throw err;
+    });
+  }
+  return sharedBrowser;
+}
+
+// Per tenant as well: a warm context holds its callers' cookies and storage
+function warmContextKey(tenantId, origin, options) {
+  return `${tenantId} ${origin} ${createHash("sha256").update(JSON.stringify(options)).digest("hex").slice(0, 16)}`;
+}
+
+async function acquireWarmContext(key, options) {
+  let entry = warmContexts.get(key);
+  if (!entry) {
+    // Make room by closing the least recently used idle context
+    if (warmContexts.size >= settings.max_warm_contexts) {
+      const idle = [...warmContexts.entries()].filter(([, e]) => e.active === 0).sort((a, b) => a[1].used - b[1].used)[0];
+      if (idle) await dropWarmContext(idle[0]);
+    }
+    const browser = await getSharedBrowser();
+    entry = { context: browser.newContext(options).then(async ctx => { await blockNoise(ctx); return ctx; }), active: 0, timer: null };
+    warmContexts.set(key, entry);
+  }
+  entry.active++;
+  entry.used = Date.now();
+  clearTimeout(entry.timer);
+  let context;
+  try {
+    context = await entry.context;
+  } catch (err) {
+    if (warmContexts.get(key) === entry) warmContexts.delete(key);
+    throw err;
+  }
+  const release = () => {
+    entry.active--;
+    if (entry.active > 0) return;
+    if (entry.detached) closeWarmEntry(entry);
+    else entry.timer = setTimeout(() => dropWarmContext(key), WARM_CONTEXT_IDLE_MS);
+  };
+  return { context, release };
+}
+
+// Detaches the entry so new captures get a fresh context; one still in use is
+// closed by its last release() instead of under the capture holding it
+async function dropWarmContext(key) {
+  const entry = warmContexts.get(key);
+  if (!entry) return;
+  warmContexts.delete(key);
+  entry.detached = true;
+  clearTimeout(entry.timer);
+  if (entry.active === 0) await closeWarmEntry(entry);
+}
+
+async function closeWarmEntry(entry) {
+  const context = await entry.context.catch(() => null);
+  if (context) await context.close().catch(() => {});
+}
 
-  const browser = await chromium.launch({
-    headless: true,
-    args: ["--no-sandbox", "--disable-gpu"]
+// Block heavy/analytics requests that can keep the network busy
+async function blockNoise(context) {
+  await context.route("**/*", route => {
+    const reqUrl = route.request().url();
+    const isAnalytics = settings.blocked_domains.some(domain => reqUrl.includes(domain));
+    const isMedia = /\.(mp4|webm|gif|mov|avi)(\?|$)/i.test(reqUrl);
+    if (isAnalytics || isMedia) return route.abort();
+    return route.continue();
   });
+}
+
+// Every /scrape option with its default; request fields override these as-is
+function scrapeOptions(fields) {
+  return {
+    url: null,
+    engine: "browser", // "http": plain fetch, no Chrome; HTML plus extraction but no screenshot. "auto": http when
+    // the HTML suffices and no image is wanted (screenshot: false or fields without one), else the browser
+    engine_fallback: false, // retry with the http engine when the browser capture fails
+    timeout_ms: settings.default_timeout_ms,
+    priority: "interactive", // queue class; "batch" waits behind interactive captures (see queue.js)
+    constraints: null, // { region: "eu", needs: ["stealth"] }: worker tags required (see dispatch.js)
+    capture_region: null, // e.g. "de": capture from a worker tagged region:de
+    fields: null, // ["title", "fields.price", ...]: return only these (dotted) paths of data; no image unless asked for
+    screenshot: true, // false: navigate, wait and extract only; no scrolling, stitching or encoding
+    outputs: [], // further formats from the same render, e.g. ["webp", "png", "pdf"]; see encodeOutputs
+    viewport_width: 1280,
+    viewport_height: 1024,
+    settle_delay_ms: 300,
+    overlap_px: 140,
+    image_format: "jpeg", // "png", "jpeg", "webp" or "avif"
+    jpeg_quality: 85,
+    webp_quality: 80,
+    avif_quality: 50,
+    avif_speed: 5, // 0 (smallest) .. 9 (fastest)
+    png_palette: false, // lossy 8-bit palette PNG, much smaller for flat UI pages
+    png_colors: 256,
+    png_quality: 90,
+    progressive: false, // progressive (mozjpeg) JPEG encoding
+    target_max_bytes: 0, // lower quality until the encoded image fits
+    allow_downscale: false, // ...and shrink the image if quality alone is not enough
+    max_segment_height_px: 0, // split tall captures into pages of at most this height
+    omit_background: false, // capture pages without a body background over transparency
+    background_color: null, // or paint them over this color instead of white
+    embed_metadata: false, // write source URL, capture time, viewport and version into EXIF/XMP
+    evidence: false, // return a signed/timestamped SHA-256 manifest of image + rendered HTML
+    layout_selectors: [], // report text, tag and image-space boxes for matching elements (CSS or XPath, as everywhere)
+    annotate: [], // [{ selector, label?, color? }] outlines drawn onto the output image
+    ocr: false, // word boxes + transcript from an OCR pass over the stitched image
+    ocr_lang: "eng",
+    extract: null, // { name: selector | { selector, attribute, all, trim, regex, group, json_path, type } } -> data.fields
+    paginate: null, // { next_selector, max_pages }: follow "Next" and run extract on every page -> data.dataset
+    extract_tables: false, // true, or a selector limiting which tables are parsed
+    tables_format: "rows", // "rows" or "csv"
+    extract_links: false, // anchors with absolute href, text, rel and internal/external type
+    extract_product: false, // name, price, currency, availability and images from JSON-LD, microdata and OpenGraph
+    extract_article: false, // readability-style title, byline, date, main text and lead image
+    extract_text: false, // visible page text; also enables language/word-count/outline stats
+    capture_icons: false, // download the best favicon and the og:image alongside the capture
+    computed_styles: null, // { selectors: [...], properties: ["font-family", "color", ...] }
+    font_report: false, // font families used by visible text and whether each loaded
+    wait_for_request: null, // URL substring (or list) of a request the page must make before capture
+    wait_for_response: null, // ...or whose response must have fully arrived, e.g. "/api/products"
+    wait_for_fonts: [], // ["Inter", "Brand Serif"]: hold the capture until these families have loaded
+    wait_for_fonts_timeout_ms: 10000,
+    clip: null, // { x, y, width, height } in page coordinates: return only this region of the full-page image
+    captures: [], // [{ name, clip | selector, padding_px, format, quality }]: extra crops of the same render -> data.captures
+    record_animation: null, // { selector, frames, interval_ms, format: "gif" | "webp" }: animated capture of one element
+    video_posters: false, // replace blocked <video> elements with their poster or first frame
+    wait_for_canvas: false, // true or { stable_frames, interval_ms, timeout_ms }: wait for charts to finish drawing
+    network_conditions: null, // "slow-3g", "fast-3g", "offline", ... or custom latency/throughput
+    http_auth: null, // { username, password } answered on auth challenges (Basic/Digest/NTLM)
+    method: "GET", // "POST" turns the initial navigation into a POST with body/content_type
+    body: null, // string, or an object encoded per content_type (form-urlencoded by default)
+    content_type: null,
+    referer: null, // Referer header sent with the initial navigation
+    user_agent: null,
+    store: false, // put the result in result storage (results.backend) and return where, not the bytes
+    proxy: null, // { server, username, password, bypass } for this capture only, instead of the pool's
+    profile: null, // name of a fingerprint profile from /admin/profiles (UA, platform, screen, WebGL, fonts, ...)
+    headers: null, // { name: value } extra request headers for every request the capture makes
+    client_hints: null, // { platform, platform_version, model, mobile, architecture, brands, full_version_list }
+    return_cookies: false, // export cookies and localStorage accumulated during the capture
+    state: null, // a state blob from an earlier return_state, restored before navigating
+    return_state: false, // export cookies + localStorage + sessionStorage as a replayable state blob
+    use_browser_cache: false, // reuse a warm per-origin context (HTTP cache, cookies) across captures
+    clear_state: false, // force a pristine context and discard any warm one for this origin
+    client_certificates: [], // [{ origin, cert_pem, key_pem } | { origin, pfx_base64, passphrase }] for mTLS targets
+    host_rules: null, // { hostname: ip-or-hostname } resolver overrides for this capture
+    cpu_throttle: 1, // CPU slowdown factor, e.g. 4 or 6 to approximate low-end devices
+    page_zoom: 1, // e.g. 0.75 to fit dense pages, 1.5 to enlarge small text; viewport size is unchanged
+    emulate_media: null, // "print" renders with the page's print stylesheet, "screen" forces screen
+    forced_colors: null, // "active": Windows High Contrast-style forced colors rendering
+    prefers_contrast: null, // "more", "less", "custom" or "no-preference"
+    save_data: false, // Save-Data: on, navigator.connection.saveData and prefers-reduced-data: reduce
+    security_events: false, // CSP violations, mixed content and security state seen during load
+    test_csp: null, // extra Content-Security-Policy-Report-Only policy to trial on the document
+    output: "json", // "json", "bundle" (ZIP of image, tiles, HTML, metadata and logs), "warc", "domsnapshot"
+    // or "text-snapshot" (plain text, one block per line, for diffing runs). A bundle has tiles/ only when
+    // the page went through the tile pass; metadata.json's capture_method says which one ran
+    locale: null, // e.g. "de-DE": Accept-Language, navigator.language and Intl formatting
+    timezone: null, // IANA zone, e.g. "Europe/Berlin"
+    locales: [], // ["de-DE", { locale: "ja-JP", timezone: "Asia/Tokyo" }, ...]: one capture each, in parallel
+    popups: "ignore", // windows the page opens: "ignore", "block", "follow" (capture the newest instead) or "all" (capture each too)
+    dialogs: "dismiss", // alert/confirm/prompt: "dismiss", "accept" or { action: "accept", prompt_text }; beforeunload always leaves
+    permissions: null, // { notifications: "granted" | "denied" | "prompt", camera: ..., "clipboard-read": ... } for the target origin
+    javascript_enabled: true, // false: no page scripts run at all (server-rendered baseline, untrusted pages)
+    compare_javascript: false, // capture with and without JavaScript and diff the extracted text and links
+    debug: false, // also ?debug=1: scroll positions, raw tiles, seams, injected scripts and Chrome stderr
+    accessibility_tree: false, // roles, names and states from Chrome's accessibility tree
+    snapshot_styles: DEFAULT_SNAPSHOT_STYLES, // computed styles included with output: "domsnapshot"
+    document_view: false, // image/JSON/XML targets: also screenshot Chrome's rendering of the raw content
+    pdf_text: true, // PDF targets: return the embedded text layer, one string per page
+    pdf_pages: 0, // PDF targets: also rasterize the first N pages into image_format
+    pdf_dpi: 110,
+    ...fields
+  };
+}
+
+const MAX_PROJECTED_FIELDS = 50;
+// Response fields that exist only when the page is screenshotted
+const IMAGE_FIELDS = [
+  "screenshot_base64", "segments", "content_type", "encoding", "hashes", "captures", "ocr", "outputs"
+];
+
+// Keep only the given dotted paths of data
+function projectFields(data, paths) {
+  const out = {};
+  for (const path of paths) {
+    const keys = path.split(".");
+    let from = data;
+    for (const key of keys) from = from != null && typeof from === "object" ? from[key] : undefined;
+    if (from === undefined) continue;
+    let to = out;
+    for (const key of keys.slice(0, -1)) to = to[key] ??= {};
+    to[keys[keys.length - 1]] = from;
+  }
+  return out;
+}
+
+// Capture facts that differ between runs of an unchanged page
+const VOLATILE_FIELDS = ["transfer", "resources", "debug", "font_wait", "canvas_wait", "evidence", "storage_state", "state"];
+// Timings and timestamps, dropped wherever they appear (popups, pages, nested reports)
+const VOLATILE_KEYS = ["waited_ms", "captured_at", "exported_at", "duration_ms", "elapsed_ms"];
+
+// Weak ETag over what was captured rather than how: the images (by the master
+// they were encoded from when metadata made their bytes time-dependent) plus
+// the rest of data without its timings, so two captures of an unchanged page match
+function contentTag(data) {
+  const hash = createHash("sha256");
+  const json = JSON.stringify(data, function (key, value) {
+    if (this === data && VOLATILE_FIELDS.includes(key)) return undefined;
+    if (VOLATILE_KEYS.includes(key)) return undefined;
+    if (this[key] instanceof Base64Value) {
+      hash.update(this[key].digest || this[key].buffer);
+      return "#";
+    }
+    return value;
+  });
+  hash.update(json ?? "");
+  return `W/"${hash.digest("base64url").slice(0, 27)}"`;
+}
+
+// If-None-Match uses weak comparison: the W/ prefix does not matter
+function etagMatches(header, etag) {
+  if (!header) return false;
+  const opaque = tag => tag.trim().replace(/^W\//, "");
+  return header.split(",").some(tag => tag.trim() === "*" || opaque(tag) === opaque(etag));
+}
+
+function requestError(message, code = "invalid_request", status = 400) {
+  return new ScrapeError(code, message, status);
+}
+
+// Numeric options and their accepted [min, max]
+const OPTION_RANGES = {
+  timeout_ms: [1000, 600000],
+  viewport_width: [100, 10000],
+  viewport_height: [100, 10000],
+  settle_delay_ms: [0, 10000],
+  overlap_px: [0, 2000],
+  jpeg_quality: [1, 100],
+  webp_quality: [1, 100],
+  avif_quality: [1, 100],
+  avif_speed: [0, 9],
+  png_colors: [2, 256],
+  png_quality: [1, 100],
+  target_max_bytes: [0, Infinity],
+  max_segment_height_px: [0, Infinity],
+  wait_for_fonts_timeout_ms: [0, 60000],
+  cpu_throttle: [1, 20],
+  page_zoom: [0.25, 4],
+  pdf_pages: [0, 100],
+  pdf_dpi: [36, 300]
+};
+
+function checkRange(options, field) {
+  const [min, max] = OPTION_RANGES[field];
+  const value = options[field];
+  if (typeof value !== "number" || !(value >= min && value <= max)) {
+    throw requestError(`${field} must be a number between ${min} and ${max}`);
+  }
+}
+
+// Cheap structural check so obviously broken selectors fail before Chrome
+// starts; the browser remains the final judge of what is valid CSS. XPath
+// selectors ("xpath=..." or a leading "//") share the bracket/quote rules.
+function checkSelector(selector, field) {
+  if (typeof selector !== "string" || !selector.trim()) throw requestError(`${field}: selectors must be non-empty strings`);
+  const closing = { "]": "[", ")": "(" };
+  const stack = [];
+  let quote = null;
+  for (let i = 0; i < selector.length; i++) {
+    const c = selector[i];
+    if (c === "\\") { i++; continue; }
+    if (quote) { if (c === quote) quote = null; continue; }
+    if (c === "\"" || c === "'") quote = c;
+    else if (c === "[" || c === "(") stack.push(c);
+    else if (closing[c] && stack.pop() !== closing[c]) throw requestError(`${field}: invalid selector ${selector}`);
+  }
+  if (quote || stack.length || /^[>+~,]|[>+~,]\s*$/.test(selector.trim())) {
+    throw requestError(`${field}: invalid selector ${selector}`);
+  }
+}
+
+const MEDIA_FEATURES = {
+  forced_colors: ["forced-colors", ["active", "none"]],
+  prefers_contrast: ["prefers-contrast", ["more", "less", "custom", "no-preference"]]
+};
+
+// CSS media type / media feature overrides for Emulation.setEmulatedMedia
+function mediaEmulation(options) {
+  const features = Object.entries(MEDIA_FEATURES)
+    .filter(([option]) => options[option] != null)
+    .map(([option, [name]]) => ({ name, value: options[option] }));
+  if (options.save_data) features.push({ name: "prefers-reduced-data", value: "reduce" });
+  if (!options.emulate_media && features.length === 0) return null;
+  return { media: options.emulate_media || "", features };
+}
+
+function checkClip(clip, field) {
+  const { x, y, width, height } = clip;
+  if (![x, y].every(v => typeof v === "number" && v >= 0) || ![width, height].every(v => typeof v === "number" && v >= 1)) {
+    throw requestError(`${field} needs numeric x, y >= 0 and width, height >= 1`);
+  }
+}
+
+// Permission names accepted by both Playwright's grants and CDP's Browser.setPermission
+const PERMISSIONS = ["geolocation", "notifications", "camera", "microphone", "clipboard-read", "clipboard-write",
+  "midi", "background-sync", "persistent-storage", "screen-wake-lock", "storage-access", "idle-detection",
+  "local-fonts", "window-management", "payment-handler", "accelerometer", "gyroscope", "magnetometer"];
+const PERMISSION_SETTINGS = ["granted", "denied", "prompt"];
+
+function grantedPermissions(permissions) {
+  if (!permissions) return undefined;
+  return Object.keys(permissions).filter(name => permissions[name] === "granted");
+}
+
+// Headless Chrome already dismisses permission prompts; explicit "denied" or
+// "prompt" states make navigator.permissions report them, for pages that branch
+// on it. Browser.setPermission is browser-level, scoped to this page's context.
+async function applyPermissionStates(context, cdp, permissions, origin) {
+  const explicit = Object.entries(permissions || {}).filter(([, setting]) => setting !== "granted");
+  if (!explicit.length) return;
+  const { targetInfo } = await cdp.send("Target.getTargetInfo");
+  const browserCdp = await context.browser().newBrowserCDPSession();
+  try {
+    for (const [name, setting] of explicit) {
+      await browserCdp.send("Browser.setPermission", {
+        permission: { name },
+        setting,
+        origin,
+        browserContextId: targetInfo.browserContextId
+      });
+    }
+  } finally {
+    await browserCdp.detach().catch(() => {});
+  }
+}
+
+const MAX_CAPTURES = 20;
+const CAPTURE_NAME = /^[a-z0-9][a-z0-9._-]{0,63}$/i;
+
+const ENGINES = ["browser", "http", "auto"];
+const HTTP_OUTPUTS = ["json", "bundle", "warc", "text-snapshot"];
 
-  const context = await browser.newContext({
+// Options that only mean something with a rendered page
+const BROWSER_ONLY = [
+  "ocr", "evidence", "annotate", "clip", "captures", "layout_selectors", "computed_styles", "font_report", "capture_icons",
+  "record_animation", "video_posters", "wait_for_canvas", "wait_for_fonts", "wait_for_request",
+  "wait_for_response", "accessibility_tree", "locales", "state", "return_state", "return_cookies",
+  "use_browser_cache", "client_certificates", "host_rules", "network_conditions", "security_events",
+  "test_csp", "permissions", "emulate_media", "forced_colors", "prefers_contrast", "client_hints", "profile",
+  "proxy", "debug", "outputs"
+];
+
+function browserOnlyOptions(options) {
+  return BROWSER_ONLY.filter(name => {
+    const value = options[name];
+    return Array.isArray(value) ? value.length > 0 : !!value;
+  });
+}
+
+// Whether the http engine can stand in for the browser on this request
+function httpCompatible(options) {
+  return browserOnlyOptions(options).length === 0 && HTTP_OUTPUTS.includes(options.output);
+}
+
+const MAX_LOCALES = 24;
+
+function localeEntry(entry) {
+  return typeof entry === "string" ? { locale: entry, timezone: null } : { locale: null, timezone: null, ...entry };
+}
+
+// Validate resolved /scrape options and derive what the capture needs from
+// them. Throws ScrapeErrors (or plain Errors for malformed sub-options);
+// never touches the browser.
+function prepareScrape(options) {
+  const {
+    url, method, image_format, output, omit_background, background_color, network_conditions,
+    client_certificates, host_rules, layout_selectors, annotate, extract_tables, computed_styles
+  } = options;
+
+  let target;
+  try {
+    target = new URL(url);
+  } catch (_) {
+    throw requestError("url must be an absolute URL");
+  }
+  if (isBlockedTarget(target.hostname)) throw requestError(`captures of ${target.hostname} are blocked`, "blocked_by_policy", 403);
+  if (!["GET", "POST"].includes(String(method).toUpperCase())) throw requestError(`unsupported method: ${method}`);
+  if (!CONTENT_TYPES[image_format]) throw requestError(`unsupported image_format: ${image_format}`);
+  if (!["json", "bundle", "warc", "domsnapshot", "text-snapshot"].includes(output)) {
+    throw requestError(`unsupported output: ${output}`);
+  }
+
+  for (const field of Object.keys(OPTION_RANGES)) checkRange(options, field);
+  if (options.overlap_px >= options.viewport_height) throw requestError("overlap_px must be less than viewport_height");
+
+  layout_selectors.forEach(sel => checkSelector(sel, "layout_selectors"));
+  annotate.forEach(a => checkSelector(typeof a === "string" ? a : a?.selector, "annotate"));
+  if (typeof extract_tables === "string") checkSelector(extract_tables, "extract_tables");
+  for (const [name, spec] of Object.entries(fieldSpecs(options.extract))) checkSelector(spec.selector, `extract.${name}`);
+  if (options.paginate) {
+    const { next_selector, max_pages = 10 } = options.paginate;
+    if (!options.extract) throw requestError("paginate needs extract fields to collect");
+    checkSelector(next_selector, "paginate.next_selector");
+    if (!Number.isInteger(max_pages) || max_pages < 2 || max_pages > MAX_PAGES) {
+      throw requestError(`paginate.max_pages must be 2-${MAX_PAGES}`);
+    }
+  }
+  (computed_styles?.selectors || []).forEach(sel => checkSelector(sel, "computed_styles"));
+
+  if (options.emulate_media != null && !["print", "screen"].includes(options.emulate_media)) {
+    throw requestError(`unsupported emulate_media: ${options.emulate_media}`);
+  }
+  for (const [option, [, values]] of Object.entries(MEDIA_FEATURES)) {
+    if (options[option] != null && !values.includes(options[option])) {
+      throw requestError(`${option} must be one of ${values.join(", ")}`);
+    }
+  }
+  for (const field of ["wait_for_request", "wait_for_response"]) {
+    if (!asList(options[field]).every(p => typeof p === "string" && p)) {
+      throw requestError(`${field} must be a URL substring or a list of them`);
+    }
+  }
+  if (!Array.isArray(options.wait_for_fonts) || !options.wait_for_fonts.every(f => typeof f === "string" && f.trim())) {
+    throw requestError("wait_for_fonts must be an array of font family names");
+  }
+  if (options.wait_for_canvas != null && options.wait_for_canvas !== false && options.wait_for_canvas !== true) {
+    const spec = options.wait_for_canvas;
+    if (typeof spec !== "object" || Array.isArray(spec)) {
+      throw requestError("wait_for_canvas must be true or { stable_frames, interval_ms, timeout_ms }");
+    }
+    const { stable_frames = 3, interval_ms = 100, timeout_ms = 10000 } = spec;
+    if (!Number.isInteger(stable_frames) || stable_frames < 1 || stable_frames > 100) {
+      throw requestError("wait_for_canvas.stable_frames must be 1-100");
+    }
+    if (!(interval_ms >= 16 && interval_ms <= 5000)) throw requestError("wait_for_canvas.interval_ms must be 16-5000");
+    if (!(timeout_ms >= 0 && timeout_ms <= options.timeout_ms)) {
+      throw requestError("wait_for_canvas.timeout_ms must be between 0 and timeout_ms");
+    }
+  }
+  if (options.clip != null) checkClip(options.clip, "clip");
+  if (!Array.isArray(options.captures) || options.captures.length > MAX_CAPTURES) {
+    throw requestError(`captures must be an array of at most ${MAX_CAPTURES} entries`);
+  }
+  const captureNames = new Set();
+  for (const entry of options.captures) {
+    const { name, clip, selector, format = image_format, quality } = entry || {};
+    if (typeof name !== "string" || !CAPTURE_NAME.test(name) || captureNames.has(name)) {
+      throw requestError("captures: each entry needs a unique name of letters, digits, '.', '_' or '-'");
+    }
+    captureNames.add(name);
+    if (clip != null && selector != null) throw requestError(`captures.${name}: give clip or selector, not both`);
+    if (clip != null) checkClip(clip, `captures.${name}.clip`);
+    if (selector != null) checkSelector(selector, `captures.${name}.selector`);
+    if (!CONTENT_TYPES[format]) throw requestError(`captures.${name}: unsupported format: ${format}`);
+    if (quality != null && !(quality >= 1 && quality <= 100)) throw requestError(`captures.${name}.quality must be 1-100`);
+  }
+  if (options.record_animation) {
+    const { selector, frames = 10, interval_ms = 200, format = "gif" } = options.record_animation;
+    checkSelector(selector, "record_animation");
+    if (!Number.isInteger(frames) || frames < 2 || frames > 100) throw requestError("record_animation.frames must be 2-100");
+    if (!(interval_ms >= 20 && interval_ms <= 5000)) throw requestError("record_animation.interval_ms must be 20-5000");
+    if (!ANIMATION_TYPES[format]) throw requestError("record_animation.format must be \"gif\" or \"webp\"");
+    if (frames * interval_ms > options.timeout_ms) {
+      throw requestError("record_animation: frames x interval_ms must fit within timeout_ms");
+    }
+  }
+  checkState(options.state);
+  if (options.headers != null && (typeof options.headers !== "object" || Array.isArray(options.headers) ||
+      !Object.values(options.headers).every(v => typeof v === "string"))) {
+    throw requestError("headers must be an object of header name -> string value");
+  }
+  if (!ENGINES.includes(options.engine)) throw requestError(`unsupported engine: ${options.engine}`);
+  if (options.engine === "http") {
+    const needsBrowser = browserOnlyOptions(options);
+    if (needsBrowser.length) throw requestError(`engine "http" cannot be combined with ${needsBrowser.join(", ")}`);
+    if (!HTTP_OUTPUTS.includes(output)) throw requestError(`engine "http" does not support output: ${output}`);
+  }
+  if (!Array.isArray(options.locales)) throw requestError("locales must be an array");
+  if (options.locales.length > MAX_LOCALES) throw requestError(`at most ${MAX_LOCALES} locales per request`);
+  if (options.locales.length && output !== "json") throw requestError("locales requires output: \"json\"");
+  if (!["ignore", "block", "follow", "all"].includes(options.popups)) throw requestError(`unsupported popups: ${options.popups}`);
+  const dialogAction = typeof options.dialogs === "string" ? options.dialogs : options.dialogs?.action;
+  if (!["accept", "dismiss"].includes(dialogAction)) throw requestError("dialogs must be \"accept\", \"dismiss\" or { action, prompt_text }");
+  if (options.permissions != null) {
+    if (typeof options.permissions !== "object" || Array.isArray(options.permissions)) {
+      throw requestError("permissions must be an object of permission name -> setting");
+    }
+    for (const [name, setting] of Object.entries(options.permissions)) {
+      if (!PERMISSIONS.includes(name)) throw requestError(`unknown permission: ${name}`);
+      if (!PERMISSION_SETTINGS.includes(setting)) throw requestError(`permissions.${name} must be one of ${PERMISSION_SETTINGS.join(", ")}`);
+    }
+  }
+  if (typeof options.javascript_enabled !== "boolean") throw requestError("javascript_enabled must be true or false");
+  if (options.compare_javascript && !options.javascript_enabled) {
+    throw requestError("compare_javascript already captures with JavaScript disabled");
+  }
+  if (options.compare_javascript && (output !== "json" || options.locales.length || options.engine !== "browser")) {
+    throw requestError("compare_javascript requires output: \"json\", engine: \"browser\" and no locales");
+  }
+  for (const { locale, timezone } of [options, ...options.locales.map(localeEntry)]) {
+    if (locale != null) {
+      try {
+        Intl.getCanonicalLocales(locale);
+      } catch (_) {
+        throw requestError(`invalid locale: ${locale}`);
+      }
+    }
+    if (timezone != null) {
+      try {
+        new Intl.DateTimeFormat("en-US", { timeZone: timezone });
+      } catch (_) {
+        throw requestError(`invalid timezone: ${timezone}`);
+      }
+    }
+  }
+
+  if (options.store) {
+    if (!storageEnabled()) throw requestError("store needs result storage (results.backend) configured");
+    if (options.locales.length || options.compare_javascript) {
+      throw requestError("store does not support locales or compare_javascript");
+    }
+    if (output === "json" && options.max_segment_height_px > 0) {
+      throw requestError("store with max_segment_height_px needs output: \"bundle\"");
+    }
+  }
+  if (!PRIORITIES.includes(options.priority)) throw requestError(`priority must be one of ${PRIORITIES.join(", ")}`);
+  if (typeof options.screenshot !== "boolean") throw requestError("screenshot must be true or false");
+  // text-snapshot answers with the page text alone: nothing to paint or scroll into view
+  const textOnly = output === "text-snapshot";
+  let pixels = options.screenshot && !textOnly;
+  if (options.fields != null) {
+    const { fields } = options;
+    if (!Array.isArray(fields) || !fields.length || fields.length > MAX_PROJECTED_FIELDS ||
+      !fields.every(f => typeof f === "string" && /^\w+(\.\w+)*$/.test(f))) {
+      throw requestError(`fields must be a list of 1-${MAX_PROJECTED_FIELDS} dotted paths like "title" or "fields.price"`);
+    }
+    if (output !== "json" || options.locales.length || options.compare_javascript) {
+      throw requestError("fields requires output: \"json\" and no locales or compare_javascript");
+    }
+    pixels &&= fields.some(f => IMAGE_FIELDS.includes(f.split(".")[0]));
+  }
+  if (!pixels) {
+    const needsImage = ["ocr", "evidence", "annotate", "clip", "captures", "record_animation"].filter(name => {
+      const value = options[name];
+      return Array.isArray(value) ? value.length > 0 : !!value;
+    });
+    if (needsImage.length) {
+      throw requestError(textOnly
+        ? `${needsImage.join(", ")} cannot be combined with output: "text-snapshot"`
+        : options.screenshot
+          ? `${needsImage.join(", ")} need the image; add "screenshot_base64" to fields`
+          : `${needsImage.join(", ")} cannot be combined with screenshot: false`);
+    }
+  }
+  if (!Array.isArray(options.outputs) || new Set(options.outputs).size !== options.outputs.length ||
+    !options.outputs.every(f => OUTPUT_FORMATS.includes(f))) {
+    throw requestError(`outputs must be a list of distinct formats from ${OUTPUT_FORMATS.join(", ")}`);
+  }
+  if (options.outputs.length) {
+    if (!pixels) throw requestError("outputs needs the screenshot (no screenshot: false, fields naming outputs)");
+    if (!["json", "bundle"].includes(output)) throw requestError("outputs requires output: \"json\" or \"bundle\"");
+    if (options.max_segment_height_px > 0) throw requestError("outputs cannot be combined with max_segment_height_px");
+    if (options.store && output !== "bundle") throw requestError("store with outputs needs output: \"bundle\"");
+    // the PDF is the whole page; it cannot follow the image's clip
+    if (options.clip && options.outputs.includes("pdf")) throw requestError("outputs: \"pdf\" cannot be combined with clip");
+  }
+  if (options.proxy != null) {
+    try {
+      checkProxy(options.proxy);
+    } catch (err) {
+      throw requestError(err.message);
+    }
+  }
+
+  let fingerprint = null;
+  if (options.profile != null) {
+    fingerprint = getProfile(options.profile);
+    if (!fingerprint) throw requestError(`unknown profile: ${options.profile}`);
+  }
+
+  const certs = clientCertificates(client_certificates);
+  const browserArgs = hostResolverArgs(host_rules);
+  const bgColor = omit_background ? { r: 0, g: 0, b: 0, a: 0 } : background_color && parseColor(background_color);
+  const networkConditions = network_conditions && resolveNetworkConditions(network_conditions);
+
+  const enc = {
+    format: image_format,
+    quality: qualityFor(options, image_format),
+    avif_speed: options.avif_speed,
+    png_palette: options.png_palette,
+    png_colors: options.png_colors,
+    progressive: options.progressive,
+    target_max_bytes: options.target_max_bytes,
+    allow_downscale: options.allow_downscale
+  };
+
+  const scroll = options.screenshot && !textOnly;
+  return { target, bgColor, networkConditions, browserArgs, certs, enc, fingerprint, pixels, scroll };
+}
+app.use(cors);
+app.use(compression);
+app.use(express.json({ limit: config.server.json_limit }));
+
+// Body parser failures get the usual envelope instead of Express's HTML page
+app.use((err, req, res, next) => {
+  if (err.type === "entity.too.large") {
+    return sendError(res, 413, "body_too_large", `request body exceeds ${config.server.json_limit}`);
+  }
+  if (err.type === "entity.parse.failed") return sendError(res, 400, "invalid_request", "request body is not valid JSON");
+  next(err);
+});
+
+// One browser capture of a validated /scrape request. Returns the JSON data
+// plus the raw pieces that bundle and WARC output are assembled from.
+async function capturePage(req, res, options, prepared) {
+  const {
+    url, timeout_ms, viewport_width, viewport_height, settle_delay_ms, overlap_px, image_format,
+    max_segment_height_px, omit_background, embed_metadata, evidence, layout_selectors, annotate, ocr,
+    ocr_lang, extract_tables, tables_format, extract_links, extract_article, extract_text, capture_icons,
+    computed_styles, font_report, http_auth, method, body, content_type, referer, user_agent, client_hints,
+    use_browser_cache, clear_state, host_rules, cpu_throttle, security_events, test_csp, output,
+    accessibility_tree, snapshot_styles
+  } = options;
+  // Intermediate artifacts for diagnosing stitching problems on a specific site
+  const debugInfo = options.debug === true || req.query.debug === "1"
+    ? { capture_method: null, scroll_origin_x: 0, scroll_positions: [], tiles: [], injected: [], chrome_stderr: [] } // stderr: dedicated browsers only
+    : null;
+  const { target, bgColor, networkConditions, browserArgs, certs, fingerprint: fp, pixels, scroll } = prepared;
+  const userAgent = user_agent || fp?.user_agent;
+  const languages = options.locale ? null : fp?.languages;
+  const extraHeaders = {
+    ...(languages ? { "Accept-Language": languages.join(",") } : {}),
+    ...options.headers,
+    ...(options.save_data ? { "Save-Data": "on" } : {})
+  };
+  // encodeImage options gain per-capture metadata, so never share them
+  const enc = { ...prepared.enc };
+
+  const contextOptions = {
     viewport: { width: viewport_width, height: viewport_height },
-    deviceScaleFactor: 1
+    deviceScaleFactor: 1,
+    // Playwright answers Fetch.authRequired challenges with these; scoped to the
+    // target origin so credentials never leak to third-party subresources
+    httpCredentials: http_auth && http_auth.username
+      ? {
+          username: http_auth.username,
+          password: http_auth.password ?? "",
+          origin: http_auth.origin || target.origin,
+          send: "unauthorized"
+        }
+      : undefined,
+    clientCertificates: certs.length ? certs : undefined,
+    permissions: grantedPermissions(options.permissions),
+    // Playwright applies this with Emulation.setScriptExecutionDisabled on every page and frame
+    javaScriptEnabled: options.javascript_enabled !== false,
+    locale: options.locale || languages?.[0] || undefined,
+    timezoneId: options.timezone || fp?.timezone || undefined,
+    screen: fp?.screen,
+    extraHTTPHeaders: Object.keys(extraHeaders).length ? extraHeaders : undefined,
+    storageState: options.state
+      ? {
+          cookies: options.state.cookies,
+          origins: options.state.origins.map(o => ({ origin: o.origin, localStorage: o.localStorage || [] }))
+        }
+      : undefined
+  };
+
+  // Warm contexts live in the shared browser, so per-launch flags (host_rules) opt out
+  // Browser.setPermission states outlive the capture, so they are part of the key
+  const cacheKey = warmContextKey(req.tenant.id, target.origin, {
+    ...contextOptions,
+    permission_states: options.permissions
   });
+  if (clear_state) await dropWarmContext(cacheKey);
+  let browser = null;
+  let context;
+  let releaseContext = () => {};
+  let opener;
+  try {
+    // A per-request proxy (and its relay) lives only as long as the capture, so it never goes warm
+    if (use_browser_cache && !clear_state && browserArgs.length === 0 && !options.proxy &&
+        settings.max_warm_contexts > 0) {
+      ({ context, release: releaseContext } = await acquireWarmContext(cacheKey, contextOptions));
+    } else if (settings.reuse_browser && browserArgs.length === 0 && !debugInfo) {
+      // Pooled: a throwaway incognito context in the shared browser instead of a new Chrome
+      const relay = await browserProxy(options.proxy || nextProxy());
+      let isolated;
+      try {
+        isolated = await (await getSharedBrowser()).newContext({ ...contextOptions, proxy: relay.proxy });
+      } catch (err) {
+        relay.close();
+        throw err;
+      }
+      releaseContext = () => isolated.close().catch(() => {}).finally(relay.close);
+      context = isolated;
+      await blockNoise(context);
+    } else {
+      browser = await launchBrowser(browserArgs, debugInfo && debugInfo.chrome_stderr, options.proxy || nextProxy());
+      context = await browser.newContext(contextOptions);
+      await blockNoise(context);
+    }
+    opener = await context.newPage();
+  } catch (err) {
+    // The capture's own finally is not reached yet, so give back what was set up
+    if (browser) await browser.close().catch(() => {});
+    else releaseContext();
+    throw err;
+  }
+  // the capture target; popups: "follow" moves it to the newest popup
+  let page = opener;
+
+  // Console and network activity, shipped in bundle output
+  const consoleLog = [];
+  const networkLog = [];
+  page.on("console", msg => consoleLog.push({ type: msg.type(), text: msg.text(), location: msg.location() }));
+  page.on("pageerror", err => consoleLog.push({ type: "pageerror", text: err.message }));
+
+  // Answer JS dialogs at once so an alert() on load cannot stall the capture
+  const dialogs = [];
+  const dialogPolicy = typeof options.dialogs === "string" ? { action: options.dialogs } : options.dialogs;
+  const answerDialog = dialog => {
+    const accept = dialog.type() === "beforeunload" || dialogPolicy.action === "accept";
+    dialogs.push({
+      type: dialog.type(),
+      message: dialog.message().slice(0, 1000),
+      action: accept ? "accept" : "dismiss"
+    });
+    (accept ? dialog.accept(dialog.type() === "prompt" ? dialogPolicy.prompt_text ?? dialog.defaultValue() : undefined)
+      : dialog.dismiss()).catch(() => {});
+  };
+  page.on("dialog", answerDialog);
 
-  const page = await context.newPage();
+  // Windows the page opens (OAuth, target=_blank, window.open)
+  const popups = [];
+  const popupLog = [];
+  page.on("popup", popup => {
+    popup.on("dialog", answerDialog);
+    if (options.popups === "block") {
+      popupLog.push({ url: popup.url(), action: "blocked" });
+      popup.close().catch(() => {});
+    } else {
+      popups.push(popup);
+    }
+  });
 
+  // Past the caller's deadline (or after it hung up) closing the pages makes
+  // whatever step is running fail at once
+  const abortCapture = () => {
+    for (const p of [opener, ...popups]) p.close().catch(() => {});
+  };
+  res.locals.abort?.addEventListener("abort", abortCapture, { once: true });
+  if (res.locals.abort?.aborted) abortCapture();
+  page.on("requestfinished", async request => {
+    const response = await request.response().catch(() => null);
+    networkLog.push({
+      url: request.url(),
+      method: request.method(),
+      resource_type: request.resourceType(),
+      status: response ? response.status() : null
+    });
+  });
+  page.on("requestfailed", request => networkLog.push({
+    url: request.url(),
+    method: request.method(),
+    resource_type: request.resourceType(),
+    failure: request.failure()?.errorText
+  }));
+
+  // Full request/response pairs (with bodies) for WARC output
+  const exchanges = [];
+  const pendingBodies = [];
+  if (output === "warc") {
+    page.on("response", response => {
+      const request = response.request();
+      pendingBodies.push((async () => {
+        const exchange = {
+          url: response.url(),
+          method: request.method(),
+          requestHeaders: await request.allHeaders().catch(() => request.headers()),
+          postData: request.postDataBuffer(),
+          status: response.status(),
+          statusText: response.statusText(),
+          responseHeaders: await response.allHeaders().catch(() => response.headers()),
+          // redirects and some aborted loads have no retrievable body
+          body: await response.body().catch(() => null),
+          date: new Date().toISOString()
+        };
+        if (/^https?:/.test(exchange.url)) exchanges.push(exchange);
+      })());
+    });
+  }
+
+  const transfer = watchTransfer();
+  const resources = watchResources();
   try {
+    // Per-target emulation, applied again to a followed popup
+    const emulate = async (p, session) => {
+      if (bgColor) {
+        await session.send("Emulation.setDefaultBackgroundColorOverride", { color: bgColor });
+      }
+      if (networkConditions) {
+        await session.send("Network.enable");
+        await session.send("Network.emulateNetworkConditions", networkConditions);
+      }
+      if (userAgent || client_hints) {
+        const { product, userAgent: defaultAgent } = await session.send("Browser.getVersion");
+        const browserVersion = product.split("/")[1] || "0.0.0.0";
+        await session.send("Emulation.setUserAgentOverride", {
+          userAgent: userAgent || defaultAgent.replace("HeadlessChrome", "Chrome"),
+          userAgentMetadata: client_hints ? userAgentMetadata(client_hints, browserVersion) : undefined
+        });
+      }
+      if (cpu_throttle > 1) {
+        await session.send("Emulation.setCPUThrottlingRate", { rate: Math.min(cpu_throttle, 20) });
+      }
+      const media = mediaEmulation(options);
+      if (media) await session.send("Emulation.setEmulatedMedia", media);
+      if (fp) await p.addInitScript(applyFingerprint, fp);
+      if (options.save_data) {
+        await p.addInitScript(() => {
+          if (navigator.connection) Object.defineProperty(navigator.connection, "saveData", { get: () => true });
+        });
+      }
+    };
+    let cdp = await context.newCDPSession(page);
+    await emulate(page, cdp);
+    await transfer.attach(cdp);
+    await resources.attach(cdp);
+    await applyPermissionStates(context, cdp, options.permissions, target.origin);
+    const securityReport = security_events || test_csp
+      ? await watchSecurity(page, cdp, { testCsp: test_csp })
+      : null;
+
     // Set sane timeouts
     page.setDefaultNavigationTimeout(timeout_ms);
     page.setDefaultTimeout(timeout_ms);
 
-    // Block heavy/analytics requests that can keep the network busy
-    await context.route("**/*", route => {
-      const reqUrl = route.request().url();
-      const isAnalytics = [
-        "googletagmanager.com",
-        "google-analytics.com",
-        "facebook.com/tr",
-        "hotjar.com",
-        "segment.com",
-        "mixpanel.com",
-        "fullstory.com"
-      ].some(domain => reqUrl.includes(domain));
-      const isMedia = /\.(mp4|webm|gif|mov|avi)(\?|$)/i.test(reqUrl);
-      if (isAnalytics || isMedia) return route.abort();
-      return route.continue();
+    if (String(method).toUpperCase() === "POST") {
+      await postNavigation(page, { body, content_type });
+    }
+
+    const networkWaits = watchNetwork(page, options, timeout_ms);
+    let mainResponse = null;
+    page.on("response", response => {
+      if (response.frame() === page.mainFrame() && response.request().isNavigationRequest()) mainResponse = response;
     });
+    if (options.state) await page.addInitScript(restoreSessionStorage, options.state.origins);
+    let allowMedia = false;
+    if (options.video_posters) {
+      await page.route("**/*", route => (allowMedia && route.request().resourceType() === "media"
+        ? route.continue()
+        : route.fallback()));
+    }
+    if (options.wait_for_canvas) await page.addInitScript(preserveCanvasBuffers);
 
     // Avoid networkidle which is unreliable on sites with beacons/analytics
-    await page.goto(url, { timeout: timeout_ms, waitUntil: "domcontentloaded" });
+    setStage(res, "navigating");
+    traceAttributes(res, { "url.full": url, "scraper.job_id": res.locals.job?.id });
+    traceStage(res, "navigate");
+    const navigation = await page.goto(url, { timeout: timeout_ms, waitUntil: "domcontentloaded", referer: referer || undefined })
+      .catch(err => {
+        // attachments (including PDFs in headless Chrome) download instead of rendering
+        if (mainResponse && /Download is starting|net::ERR_ABORTED/.test(err.message)) return null;
+        throw err;
+      });
+    // goto's own response when no navigation response event was seen (e.g. served by a service worker)
+    mainResponse ??= navigation;
+    const mainType = mainResponse?.headers()["content-type"] || "";
+    const kind = navigation ? documentKind(mainType) : "pdf";
+    let rawDocument;
+    if (kind) {
+      const raw = await documentBody(context, mainResponse, timeout_ms);
+      if (kind === "pdf" && !isPdf(raw)) {
+        throw new ScrapeError("navigation_aborted", `${mainResponse.url()} is a download, not a page`);
+      }
+      // Raw content instead of a screenshot of Chrome's built-in viewer, unless
+      // document_view asks for that rendering as well (PDFs have none headless)
+      if (kind === "pdf" || !options.document_view) {
+        setStage(res, "encoding");
+        traceStage(res, "encode", { "scraper.document": kind });
+        const capturedAt = new Date().toISOString();
+        if (embed_metadata) {
+          enc.metadata = {
+            url: mainResponse.url(),
+            captured_at: capturedAt,
+            viewport: { width: viewport_width, height: viewport_height },
+            software: SOFTWARE
+          };
+        }
+        const data = kind === "pdf"
+          ? await capturePdf(req, raw, options, enc, mainResponse.url())
+          : { document: await describeDocument(kind, mainType, raw), final_url: mainResponse.url() };
+        data.storage_state = options.return_cookies ? await context.storageState() : undefined;
+        data.state = options.return_state ? await exportState(context, page) : undefined;
+        data.transfer = transfer.summary();
+        data.resources = await resources.report({ tiles: 0, segments: 0, pixels: 0 });
+        data.debug = debugInfo || undefined;
+        if (output === "warc") await Promise.all(pendingBodies);
+        return { data, encoded: null, tiles: [], html: null, capturedAt, consoleLog, networkLog, exchanges, debugInfo };
+      }
+      rawDocument = await describeDocument(kind, mainType, raw);
+    }
+    traceStage(res, "wait");
     // Give the page a moment to finish loading assets
     await page.waitForLoadState("load", { timeout: Math.min(timeout_ms, 10000) }).catch(() => {});
+    await networkWaits();
+    if (options.popups === "follow" && popups.length) {
+      page = popups[popups.length - 1];
+      await page.waitForLoadState("load", { timeout: Math.min(timeout_ms, 10000) }).catch(() => {});
+      page.setDefaultNavigationTimeout(timeout_ms);
+      page.setDefaultTimeout(timeout_ms);
+      cdp = await context.newCDPSession(page);
+      await emulate(page, cdp);
+      await transfer.attach(cdp);
+      await resources.attach(cdp);
+      popupLog.push({ url: page.url(), action: "followed" });
+    }
 
     // disable animations & parallax
-    await page.addStyleTag({ content: `
+    const freezeCss = `
       * { animation: none !important; transition: none !important; }
       html, body, * { background-attachment: initial !important; scroll-behavior: auto !important; }
-    `});
+    `;
+    const freezeStyle = await page.addStyleTag({ content: freezeCss });
 
     // force eager load for lazy images
-    await page.evaluate(() => {
+    const eagerImages = () => {
       document.querySelectorAll("img[loading]").forEach(img => img.loading = "eager");
       document.querySelectorAll("img[data-src]").forEach(img => {
         if (!img.src) img.src = img.getAttribute("data-src");
       });
-    });
+    };
+    await page.evaluate(eagerImages);
+    debugInfo?.injected.push({ kind: "style", source: freezeCss.trim() }, { kind: "script", source: eagerImages.toString() });
 
-    let totalHeight = await page.evaluate(() =>
-      Math.max(document.body.scrollHeight, document.documentElement.scrollHeight)
-    );
+    // Browser-style zoom: the page lays out as if the viewport were 1/zoom as wide
+    if (options.page_zoom !== 1) {
+      const zoomCss = `html { zoom: ${options.page_zoom} !important; }`;
+      await page.addStyleTag({ content: zoomCss });
+      debugInfo?.injected.push({ kind: "style", source: zoomCss });
+    }
 
-    // Auto-scroll through the page to trigger lazy loading
-    const scrollStep = Math.max(200, Math.floor(viewport_height * 0.8));
-    let currentY = 0;
-    while (currentY + viewport_height < totalHeight) {
-      await page.evaluate(_y => window.scrollTo(0, _y), currentY);
-      await page.waitForTimeout(settle_delay_ms);
-      currentY += scrollStep;
-    }
-    // Ensure we hit the bottom at least once
-    await page.evaluate(() => window.scrollTo(0, document.documentElement.scrollHeight));
-    await page.waitForTimeout(Math.max(400, settle_delay_ms));
-    // Recompute height in case content expanded after lazy loads
-    totalHeight = await page.evaluate(() =>
+    let totalHeight = await page.evaluate(() =>
       Math.max(document.body.scrollHeight, document.documentElement.scrollHeight)
     );
-    // Return to top for consistent screenshots
-    await page.evaluate(() => window.scrollTo(0, 0));
-    await page.waitForTimeout(Math.min(800, Math.max(200, settle_delay_ms)));
 
-    // First try native full-page screenshot to capture entire page in one image
-    let finalBuffer = null;
-    try {
-      finalBuffer = await page.screenshot({
-        fullPage: true,
-        type: image_format === "jpeg" ? "jpeg" : "png",
-        quality: image_format === "jpeg" ? jpeg_quality : undefined
-      });
-    } catch (_) {}
-
-    if (!finalBuffer) {
-      // Fallback: tile + stitch
-      const tiles = [];
-      let y = 0;
-      while (y < totalHeight) {
-        await page.evaluate(_y => window.scrollTo(0, _y), y);
+    // screenshot: false and text-snapshot skip the lazy-load pass; there are no tiles to line up
+    let scrollOriginX = 0;
+    if (scroll) {
+      // Auto-scroll through the page to trigger lazy loading
+      setStage(res, "scrolling");
+      const scrollStep = Math.max(200, Math.floor(viewport_height * 0.8));
+      let currentY = 0;
+      while (currentY + viewport_height < totalHeight) {
+        await page.evaluate(_y => window.scrollTo(0, _y), currentY);
+        debugInfo?.scroll_positions.push(currentY);
         await page.waitForTimeout(settle_delay_ms);
+        currentY += scrollStep;
+      }
+      // Ensure we hit the bottom at least once
+      await page.evaluate(() => window.scrollTo(0, document.documentElement.scrollHeight));
+      await page.waitForTimeout(Math.max(400, settle_delay_ms));
+      // Recompute height in case content expanded after lazy loads
+      totalHeight = await page.evaluate(() =>
+        Math.max(document.body.scrollHeight, document.documentElement.scrollHeight)
+      );
+      if (!(totalHeight > 0)) {
+        throw new ScrapeError("height_detection_failed", `could not determine page height (got ${totalHeight})`);
+      }
+      // Return to top for consistent screenshots
+      await page.evaluate(() => window.scrollTo(0, 0));
+      await page.waitForTimeout(Math.min(800, Math.max(200, settle_delay_ms)));
+      // RTL documents scroll from the right: scrollX runs from -(overflow) to 0.
+      // scrollOriginX is that overflow, the offset from scrollX to image x.
+      scrollOriginX = await page.evaluate(() => {
+        const y = window.scrollY;
+        window.scrollTo(-1e7, y);
+        const min = window.scrollX;
+        window.scrollTo(0, y);
+        return -min;
+      });
+      if (debugInfo) debugInfo.scroll_origin_x = scrollOriginX;
+    }
+    const fontWait = await waitForFonts(page, options.wait_for_fonts, options.wait_for_fonts_timeout_ms);
+    const canvasWait = options.wait_for_canvas
+      ? await waitForCanvas(page, options.wait_for_canvas, remainingMs(res, timeout_ms))
+      : undefined;
+    let videoPosters;
+    if (options.video_posters) {
+      // media is normally aborted; let it through just long enough to grab first frames
+      allowMedia = true;
+      videoPosters = await substituteVideoPosters(page, Math.min(timeout_ms, 10000));
+      allowMedia = false;
+    }
 
-        const buf = await page.screenshot({ fullPage: false });
-        tiles.push(buf);
+    // Flattened DOM + layout boxes, taken at the same scroll position as the screenshot
+    const domSnapshot = output === "domsnapshot"
+      ? await cdp.send("DOMSnapshot.captureSnapshot", {
+          computedStyles: snapshot_styles,
+          includeDOMRects: true,
+          includePaintOrder: true
+        })
+      : undefined;
+    const axTree = accessibility_tree ? await accessibilityTree(cdp) : undefined;
+    const layout = layout_selectors.length ? await collectLayout(page, layout_selectors, scrollOriginX) : undefined;
+    const tables = extract_tables
+      ? await extractTables(page, {
+          selector: typeof extract_tables === "string" ? extract_tables : "table",
+          format: tables_format
+        })
+      : undefined;
+    const links = extract_links ? await extractLinks(page) : undefined;
+    const extracted = options.extract ? await extractFields(page, fieldSpecs(options.extract)) : undefined;
+    const article = extract_article ? await extractArticle(page) : undefined;
+    const product = options.extract_product ? await extractProduct(page) : undefined;
+    const snapshotText = output === "text-snapshot" ? await textSnapshot(page) : undefined;
+    const pageText = extract_text || extract_article ? await extractText(page) : undefined;
+    const styles = computed_styles && computed_styles.selectors?.length
+      ? await extractComputedStyles(page, {
+          selectors: computed_styles.selectors,
+          properties: computed_styles.properties?.length ? computed_styles.properties : DEFAULT_SNAPSHOT_STYLES
+        })
+      : undefined;
+    const fonts = font_report ? await fontInventory(page) : undefined;
+    const security = securityReport ? await securityReport() : undefined;
+    const icons = capture_icons ? await fetchIcons(page, Math.min(timeout_ms, 10000)) : undefined;
+    const annotateSpecs = annotate.map(a => typeof a === "string" ? { selector: a } : a).map(a => ({
+      selector: a.selector,
+      label: a.label ?? a.selector,
+      color: /^#[0-9a-f]{3,8}$|^[a-z]+$/i.test(a.color || "") ? a.color : "#ff0044"
+    }));
+    const annotateBoxes = annotateSpecs.length
+      ? await collectLayout(page, annotateSpecs.map(a => a.selector), scrollOriginX)
+      : null;
+    // selector entries in captures crop to their first visible match
+    const captureSelectors = options.captures.filter(c => c.selector != null).map(c => c.selector);
+    const captureBoxes = captureSelectors.length
+      ? await collectLayout(page, captureSelectors, scrollOriginX)
+      : [];
 
-        y += viewport_height - overlap_px;
-        if (y + viewport_height >= totalHeight) {
-          await page.evaluate(() => window.scrollTo(0, document.documentElement.scrollHeight));
+    // First try native full-page screenshot to capture entire page in one image.
+    // Capture losslessly and let sharp do the final encode so every format and
+    // the size auto-tuning work from the same master.
+    setStage(res, "capturing");
+    traceStage(res, "tiles");
+    let master = null;
+    let tiles = [];
+    // Chrome's full-page capture starts at x = 0 and would clip the left-hand
+    // overflow of RTL pages, so those always go through the tile pass
+    if (pixels && scrollOriginX === 0) {
+      try {
+        master = await page.screenshot({ fullPage: true, type: "png", omitBackground: omit_background });
+      } catch (_) {}
+    }
+
+    if (debugInfo) debugInfo.capture_method = master ? "full_page" : pixels ? "tiles" : "none";
+
+    // fields without an image: everything below works from the page alone
+    if (pixels && !master) {
+      // Fallback: tile + stitch, across as well as down when the page scrolls sideways.
+      // Each tile is placed at the scroll offset the browser actually reports.
+      const totalWidth = await page.evaluate(() =>
+        Math.max(document.body.scrollWidth, document.documentElement.scrollWidth)
+      );
+      const placed = [];
+      for (const y of tileOffsets(totalHeight, viewport_height, overlap_px)) {
+        for (const x of tileOffsets(totalWidth, viewport_width, overlap_px)) {
+          const [scrollX, scrollY] = await page.evaluate(([_x, _y]) => {
+            window.scrollTo(_x, _y);
+            return [window.scrollX, window.scrollY];
+          }, [x - scrollOriginX, y]);
           await page.waitForTimeout(settle_delay_ms);
-          tiles.push(await page.screenshot({ fullPage: false }));
-          break;
+          const buf = await page.screenshot({ fullPage: false, omitBackground: omit_background });
+          tiles.push(buf);
+          placed.push({ buf, left: scrollX + scrollOriginX, top: scrollY });
         }
       }
 
-      // Stitch vertically with Sharp (normalize widths, compute final height first)
+      traceStage(res, "stitch", { "scraper.tiles": tiles.length });
       if (tiles.length === 0) {
-        throw new Error("No screenshots captured");
+        throw new ScrapeError("capture_failed", "No screenshots captured");
       }
 
-      const prepared = await Promise.all(
-        tiles.map(async b => {
-          const img = sharp(b).ensureAlpha();
-          const meta = await img.metadata();
-          return { img, meta };
-        })
-      );
+      const sized = await Promise.all(placed.map(async p => ({ ...p, ...(await sharp(p.buf).metadata()) })));
+      const canvasWidth = Math.max(...sized.map(p => p.left + p.width));
+      const canvasHeight = Math.max(...sized.map(p => p.top + p.height));
+      const stitched = sharp({
+        create: {
+          width: canvasWidth,
+          height: canvasHeight,
+          channels: 4,
+          background: bgColor
+            ? { r: bgColor.r, g: bgColor.g, b: bgColor.b, alpha: bgColor.a }
+            : { r: 255, g: 255, b: 255, alpha: 1 }
+        }
+      }).composite(sized.map(p => ({ input: p.buf, top: p.top, left: p.left })));
+      sized.forEach((p, i) => debugInfo?.tiles.push({
+        index: i,
+        scroll_x: p.left - scrollOriginX,
+        scroll_y: p.top,
+        seam_left_px: p.left,
+        seam_top_px: p.top,
+        width_px: p.width,
+        height_px: p.height,
+        screenshot_base64: new Base64Value(tiles[i])
+      }));
+
+      master = await stitched.png().toBuffer();
+    }
+
+    // clip is in page coordinates, so it is cut from the stitched master
+    let clipRegion;
+    if (options.clip) ({ buffer: master, region: clipRegion } = await cropImage(master, options.clip));
+
+    // Recorded after the still so unfreezing animations cannot affect it
+    let animation;
+    if (options.record_animation) {
+      await freezeStyle.evaluate(el => el.remove()).catch(() => {});
+      animation = await recordAnimation(page, options.record_animation, remainingMs(res, timeout_ms), req.tenant);
+    }
+
+    const capturedAt = new Date().toISOString();
+    if (embed_metadata) {
+      enc.metadata = {
+        url: page.url(),
+        captured_at: capturedAt,
+        viewport: { width: viewport_width, height: viewport_height },
+        software: SOFTWARE
+      };
+    }
+
+    setStage(res, "encoding");
+    traceStage(res, "encode", { "scraper.format": image_format });
+    const masterMeta = master ? await sharp(master, { limitInputPixels: false }).metadata() : null;
+    if (masterMeta) chargePixels(req.tenant, masterMeta.width * masterMeta.height);
+    // OCR the clean capture, before any annotation is drawn over it
+    const ocrResult = ocr ? await runOcr(master, { lang: ocr_lang, timeoutMs: timeout_ms * 2 }) : undefined;
+    if (annotateBoxes) {
+      const boxes = clipRegion ? shiftLayout(annotateBoxes, clipRegion) : annotateBoxes;
+      master = await annotateImage(master, masterMeta, boxes, annotateSpecs);
+    }
+    const hashes = master ? await perceptualHashes(master) : undefined;
+    const segments = master && max_segment_height_px > 0 && masterMeta.height > max_segment_height_px
+      ? await splitSegments(master, masterMeta, max_segment_height_px, enc)
+      : null;
+
+    const encoded = segments || !master ? null : await encodeImage(master, enc);
+    if (master) {
+      setThumbnail(res.locals.job?.id, await sharp(master, { limitInputPixels: false })
+        .resize({ width: 320, height: 480, fit: "cover", position: "top" })
+        .flatten({ background: "#ffffff" })
+        .jpeg({ quality: 70 })
+        .toBuffer());
+    }
+    const b64 = encoded ? new Base64Value(encoded.buffer, encoded.digest) : null;
+    const namedCaptures = options.captures.length
+      ? await encodeCaptures(master, options, enc, captureBoxes, clipRegion)
+      : undefined;
+    const outputs = options.outputs.length
+      ? await encodeOutputs(page, master, encoded, options, enc, totalHeight)
+      : undefined;
+
+    const title = await page.title();
+    let html = output === "bundle" ? await page.content() : null;
 
-      const targetWidth = Math.min(...prepared.map(p => p.meta.width || 0));
-      const normalized = await Promise.all(
-        prepared.map(async (p) => {
-          let buf = await (p.meta.width !== targetWidth
-            ? p.img.resize({ width: targetWidth }).toBuffer()
-            : p.img.toBuffer());
-          const meta = await sharp(buf).metadata();
-          return { buf, width: meta.width || targetWidth, height: meta.height || 0 };
+    const evidenceBundle = evidence
+      ? await buildEvidence({
+          url,
+          final_url: page.url(),
+          captured_at: capturedAt,
+          software: SOFTWARE,
+          images: segments
+            ? segments.map(seg => seg.screenshot_base64.buffer)
+            : [encoded.buffer],
+          html: html ??= await page.content(),
+          timeoutMs: Math.min(timeout_ms, 10000)
         })
-      );
+      : undefined;
+
+    const data = {
+      screenshot_base64: b64,
+      segments,
+      content_type: master ? CONTENT_TYPES[image_format] : undefined,
+      hashes,
+      encoding: encoded && {
+        quality: encoded.quality,
+        scale: encoded.scale,
+        bytes: encoded.buffer.length,
+        target_met: encoded.target_met !== false
+      },
+      title,
+      final_url: page.url(),
+      viewport: { width: viewport_width, height: viewport_height },
+      overlap_px,
+      settle_delay_ms,
+      total_height_px: totalHeight,
+      layout: layout && scaleLayout(clipRegion ? shiftLayout(layout, clipRegion) : layout, encoded ? encoded.scale : 1,
+        segments ? max_segment_height_px : 0),
+      clip: clipRegion,
+      captures: namedCaptures,
+      outputs,
+      ocr: ocrResult && encoded && encoded.scale < 1
+        ? {
+            ...ocrResult,
+            words: ocrResult.words.map(w => ({
+              ...w,
+              x: Math.round(w.x * encoded.scale),
+              y: Math.round(w.y * encoded.scale),
+              width: Math.round(w.width * encoded.scale),
+              height: Math.round(w.height * encoded.scale)
+            }))
+          }
+        : ocrResult,
+      dom_snapshot: domSnapshot,
+      accessibility_tree: axTree,
+      fields: extracted && extracted.fields,
+      field_errors: extracted && extracted.errors,
+      tables,
+      links,
+      article,
+      product,
+      text_snapshot: snapshotText,
+      text: extract_text ? pageText.text : undefined,
+      content: pageText && pageText.stats,
+      icons,
+      computed_styles: styles,
+      fonts,
+      font_wait: fontWait,
+      canvas_wait: canvasWait,
+      video_posters: videoPosters,
+      dialogs: dialogs.length ? dialogs : undefined,
+      // popup images only when the request wants images at all
+      popups: options.popups === "all" && pixels
+        ? await capturePopups(popups, enc, timeout_ms, req.tenant)
+        : popupLog.length ? popupLog : undefined,
+      document: rawDocument,
+      // cookies + per-origin localStorage, loadable again via Playwright's storageState
+      storage_state: options.return_cookies ? await context.storageState() : undefined,
+      state: options.return_state ? await exportState(context, page) : undefined,
+      animation,
+      security,
+      evidence: evidenceBundle,
+      debug: debugInfo || undefined
+    };
+
+    // Last: following "Next" moves the page away from what was captured above
+    if (options.paginate) {
+      data.dataset = await paginateBrowser(page, { max_pages: 10, ...options.paginate }, fieldSpecs(options.extract),
+        extracted.fields, { timeoutMs: Math.min(timeout_ms, 15000), settleMs: settle_delay_ms });
+    }
+
+    data.transfer = transfer.summary();
+    data.resources = await resources.report({
+      tiles: tiles.length,
+      segments: segments ? segments.length : 0,
+      pixels: masterMeta ? masterMeta.width * masterMeta.height : 0
+    });
+    if (output === "warc") await Promise.all(pendingBodies);
+    return { data, encoded, tiles, html, capturedAt, consoleLog, networkLog, exchanges, debugInfo };
+  } finally {
+    // billed whether or not the capture succeeded; the proxy carried the bytes either way
+    chargeTransfer(req.tenant, transfer.summary().total_bytes);
+    resources.stop();
+    res.locals.abort?.removeEventListener("abort", abortCapture);
+    if (browser) {
+      await browser.close();
+    } else {
+      await Promise.all([opener, ...popups].map(p => p.close().catch(() => {})));
+      releaseContext();
+    }
+  }
+}
+
+// engine: "http": fetch without a browser and run the DOM extractors over the
+// response. Same result shape as capturePage, minus anything that needs pixels.
+async function captureHttp(req, res, options) {
+  const { url, method, body, content_type, referer, user_agent, http_auth, timeout_ms, output } = options;
+  const headers = { ...options.headers };
+  if (referer) headers.referer = referer;
+  if (user_agent) headers["user-agent"] = user_agent;
+  if (options.locale) headers["accept-language"] = options.locale;
+  if (options.save_data) headers["save-data"] = "on";
+  let postBody;
+  let postHeaders = headers;
+  if (String(method).toUpperCase() === "POST") {
+    const { postData, contentType } = encodePostBody(body, content_type);
+    postBody = postData;
+    postHeaders = { ...headers, "content-type": contentType };
+  }
 
-      // Compute final canvas height accounting for overlaps
-      let finalHeight = 0;
-      for (let i = 0; i < normalized.length; i++) {
-        const h = normalized[i].height;
-        if (i === 0) finalHeight += h; else finalHeight += Math.max(0, h - overlap_px);
+  const resources = watchResources();
+  try {
+    setStage(res, "navigating");
+    traceAttributes(res, { "url.full": url, "scraper.job_id": res.locals.job?.id, "scraper.engine": "http" });
+    traceStage(res, "navigate");
+    const auth = http_auth && http_auth.username ? http_auth : null;
+    const fetched = await fetchDocument(url, {
+      method: String(method).toUpperCase(),
+      headers: postHeaders,
+      body: postBody,
+      auth,
+      timeoutMs: timeout_ms,
+      abort: res.locals.abort
+    });
+    const capturedAt = new Date().toISOString();
+    const contentType = fetched.headers["content-type"] || "";
+    const networkLog = fetched.exchanges.map(e => ({
+      url: e.url,
+      method: e.method,
+      resource_type: "document",
+      status: e.status
+    }));
+    // fetch hands over decoded bodies, so compressed responses are counted at their decoded size
+    const transfer = summarize(fetched.exchanges.map(e => ({
+      url: e.url,
+      type: "document",
+      bytes: e.body.length +
+        Object.entries(e.responseHeaders).reduce((n, [k, v]) => n + k.length + String(v).length + 4, 0),
+      cached: false
+    })));
+    chargeTransfer(req.tenant, transfer.total_bytes);
+
+    const data = {
+      engine: "http",
+      status: fetched.status,
+      content_type: contentType.split(";")[0].trim() || null,
+      final_url: fetched.url,
+      redirects: fetched.redirects,
+      transfer
+    };
+    let html = null;
+    const kind = documentKind(contentType);
+    if (kind) {
+      data.document = await describeDocument(kind, contentType, fetched.body);
+    } else {
+      html = fetched.body.toString("utf8");
+      const wantsDom = options.extract || options.extract_tables || options.extract_links || options.extract_article ||
+        options.extract_product || options.extract_text || output === "text-snapshot";
+      setStage(res, "capturing");
+      const page = wantsDom ? await documentPage(html, fetched.url) : null;
+      try {
+        data.title = page
+          ? await page.title()
+          : (html.match(/<title[^>]*>([^<]*)<\/title>/i)?.[1] || "").trim();
+        data.tables = options.extract_tables
+          ? await extractTables(page, {
+              selector: typeof options.extract_tables === "string" ? options.extract_tables : "table",
+              format: options.tables_format
+            })
+          : undefined;
+        const extracted = options.extract ? await extractFields(page, fieldSpecs(options.extract)) : undefined;
+        data.fields = extracted && extracted.fields;
+        data.field_errors = extracted && extracted.errors;
+        data.dataset = options.paginate
+          ? await paginateHttp(page, { max_pages: 10, ...options.paginate }, fieldSpecs(options.extract),
+              extracted.fields, { headers, auth, timeoutMs: timeout_ms })
+          : undefined;
+        data.links = options.extract_links ? await extractLinks(page) : undefined;
+        data.article = options.extract_article ? await extractArticle(page) : undefined;
+        data.product = options.extract_product ? await extractProduct(page) : undefined;
+        data.text_snapshot = output === "text-snapshot" ? await textSnapshot(page) : undefined;
+        const pageText = options.extract_text || options.extract_article ? await extractText(page) : undefined;
+        data.text = options.extract_text ? pageText.text : undefined;
+        data.content = pageText && pageText.stats;
+      } finally {
+        page?.close();
       }
+      if (output === "json") data.html = html;
+    }
+    data.resources = await resources.report({ tiles: 0, segments: 0, pixels: 0 });
+    return {
+      data,
+      encoded: null,
+      tiles: [],
+      html,
+      capturedAt,
+      consoleLog: [],
+      networkLog,
+      exchanges: output === "warc" ? fetched.exchanges : [],
+      debugInfo: null
+    };
+  } finally {
+    resources.stop();
+  }
+}
 
-      let stitched = sharp({
-        create: {
-          width: targetWidth,
-          height: finalHeight,
-          channels: 4,
-          background: { r: 255, g: 255, b: 255, alpha: 1 }
-        }
+// Browser failures the http engine may get past; network-level ones it would repeat
+const FALLBACK_CODES = new Set(["navigation_failed", "nav_timeout", "timeout", "browser_crashed", "height_detection_failed",
+  "capture_failed"]);
+
+// Run the requested engine. "auto" tries http first and keeps its result when
+// the initial HTML already carries the content; engine_fallback (implied by
+// "auto") retries a failed browser capture over http. A capture that wants
+// the screenshot only goes over http on an explicit engine_fallback, since
+// "auto" should not quietly drop the image. data.engine reports which one
+// produced the result, data.engine_fallback why the other was skipped.
+async function captureWithEngine(req, res, options, prepared) {
+  if (options.engine === "http") return captureHttp(req, res, options);
+  const canUseHttp = httpCompatible(options);
+  const auto = options.engine === "auto" && !prepared.pixels;
+  let skipped = null;
+  if (auto && canUseHttp) {
+    let result = null;
+    try {
+      result = await captureHttp(req, res, options);
+    } catch (err) {
+      if (err instanceof ScrapeError && err.code === "blocked_by_policy") throw err;
+      skipped = { from: "http", code: classifyError(err, "navigating"), reason: err.message };
+    }
+    if (result) {
+      const { status, document } = result.data;
+      if (status < 400 && (document || looksStatic(result.html))) return result;
+      skipped = {
+        from: "http",
+        code: null,
+        reason: status >= 400 ? `HTTP ${status}` : "initial HTML has too little content without JavaScript"
+      };
+    }
+  }
+
+  try {
+    const result = await capturePage(req, res, options, prepared);
+    result.data.engine = "browser";
+    result.data.engine_fallback = skipped || undefined;
+    return result;
+  } catch (err) {
+    const code = classifyError(err, res.locals.job?.stage);
+    const fallback = options.engine_fallback || auto;
+    if (!fallback || !canUseHttp || !FALLBACK_CODES.has(code)) throw err;
+    const result = await captureHttp(req, res, options);
+    result.data.engine_fallback = { from: "browser", code, reason: err.message };
+    return result;
+  }
+}
+
+// Capture the page once per locales entry. This request's slot always works
+// through the list; extra free pool slots join in for as long as entries remain.
+async function captureLocales(req, res, options, prepared) {
+  const entries = options.locales.map(localeEntry);
+  const results = new Array(entries.length);
+  let next = 0;
+  const worker = async () => {
+    while (next < entries.length) {
+      const i = next++;
+      const { locale, timezone } = entries[i];
+      try {
+        const { data } = await capturePage(req, res, { ...options, locale, timezone, locales: [] }, prepared);
+        results[i] = { locale, timezone, ok: true, ...data };
+      } catch (err) {
+        const { ok, ...failure } = errorBody(classifyError(err, res.locals.job?.stage), err.message);
+        results[i] = { locale, timezone, ok: false, ...failure };
+      }
+    }
+  };
+
+  const stopRecruiting = new AbortController();
+  const helpers = entries.slice(1).map(() => acquireSlot(stopRecruiting.signal, options.priority).then(
+    () => worker().finally(releaseSlot),
+    () => {}
+  ));
+  await worker();
+  // everything is claimed: withdraw helpers still queued, wait for running ones
+  stopRecruiting.abort();
+  await Promise.all(helpers);
+
+  traceStage(res, "upload", { "scraper.output": "json", "scraper.locales": entries.length });
+  await sendJson(res, { ok: true, data: { url: options.url, locales: results } });
+}
+
+const MAX_DIFF_LINES = 500;
+
+// Lines / links present in one extraction but not the other
+function jsDiff(rendered, baseline) {
+  const lines = data => new Set((data.text || "").split("\n").map(l => l.replace(/\s+/g, " ").trim()).filter(Boolean));
+  const hrefs = data => new Set((data.links || []).map(l => l.href));
+  const only = (a, b) => [...a].filter(v => !b.has(v));
+  const [withJs, withoutJs] = [lines(rendered), lines(baseline)];
+  const [linksWithJs, linksWithoutJs] = [hrefs(rendered), hrefs(baseline)];
+  const jsOnly = only(withJs, withoutJs);
+  const staticOnly = only(withoutJs, withJs);
+  return {
+    text_only_with_js: jsOnly.slice(0, MAX_DIFF_LINES),
+    text_only_without_js: staticOnly.slice(0, MAX_DIFF_LINES),
+    truncated: jsOnly.length > MAX_DIFF_LINES || staticOnly.length > MAX_DIFF_LINES,
+    links_only_with_js: only(linksWithJs, linksWithoutJs),
+    links_only_without_js: only(linksWithoutJs, linksWithJs),
+    word_count: { with_js: rendered.content?.word_count ?? 0, without_js: baseline.content?.word_count ?? 0 }
+  };
+}
+
+// compare_javascript: the server-rendered baseline and the full render, one
+// after the other in this request's slot, plus what differs between them
+async function captureJsComparison(req, res, options, prepared) {
+  const base = { ...options, compare_javascript: false, extract_text: true, extract_links: true };
+  let rendered;
+  let baseline;
+  try {
+    baseline = (await capturePage(req, res, { ...base, javascript_enabled: false }, prepared)).data;
+    rendered = (await capturePage(req, res, base, prepared)).data;
+  } catch (err) {
+    return sendError(res, err.status || 500, classifyError(err, res.locals.job?.stage), err.message);
+  }
+  traceStage(res, "upload", { "scraper.output": "json" });
+  await sendJson(res, {
+    ok: true,
+    data: { ...rendered, without_javascript: baseline, javascript_diff: jsDiff(rendered, baseline) }
+  });
+}
+
+// Shared by the capture endpoints; dispatch hands requests this instance cannot serve to a peer
+// (after the job is recorded and the tenant admitted), the circuit breaker refuses dead hosts
+// before they take a slot
+const captureChain = [
+  traceRequest, auditLog, authenticate, deadline, idempotency, trackJob, admitCapture, resolvePreset, dispatch,
+  circuitBreaker, withSlot
+];
+
+app.post("/scrape", ...captureChain, async (req, res) => {
+  let options;
+  let prepared;
+  try {
+    options = scrapeOptions(req.options);
+    prepared = prepareScrape(options);
+  } catch (err) {
+    return err instanceof ScrapeError
+      ? sendError(res, err.status, err.code, err.message)
+      : sendError(res, 400, "invalid_request", err.message);
+  }
+  // no step may outlast the caller's deadline
+  options.timeout_ms = remainingMs(res, options.timeout_ms);
+  const { url, image_format, output } = options;
+  if (options.locales.length) return captureLocales(req, res, options, prepared);
+  if (options.compare_javascript) return captureJsComparison(req, res, options, prepared);
+
+  let result;
+  try {
+    result = await captureWithEngine(req, res, options, prepared);
+  } catch (err) {
+    if (res.locals.abort?.aborted) return sendAborted(res);
+    return sendError(res, err.status || 500, classifyError(err, res.locals.job?.stage), err.message);
+  }
+  const { encoded, tiles, html, capturedAt, consoleLog, networkLog, exchanges, debugInfo } = result;
+  if (res.locals.job) res.locals.job.final_url = result.data.final_url;
+  const host = (() => { try { return new URL(result.data.final_url).hostname; } catch (_) { return "capture"; } })();
+  const data = options.fields ? projectFields(result.data, options.fields) : result.data;
+
+  // Pollers asking "has this page changed?" skip the body when it has not
+  if (output === "json" || output === "text-snapshot") {
+    const etag = contentTag(output === "json" ? data : { text_snapshot: data.text_snapshot });
+    res.set("ETag", etag);
+    if (etagMatches(req.get("if-none-match"), etag)) return res.status(304).end();
+  }
+
+  traceStage(res, "upload", { "scraper.output": output });
+  if (output === "text-snapshot") {
+    if (data.text_snapshot == null) {
+      return sendError(res, 422, "invalid_request", `${data.final_url} is not an HTML page; use output: "json"`);
+    }
+    res.set("Content-Type", "text/plain; charset=utf-8");
+    res.set("Content-Location", data.final_url);
+    if (options.store) {
+      return sendStored(req, res, data, "txt", Buffer.from(data.text_snapshot), "text/plain; charset=utf-8");
+    }
+    return res.send(data.text_snapshot);
+  }
+
+  if (output === "warc") {
+    const filename = `${host}-${Date.now()}.warc.gz`;
+    const warc = createWarc(exchanges, { software: SOFTWARE, filename, date: capturedAt });
+    if (options.store) return sendStored(req, res, data, "warc.gz", warc, "application/warc");
+    res.set("Content-Type", "application/warc");
+    res.set("Content-Disposition", `attachment; filename="${filename}"`);
+    return res.send(warc);
+  }
+
+  if (output === "bundle") {
+    const ext = EXTENSIONS[image_format];
+    const {
+      screenshot_base64, segments: segs, debug, animation, document, pages, captures, popups, outputs, ...metadata
+    } = data;
+    let entries = [];
+    if (segs) {
+      entries = segs.map(seg => ({
+        name: `segments/segment-${String(seg.index).padStart(3, "0")}.${ext}`,
+        data: seg.screenshot_base64.buffer
+      }));
+    } else if (encoded) {
+      entries = [{ name: `screenshot.${ext}`, data: encoded.buffer }];
+    }
+    if (document) {
+      const { data_base64, json, text, ...documentMeta } = document;
+      metadata.document = documentMeta;
+      entries.push({ name: `document.${documentExtension(document.content_type)}`, data: data_base64.buffer });
+      (pages || []).forEach(p => entries.push({
+        name: `pages/page-${String(p.index + 1).padStart(3, "0")}.${ext}`,
+        data: p.screenshot_base64.buffer
+      }));
+    }
+    // Chrome's native full-page capture needs no tiles, so tiles/ stays empty then
+    tiles.forEach((tile, i) => entries.push({ name: `tiles/tile-${String(i).padStart(3, "0")}.png`, data: tile }));
+    metadata.capture_method = tiles.length ? "tiles" : encoded || segs ? "full_page" : "none";
+    if (captures) {
+      metadata.captures = {};
+      for (const [name, { screenshot_base64: shot, ...meta }] of Object.entries(captures)) {
+        metadata.captures[name] = meta;
+        if (shot) entries.push({ name: `captures/${name}.${EXTENSIONS[meta.content_type.split("/")[1]]}`, data: shot.buffer });
+      }
+    }
+    if (outputs) {
+      metadata.outputs = {};
+      for (const [format, { screenshot_base64: shot, data_base64: pdf, ...meta }] of Object.entries(outputs)) {
+        metadata.outputs[format] = meta;
+        if (shot || pdf) entries.push({ name: `outputs/screenshot.${EXTENSIONS[format] || format}`, data: (shot || pdf).buffer });
+      }
+    }
+    if (popups) {
+      metadata.popups = popups.map(({ screenshot_base64: shot, ...meta }, i) => {
+        if (shot) entries.push({ name: `popups/popup-${String(i + 1).padStart(3, "0")}.${ext}`, data: shot.buffer });
+        return meta;
       });
+    }
+    if (animation) entries.push({ name: `animation.${options.record_animation.format || "gif"}`, data: animation.data_base64.buffer });
+    if (html != null) entries.push({ name: "page.html", data: html });
+    entries.push(
+      { name: "metadata.json", data: JSON.stringify({ url, captured_at: capturedAt, software: SOFTWARE, ...metadata }, null, 2) },
+      { name: "console.json", data: JSON.stringify(consoleLog, null, 2) },
+      { name: "network.json", data: JSON.stringify(networkLog, null, 2) }
+    );
+    if (debugInfo) {
+      // tiles themselves are already under tiles/
+      const debugJson = { ...debugInfo, tiles: debugInfo.tiles.map(({ screenshot_base64, ...t }) => t) };
+      entries.push({ name: "debug.json", data: JSON.stringify(debugJson, null, 2) });
+    }
+    const zip = createZip(entries);
+    if (options.store) return sendStored(req, res, data, "zip", zip, "application/zip");
+    res.set("Content-Type", "application/zip");
+    res.set("Content-Disposition", `attachment; filename="${host}-${Date.now()}.zip"`);
+    return res.send(zip);
+  }
 
-      let yOffset = 0;
-      for (let i = 0; i < normalized.length; i++) {
-        const { buf, height } = normalized[i];
-        const topY = i === 0 ? yOffset : yOffset - overlap_px;
-        stitched = stitched.composite([{ input: buf, top: topY, left: 0 }]);
-        yOffset = topY + height;
+  if (options.store) {
+    // The screenshot (or the raw document) is stored; the JSON keeps everything else
+    try {
+      if (encoded) {
+        const type = CONTENT_TYPES[image_format];
+        data.result = await storeResult(req, res, result.data, EXTENSIONS[image_format], encoded.buffer, type);
+        delete data.screenshot_base64;
+      } else if (data.document?.data_base64) {
+        const { content_type } = data.document;
+        data.result = await storeResult(req, res, result.data, documentExtension(content_type),
+          data.document.data_base64.buffer, content_type);
+        delete data.document.data_base64;
+      } else {
+        const json = Buffer.from(JSON.stringify(data));
+        data.result = await storeResult(req, res, result.data, "json", json, "application/json");
       }
+    } catch (err) {
+      return sendError(res, 502, "storage_failed", `storing the result failed: ${err.message}`);
+    }
+  }
+  await sendJson(res, { ok: true, data });
+});
+
+// store: true — put one artifact of this job into result storage under
+// results.path_template and describe where it went (plus a signed URL when
+// the backend can sign, and the file path for local storage)
+async function storeResult(req, res, data, ext, body, contentType) {
+  const storage = await resultStorage();
+  let host = "unknown";
+  try {
+    host = new URL(data.final_url || req.body.url).hostname;
+  } catch (_) {}
+  const key = resultKey({ tenant: req.tenant.id, id: res.locals.job.id, ext, host, body });
+  const { bytes, path } = await storage.put(key, body, contentType);
+  res.locals.job.result_location = `${storage.name}:${key}`;
+  const url = await storage.signUrl(key);
+  res.locals.job.result_url = url || null;
+  const share = sharingEnabled() ? shareUrl(req, key) : undefined;
+  return {
+    backend: storage.name, key, bytes, content_type: contentType, url: url || undefined, path,
+    share_url: share?.url, share_expires_at: share?.expires_at
+  };
+}
 
-      finalBuffer = await stitched
-        .toFormat(image_format, image_format === "jpeg" ? { quality: jpeg_quality } : {})
-        .toBuffer();
+// Store a whole response body (bundle, WARC, text) and answer with where it went
+async function sendStored(req, res, data, ext, body, contentType) {
+  let result;
+  try {
+    result = await storeResult(req, res, data, ext, body, contentType);
+  } catch (err) {
+    return sendError(res, 502, "storage_failed", `storing the result failed: ${err.message}`);
+  }
+  res.json({ ok: true, data: { final_url: data.final_url, result } });
+}
+
+// Options that add a pass (and time) on top of navigate + capture + encode
+const EXTRA_PASSES = ["ocr", "evidence", "annotate", "layout_selectors", "extract", "extract_tables", "extract_links",
+  "extract_article", "extract_product", "extract_text", "capture_icons", "computed_styles", "font_report", "accessibility_tree",
+  "security_events", "record_animation"];
+
+// Dry run of /scrape: resolve defaults, validate, and estimate the cost
+// without launching Chrome or counting against quotas
+app.post("/scrape/validate", traceRequest, auditLog, authenticate, (req, res) => {
+  let options;
+  let prepared;
+  try {
+    options = scrapeOptions(withPreset(req.body));
+    prepared = prepareScrape(options);
+  } catch (err) {
+    return err instanceof ScrapeError
+      ? sendError(res, err.status, err.code, err.message)
+      : sendError(res, 400, "invalid_request", err.message);
+  }
+  const warm = options.use_browser_cache && !options.clear_state && prepared.browserArgs.length === 0 &&
+    settings.max_warm_contexts > 0;
+  const passes = EXTRA_PASSES.filter(name => {
+    const value = options[name];
+    return Array.isArray(value) ? value.length > 0 : !!value;
+  });
+  res.json({
+    ok: true,
+    data: {
+      effective_options: redactOptions(options),
+      estimate: {
+        browser: options.engine === "http" ? "none" : warm ? "warm_context" : "dedicated", // "auto" may need none
+        captures: options.locales.length || 1,
+        // billed pixels are the full stitched page; one viewport is the floor
+        min_pixels: options.engine === "http" || !prepared.pixels ? 0 : options.viewport_width * options.viewport_height,
+        extra_passes: passes,
+        max_duration_ms: options.timeout_ms * (options.ocr ? 3 : 1) + settings.queue_timeout_ms,
+        queue: queueStats(),
+        usage: usageReport(req.tenant)
+      }
     }
+  });
+});
 
-    const b64 = finalBuffer.toString("base64");
+const PREVIEW_WIDTH = 1200;
+const PREVIEW_HEIGHT = 630;
 
-    const title = await page.title();
+// Link-preview card: a fixed 1200x630 above-the-fold capture plus OG metadata
+app.post("/preview", ...captureChain, async (req, res) => {
+  const {
+    url,
+    timeout_ms = settings.default_timeout_ms,
+    settle_delay_ms = 500,
+    image_format = "jpeg",
+    jpeg_quality = 85,
+    include_favicon = true,
+  } = req.body;
+
+  if (!url) return sendError(res, 400, "invalid_request", "url is required");
+  try {
+    if (isBlockedTarget(new URL(url).hostname)) {
+      return sendError(res, 403, "blocked_by_policy", "captures of this host are blocked");
+    }
+  } catch (_) {
+    return sendError(res, 400, "invalid_request", "url must be an absolute URL");
+  }
+  if (!["jpeg", "png", "webp"].includes(image_format)) {
+    return sendError(res, 400, "invalid_request", `unsupported image_format: ${image_format}`);
+  }
+  try {
+    for (const field of ["timeout_ms", "settle_delay_ms", "jpeg_quality"]) {
+      checkRange({ timeout_ms, settle_delay_ms, jpeg_quality }, field);
+    }
+  } catch (err) {
+    return sendError(res, err.status, err.code, err.message);
+  }
+
+  let browser;
+  const abortPreview = () => browser?.close().catch(() => {});
+  res.locals.abort?.addEventListener("abort", abortPreview, { once: true });
+  try {
+    browser = await launchBrowser();
+    const context = await browser.newContext({
+      viewport: { width: PREVIEW_WIDTH, height: PREVIEW_HEIGHT },
+      deviceScaleFactor: 1
+    });
+    await blockNoise(context);
+    const page = await context.newPage();
+    page.setDefaultTimeout(timeout_ms);
+
+    await page.goto(url, { timeout: timeout_ms, waitUntil: "domcontentloaded" });
+    await page.waitForLoadState("load", { timeout: Math.min(timeout_ms, 10000) }).catch(() => {});
+    await page.addStyleTag({ content: "* { animation: none !important; transition: none !important; }" });
+    await page.waitForTimeout(settle_delay_ms);
+
+    const shot = await page.screenshot({ type: "png" });
+    // Pages narrower/shorter than the viewport still come back as an exact card
+    const card = await sharp(shot)
+      .resize(PREVIEW_WIDTH, PREVIEW_HEIGHT, { fit: "cover", position: "top" })
+      .toFormat(image_format, encodeOptions({ format: image_format }, image_format === "png" ? undefined : jpeg_quality))
+      .toBuffer();
+
+    chargePixels(req.tenant, PREVIEW_WIDTH * PREVIEW_HEIGHT);
+    const og = await extractOpenGraph(page);
+    const icons = include_favicon ? await fetchIcons(page, Math.min(timeout_ms, 10000)) : null;
 
     res.json({
       ok: true,
       data: {
-        screenshot_base64: b64,
-        content_type: image_format === "jpeg" ? "image/jpeg" : "image/png",
-        title,
+        screenshot_base64: card.toString("base64"),
+        content_type: CONTENT_TYPES[image_format],
+        width: PREVIEW_WIDTH,
+        height: PREVIEW_HEIGHT,
         final_url: page.url(),
-        viewport: { width: viewport_width, height: viewport_height },
-        overlap_px,
-        settle_delay_ms,
-        total_height_px: totalHeight
+        ...og,
+        favicon: icons ? icons.favicon : undefined
       }
     });
   } catch (err) {
-    res.status(500).json({ ok: false, error: err.message });
+    if (res.locals.abort?.aborted) return sendAborted(res);
+    sendError(res, 500, classifyError(err), err.message);
   } finally {
-    await browser.close();
+    res.locals.abort?.removeEventListener("abort", abortPreview);
+    await browser?.close();
+  }
+});
+
+app.use("/admin", adminRouter({
+  status: () => ({
+    shared_browser: !!sharedBrowser,
+    warm_contexts: [...warmContexts.entries()].map(([key, e]) => ({ key, active: e.active, last_used: e.used }))
+  }),
+  // A preset must make a valid request once a URL is added
+  validatePreset: options => prepareScrape(scrapeOptions({ ...options, url: "https://example.com/" }))
+}));
+
+app.get("/presets", authenticate, (req, res) => {
+  res.json({ ok: true, data: { presets: listPresets() } });
+});
+
+// Types share links are served as; anything else is application/octet-stream
+const SHARE_TYPES = {
+  jpg: "image/jpeg", png: "image/png", webp: "image/webp", avif: "image/avif", gif: "image/gif",
+  json: "application/json", pdf: "application/pdf", zip: "application/zip", "warc.gz": "application/warc",
+  txt: "text/plain; charset=utf-8"
+};
+
+// A fresh share link for a job's stored result; body: { ttl_s }
+app.post("/jobs/:id/share", authenticate, async (req, res) => {
+  if (!sharingEnabled()) return sendError(res, 404, "not_found", "share links are not enabled (results.share_secret)");
+  const job = await getJob(req.params.id);
+  if (!job || (tenantsEnabled() && job.tenant !== req.tenant.id)) {
+    return sendError(res, 404, "not_found", "job not found");
+  }
+  const [backend, key] = String(job.result_location || "").split(/:(.*)/s);
+  if (!key || backend !== config.results.backend) return sendError(res, 409, "invalid_request", "job has no stored result");
+  const ttlS = req.body?.ttl_s ?? config.results.share_ttl_s;
+  if (!Number.isInteger(ttlS) || ttlS < 1 || ttlS > config.results.share_max_ttl_s) {
+    return sendError(res, 400, "invalid_request", `ttl_s must be 1-${config.results.share_max_ttl_s}`);
+  }
+  res.json({ ok: true, data: { key, ...shareUrl(req, key, ttlS) } });
+});
+
+// Share link downloads: no API key, the signature is the authorization
+app.get("/results/*", async (req, res) => {
+  const key = req.params[0];
+  if (!verifyShare(key, req.query.expires, req.query.sig)) {
+    return sendError(res, 403, "unauthorized", "invalid or expired share link");
+  }
+  let body;
+  try {
+    body = await (await resultStorage()).get(key);
+  } catch (err) {
+    return sendError(res, 502, "storage_failed", `reading the result failed: ${err.message}`);
+  }
+  if (!body) return sendError(res, 404, "not_found", "result no longer exists");
+  const expires = Number(req.query.expires);
+  res.set("Cache-Control", `private, max-age=${Math.max(0, expires - Math.floor(Date.now() / 1000))}`);
+  // Stored documents are whatever the target served (SVG, HTML, XML); this
+  // origin also hosts /ui, so nothing here may ever run as a page
+  const ext = key.endsWith(".warc.gz") ? "warc.gz" : key.split(".").pop().toLowerCase();
+  res.set("X-Content-Type-Options", "nosniff");
+  res.set("Content-Security-Policy", "sandbox; default-src 'none'");
+  res.attachment(key.split("/").pop());
+  res.type(SHARE_TYPES[ext] || "application/octet-stream").send(body);
+});
+
+// Profile names only; the fingerprints themselves are admin-managed
+app.get("/profiles", authenticate, (req, res) => {
+  res.json({ ok: true, data: { profiles: listProfiles().map(p => p.name) } });
+});
+
+// Job history; tenants only ever see their own jobs
+app.get("/jobs", authenticate, async (req, res) => {
+  const { status, url, since, tenant } = req.query;
+  const jobs = await listJobs({
+    tenant: tenantsEnabled() ? req.tenant.id : tenant,
+    status,
+    url,
+    since,
+    limit: Math.min(500, Math.max(1, parseInt(req.query.limit, 10) || 50)),
+    offset: Math.max(0, parseInt(req.query.offset, 10) || 0)
+  });
+  res.json({ ok: true, data: { jobs } });
+});
+
+app.get("/jobs/:id", authenticate, async (req, res) => {
+  const job = await getJob(req.params.id);
+  if (!job || (tenantsEnabled() && job.tenant !== req.tenant.id)) {
+    return sendError(res, 404, "not_found", "job not found");
+  }
+  res.json({ ok: true, data: job });
+});
+
+// Cancel a capture still queued or running in this process; the capture
+// itself answers 409 canceled and the job is recorded as canceled
+app.delete("/jobs/:id", authenticate, async (req, res) => {
+  const running = runningJobs.get(req.params.id);
+  if (running && !(tenantsEnabled() && running.tenant !== req.tenant.id)) {
+    if (!cancelJob(running.id)) return sendError(res, 409, "invalid_request", "this job cannot be canceled");
+    return res.json({ ok: true, data: { id: running.id, status: "canceled" } });
+  }
+  const job = await getJob(req.params.id);
+  if (!job || (tenantsEnabled() && job.tenant !== req.tenant.id)) {
+    return sendError(res, 404, "not_found", "job not found");
+  }
+  sendError(res, 409, "invalid_request", `job already ${job.status}`);
+});
+
+// Operator dashboard; the page itself is static and calls the /admin API with the admin token
+app.get("/ui", (req, res) => {
+  res.set("Content-Type", "text/html; charset=utf-8").send(dashboardHtml);
+});
+
+app.get("/usage", authenticate, (req, res) => {
+  const month = /^\d{4}-\d{2}$/.test(req.query.month || "") ? req.query.month : undefined;
+  res.json({ ok: true, data: usageReport(req.tenant, month) });
+});
+
+// Certificates and client-auth settings for the API's own HTTPS listener
+function tlsOptions() {
+  const { tls_cert_file, tls_key_file, tls_client_ca_file, tls_client_auth } = config.server;
+  if (!["none", "optional", "require"].includes(tls_client_auth)) {
+    throw new Error(`server.tls_client_auth must be "none", "optional" or "require"`);
+  }
+  if (tls_client_auth !== "none" && !tls_client_ca_file) {
+    throw new Error("server.tls_client_auth needs server.tls_client_ca_file");
+  }
+  return {
+    cert: readFileSync(tls_cert_file),
+    key: readFileSync(tls_key_file),
+    ca: tls_client_ca_file ? readFileSync(tls_client_ca_file) : undefined,
+    requestCert: tls_client_auth !== "none",
+    rejectUnauthorized: tls_client_auth === "require",
+    minVersion: "TLSv1.2"
+  };
+}
+
+process.on("SIGHUP", () => {
+  try {
+    const changed = reloadConfig();
+    console.log(`SIGHUP: config reloaded (${changed.join(", ") || "no changes"})`);
+  } catch (err) {
+    console.error(`SIGHUP: config reload failed: ${err.message}`);
+  }
+  // Pick up renewed certificates from the same paths without dropping connections
+  if (server instanceof https.Server) {
+    try {
+      server.setSecureContext(tlsOptions());
+      console.log("SIGHUP: TLS certificates reloaded");
+    } catch (err) {
+      console.error(`SIGHUP: TLS reload failed: ${err.message}`);
+    }
   }
 });
 
-const port = process.env.PORT || 8090;
-app.listen(port, () => {
-  console.log(`Listening on :${port}`);
+// Longest a SIGTERM waits for in-flight captures and shutdown hooks
+const SHUTDOWN_TIMEOUT_MS = 30000;
+let shuttingDown = false;
+
+// The one way out: stop taking requests, let in-flight ones finish, run the
+// modules' shutdown hooks, exit. A second signal or the timeout forces it.
+async function shutdown(signal) {
+  if (shuttingDown) process.exit(1);
+  shuttingDown = true;
+  console.log(`${signal}: shutting down`);
+  setTimeout(() => {
+    console.error("shutdown: timed out, exiting");
+    process.exit(1);
+  }, SHUTDOWN_TIMEOUT_MS).unref();
+  await new Promise(resolve => {
+    server.close(resolve);
+    server.closeIdleConnections();
+  });
+  await runShutdownHooks();
+  process.exit(0);
+}
+process.on("SIGTERM", () => shutdown("SIGTERM"));
+process.on("SIGINT", () => shutdown("SIGINT"));
+
+const { port, host, tls_cert_file, tls_key_file } = config.server;
+const server = tls_cert_file && tls_key_file ? https.createServer(tlsOptions(), app) : http.createServer(app);
+server.listen(port, host, () => {
+  console.log(`Listening on ${tls_cert_file && tls_key_file ? "https" : "http"}://${host}:${port}`);
 });
+if (storageEnabled()) {
+  // With tenants on, a key whose template has no {tenant} could be anyone's;
+  // leave it out rather than prune it under some other tenant's policy
+  registerResultStore({
+    name: config.results.backend,
+    list: async () => (await (await resultStorage()).list())
+      .map(item => ({ ...item, tenant: tenantOfKey(item.key) ?? (tenantsEnabled() ? null : "default") }))
+      .filter(item => item.tenant != null),
+    remove: async key => (await resultStorage()).remove(key)
+  });
+}
+startJanitor();
+startResultSink().catch(err => console.error(`kafka: ${err.message}`));
+startWorker(app).catch(err => console.error(`worker: ${err.message}`));
@@ -0,0 +1,338 @@
+// Job history: one record per capture request (request, timings, result
+// location, error) kept in SQLite (jobs.driver = "sqlite", needs the
+// better-sqlite3 package) or Postgres (jobs.driver = "postgres", needs pg).
+// With no driver configured records live in memory and are lost on restart.
+
+import { randomUUID } from "node:crypto";
+import { config } from "./config.js";
+import { redactOptions } from "./audit.js";
+import { ScrapeError } from "./errors.js";
+
+const MEMORY_LIMIT = 1000;
+
+const COLUMNS = ["id", "tenant", "endpoint", "url", "status", "http_status", "request", "result_location",
+  "error", "created_at", "started_at", "finished_at", "duration_ms"];
+
+function memoryStore() {
+  const rows = new Map();
+  return {
+    async insert(job) {
+      rows.set(job.id, job);
+      if (rows.size > MEMORY_LIMIT) rows.delete(rows.keys().next().value);
+    },
+    async update(id, patch) {
+      const row = rows.get(id);
+      if (row) Object.assign(row, patch);
+    },
+    async get(id) {
+      return rows.get(id) || null;
+    },
+    async list({ tenant, status, url, since, limit, offset }) {
+      return [...rows.values()]
+        .filter(j => (!tenant || j.tenant === tenant) && (!status || j.status === status) &&
+          (!url || (j.url || "").includes(url)) && (!since || j.created_at >= since))
+        .reverse()
+        .slice(offset, offset + limit);
+    },
+    async tenants() {
+      return [...new Set([...rows.values()].map(j => j.tenant))];
+    },
+    async prune({ tenant, before, keep }) {
+      const finished = [...rows.values()].filter(j => j.tenant === tenant && j.status !== "running").reverse();
+      let removed = 0;
+      finished.forEach((j, i) => {
+        if ((before && j.created_at < before) || (keep && i >= keep)) {
+          rows.delete(j.id);
+          removed++;
+        }
+      });
+      return removed;
+    }
+  };
+}
+
+function decode(row) {
+  if (!row) return null;
+  return { ...row, request: typeof row.request === "string" ? JSON.parse(row.request) : row.request };
+}
+
+async function sqliteStore(path) {
+  const { default: Database } = await import("better-sqlite3").catch(() => {
+    throw new Error("jobs.driver = \"sqlite\" requires the better-sqlite3 package");
+  });
+  const db = new Database(path);
+  db.pragma("journal_mode = WAL");
+  db.exec(`CREATE TABLE IF NOT EXISTS jobs (
+    id TEXT PRIMARY KEY, tenant TEXT, endpoint TEXT, url TEXT, status TEXT, http_status INTEGER,
+    request TEXT, result_location TEXT, error TEXT, created_at TEXT, started_at TEXT,
+    finished_at TEXT, duration_ms INTEGER)`);
+  db.exec("CREATE INDEX IF NOT EXISTS jobs_tenant_created ON jobs (tenant, created_at)");
+  const insert = db.prepare(`INSERT INTO jobs (${COLUMNS.join(", ")}) VALUES (${COLUMNS.map(c => "@" + c).join(", ")})`);
+  return {
+    async insert(job) {
+      insert.run({ ...Object.fromEntries(COLUMNS.map(c => [c, null])), ...job, request: JSON.stringify(job.request) });
+    },
+    async update(id, patch) {
+      const keys = Object.keys(patch).filter(k => COLUMNS.includes(k));
+      db.prepare(`UPDATE jobs SET ${keys.map(k => `${k} = @${k}`).join(", ")} WHERE id = @id`).run({ ...patch, id });
+    },
+    async get(id) {
+      return decode(db.prepare("SELECT * FROM jobs WHERE id = ?").get(id));
+    },
+    async list({ tenant, status, url, since, limit, offset }) {
+      const where = [];
+      const args = {};
+      if (tenant) { where.push("tenant = @tenant"); args.tenant = tenant; }
+      if (status) { where.push("status = @status"); args.status = status; }
+      if (url) { where.push("instr(url, @url) > 0"); args.url = url; }
+      if (since) { where.push("created_at >= @since"); args.since = since; }
+      const sql = `SELECT * FROM jobs ${where.length ? "WHERE " + where.join(" AND ") : ""}
+        ORDER BY created_at DESC LIMIT @limit OFFSET @offset`;
+      return db.prepare(sql).all({ ...args, limit, offset }).map(decode);
+    },
+    async tenants() {
+      return db.prepare("SELECT DISTINCT tenant FROM jobs").all().map(r => r.tenant);
+    },
+    async prune({ tenant, before, keep }) {
+      let removed = 0;
+      if (before) {
+        removed += db.prepare("DELETE FROM jobs WHERE tenant IS @tenant AND status != 'running' AND created_at < @before")
+          .run({ tenant, before }).changes;
+      }
+      if (keep) {
+        removed += db.prepare(`DELETE FROM jobs WHERE id IN (SELECT id FROM jobs
+          WHERE tenant IS @tenant AND status != 'running' ORDER BY created_at DESC LIMIT -1 OFFSET @keep)`)
+          .run({ tenant, keep }).changes;
+      }
+      return removed;
+    }
+  };
+}
+
+async function postgresStore(url) {
+  const { default: pg } = await import("pg").catch(() => {
+    throw new Error("jobs.driver = \"postgres\" requires the pg package");
+  });
+  const pool = new pg.Pool({ connectionString: url });
+  await pool.query(`CREATE TABLE IF NOT EXISTS jobs (
+    id TEXT PRIMARY KEY, tenant TEXT, endpoint TEXT, url TEXT, status TEXT, http_status INTEGER,
+    request JSONB, result_location TEXT, error TEXT, created_at TIMESTAMPTZ, started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ, duration_ms INTEGER)`);
+  await pool.query("CREATE INDEX IF NOT EXISTS jobs_tenant_created ON jobs (tenant, created_at)");
+  const toRow = r => r && {
+    ...r,
+    created_at: r.created_at?.toISOString?.() ?? r.created_at,
+    started_at: r.started_at?.toISOString?.() ?? r.started_at,
+    finished_at: r.finished_at?.toISOString?.() ?? r.finished_at
+  };
+  return {
+    async insert(job) {
+      await pool.query(
+        `INSERT INTO jobs (${COLUMNS.join(", ")}) VALUES (${COLUMNS.map((_, i) => "$" + (i + 1)).join(", ")})`,
+        COLUMNS.map(c => (c === "request" ? JSON.stringify(job.request) : job[c] ?? null))
+      );
+    },
+    async update(id, patch) {
+      const keys = Object.keys(patch).filter(k => COLUMNS.includes(k));
+      await pool.query(
+        `UPDATE jobs SET ${keys.map((k, i) => `${k} = $${i + 2}`).join(", ")} WHERE id = $1`,
+        [id, ...keys.map(k => patch[k])]
+      );
+    },
+    async get(id) {
+      const { rows } = await pool.query("SELECT * FROM jobs WHERE id = $1", [id]);
+      return toRow(rows[0]) || null;
+    },
+    async list({ tenant, status, url, since, limit, offset }) {
+      const where = [];
+      const args = [];
+      if (tenant) { args.push(tenant); where.push(`tenant = $${args.length}`); }
+      if (status) { args.push(status); where.push(`status = $${args.length}`); }
+      if (url) { args.push(url); where.push(`strpos(url, $${args.length}) > 0`); }
+      if (since) { args.push(since); where.push(`created_at >= $${args.length}`); }
+      args.push(limit, offset);
+      const { rows } = await pool.query(
+        `SELECT * FROM jobs ${where.length ? "WHERE " + where.join(" AND ") : ""}
+         ORDER BY created_at DESC LIMIT $${args.length - 1} OFFSET $${args.length}`,
+        args
+      );
+      return rows.map(toRow);
+    },
+    async tenants() {
+      const { rows } = await pool.query("SELECT DISTINCT tenant FROM jobs");
+      return rows.map(r => r.tenant);
+    },
+    async prune({ tenant, before, keep }) {
+      let removed = 0;
+      if (before) {
+        const { rowCount } = await pool.query(
+          "DELETE FROM jobs WHERE tenant IS NOT DISTINCT FROM $1 AND status <> 'running' AND created_at < $2",
+          [tenant, before]
+        );
+        removed += rowCount;
+      }
+      if (keep) {
+        const { rowCount } = await pool.query(
+          `DELETE FROM jobs WHERE id IN (SELECT id FROM jobs
+           WHERE tenant IS NOT DISTINCT FROM $1 AND status <> 'running' ORDER BY created_at DESC OFFSET $2)`,
+          [tenant, keep]
+        );
+        removed += rowCount;
+      }
+      return removed;
+    }
+  };
+}
+
+let storePromise = null;
+function store() {
+  if (!storePromise) {
+    const { driver, sqlite_path, postgres_url } = config.jobs;
+    if (driver === "sqlite") storePromise = sqliteStore(sqlite_path);
+    else if (driver === "postgres") storePromise = postgresStore(postgres_url);
+    else storePromise = Promise.resolve(memoryStore());
+  }
+  return storePromise;
+}
+
+// A store failure must never fail the capture itself
+async function safely(op) {
+  try {
+    return await op(await store());
+  } catch (err) {
+    console.error(`jobs: ${err.message}`);
+    return null;
+  }
+}
+
+// Live view of jobs in this process, for status/progress reporting
+export const runningJobs = new Map();
+// job id -> cancel(), for requests that can be aborted (deadline.js)
+const cancelers = new Map();
+const finishListeners = [];
+
+// fn(job) runs once per job after its final status is known
+export function onJobFinished(fn) {
+  finishListeners.push(fn);
+}
+
+// Small JPEG previews of the most recent captures, for the dashboard
+const THUMBNAIL_LIMIT = 50;
+const thumbnails = new Map();
+
+export function setThumbnail(jobId, buffer) {
+  thumbnails.set(jobId, buffer);
+  if (thumbnails.size > THUMBNAIL_LIMIT) thumbnails.delete(thumbnails.keys().next().value);
+}
+
+export function getThumbnail(jobId) {
+  return thumbnails.get(jobId) || null;
+}
+
+// Record which pipeline stage a running job has reached
+export function setStage(res, stage) {
+  const job = res.locals.job;
+  if (job) {
+    job.stage = stage;
+    job.stage_at = new Date().toISOString();
+  }
+}
+
+// Express middleware: record the job, expose its id as X-Job-Id and
+// res.locals.job, and close it out when the response ends
+export function trackJob(req, res, next) {
+  const { url = null, ...options } = req.body || {};
+  const job = {
+    id: randomUUID(),
+    tenant: req.tenant ? req.tenant.id : null,
+    endpoint: `${req.method} ${req.path}`,
+    url,
+    status: "running",
+    request: redactOptions(options),
+    created_at: new Date().toISOString(),
+    started_at: new Date().toISOString(),
+    result_location: null
+  };
+  res.locals.job = job;
+  res.set("X-Job-Id", job.id);
+  runningJobs.set(job.id, job);
+  if (res.locals.cancel) {
+    cancelers.set(job.id, () => res.locals.cancel(new ScrapeError("canceled", "job canceled", 409)));
+  }
+  // the pool may run the final update on another connection; it must not overtake the insert
+  const inserted = safely(s => s.insert(job));
+
+  // Remember the error message of a failed JSON envelope
+  const json = res.json.bind(res);
+  res.json = body => {
+    if (body && body.ok === false) job.error = body.error;
+    return json(body);
+  };
+
+  let done = false;
+  const finish = () => {
+    if (done) return;
+    done = true;
+    runningJobs.delete(job.id);
+    cancelers.delete(job.id);
+    const finished = new Date();
+    const patch = {
+      // only when the cancel is what ended it; a capture that finished first keeps its outcome
+      status: res.locals.error_code === "canceled" ? "canceled"
+        : res.statusCode < 400 && res.writableFinished ? "succeeded" : (res.writableFinished ? "failed" : "aborted"),
+      http_status: res.statusCode,
+      error: job.error || null,
+      result_location: job.result_location || (res.statusCode < 400 ? "inline" : null),
+      finished_at: finished.toISOString(),
+      duration_ms: finished - new Date(job.started_at)
+    };
+    Object.assign(job, patch);
+    inserted.then(() => safely(s => s.update(job.id, patch)));
+    for (const fn of finishListeners) {
+      try {
+        fn(job);
+      } catch (err) {
+        console.error(`jobs: ${err.message}`);
+      }
+    }
+  };
+  res.on("finish", finish);
+  res.on("close", finish);
+  next();
+}
+
+// Abort a job running in this process: it leaves the queue or has its pages
+// closed, answers 409 canceled, and frees its slot. False when not cancelable.
+export function cancelJob(id) {
+  const cancel = cancelers.get(id);
+  if (!cancel) return false;
+  cancel();
+  return true;
+}
+
+// Retention for job history: policyFor(tenant) -> { ttl_days, max_count }.
+// Running jobs are never removed. Returns how many records went.
+export async function pruneJobs(policyFor) {
+  const removed = await safely(async s => {
+    let total = 0;
+    for (const tenant of await s.tenants()) {
+      const { ttl_days, max_count } = policyFor(tenant);
+      if (!ttl_days && !max_count) continue;
+      total += await s.prune({
+        tenant,
+        before: ttl_days ? new Date(Date.now() - ttl_days * 86400000).toISOString() : null,
+        keep: max_count || 0
+      });
+    }
+    return total;
+  });
+  return removed || 0;
+}
+
+export async function listJobs(filter) {
+  return (await safely(s => s.list(filter))) || [];
+}
+
+export async function getJob(id) {
+  return safely(s => s.get(id));
+}
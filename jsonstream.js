@@ -0,0 +1,90 @@
+// Streaming JSON responses. Large binary fields are wrapped in Base64Value and
+// encoded piece by piece while the envelope is written with chunked encoding,
+// so a 50 MB capture never exists as one giant base64 string plus a second
+// copy inside a JSON string. Small responses still go through res.json().
+
+import { config } from "./config.js";
+
+// Multiple of 3 so every piece encodes without padding
+const BASE64_PIECE = 3 * 64 * 1024;
+const WRITE_SIZE = 64 * 1024;
+
+export class Base64Value {
+  // digest: optional stand-in for buffer when hashing content (see contentTag)
+  constructor(buffer, digest = null) {
+    this.buffer = buffer;
+    this.digest = digest;
+  }
+
+  // Plain JSON.stringify / res.json still work, just without the streaming
+  toJSON() {
+    return this.buffer.toString("base64");
+  }
+}
+
+function* pieces(value) {
+  if (value instanceof Base64Value) {
+    yield "\"";
+    for (let i = 0; i < value.buffer.length; i += BASE64_PIECE) {
+      yield value.buffer.subarray(i, i + BASE64_PIECE).toString("base64");
+    }
+    yield "\"";
+  } else if (Array.isArray(value)) {
+    yield "[";
+    for (let i = 0; i < value.length; i++) {
+      if (i) yield ",";
+      const v = value[i];
+      yield* pieces(v === undefined || typeof v === "function" ? null : v);
+    }
+    yield "]";
+  } else if (value && typeof value === "object" && typeof value.toJSON !== "function") {
+    yield "{";
+    let first = true;
+    for (const [k, v] of Object.entries(value)) {
+      if (v === undefined || typeof v === "function" || typeof v === "symbol") continue;
+      yield `${first ? "" : ","}${JSON.stringify(k)}:`;
+      first = false;
+      yield* pieces(v);
+    }
+    yield "}";
+  } else {
+    yield JSON.stringify(value) ?? "null";
+  }
+}
+
+// Binary payload size; only looks near the top so huge DOM trees aren't walked
+function base64Bytes(value, depth = 0) {
+  if (value instanceof Base64Value) return value.buffer.length;
+  if (!value || typeof value !== "object" || Buffer.isBuffer(value) || depth > 3) return 0;
+  let total = 0;
+  for (const v of Object.values(value)) total += base64Bytes(v, depth + 1);
+  return total;
+}
+
+function drained(res) {
+  return new Promise(resolve => {
+    const done = () => {
+      res.off("drain", done);
+      res.off("close", done);
+      resolve();
+    };
+    res.on("drain", done);
+    res.on("close", done);
+  });
+}
+
+// res.json() for small bodies; chunked, backpressure-aware writes once the
+// binary payload passes server.stream_threshold_bytes
+export async function sendJson(res, value) {
+  if (base64Bytes(value) < config.server.stream_threshold_bytes) return res.json(value);
+  res.set("Content-Type", "application/json; charset=utf-8");
+  let pending = "";
+  for (const piece of pieces(value)) {
+    pending += piece;
+    if (pending.length < WRITE_SIZE) continue;
+    if (!res.write(pending)) await drained(res);
+    pending = "";
+    if (res.destroyed) return;
+  }
+  res.end(pending);
+}
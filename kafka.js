@@ -0,0 +1,62 @@
+// Kafka result sink. With kafka.brokers set, every finished capture job is
+// published to kafka.topic as one JSON message keyed by job id, so downstream
+// pipelines can consume captures as a stream instead of polling /jobs. Needs
+// the kafkajs package. Publishing is best effort: a broker outage is logged
+// and never fails the capture.
+
+import { config } from "./config.js";
+import { onJobFinished } from "./jobs.js";
+import { onShutdown } from "./shutdown.js";
+
+// Message body: the job record minus the request options, plus where the
+// result went when it was stored
+function event(job) {
+  return {
+    job_id: job.id,
+    tenant: job.tenant,
+    endpoint: job.endpoint,
+    url: job.url,
+    final_url: job.final_url || null,
+    status: job.status,
+    http_status: job.http_status,
+    error: job.error,
+    result_location: job.result_location,
+    result_url: job.result_url || null,
+    created_at: job.created_at,
+    finished_at: job.finished_at,
+    duration_ms: job.duration_ms
+  };
+}
+
+async function connect() {
+  let Kafka;
+  try {
+    ({ Kafka } = await import("kafkajs"));
+  } catch (_) {
+    throw new Error("kafka.brokers is set but the kafkajs package is not installed");
+  }
+  const { brokers, client_id, ssl, sasl_mechanism, username, password } = config.kafka;
+  const kafka = new Kafka({
+    clientId: client_id,
+    brokers,
+    ssl,
+    sasl: sasl_mechanism ? { mechanism: sasl_mechanism, username, password } : undefined
+  });
+  const producer = kafka.producer({ allowAutoTopicCreation: false });
+  await producer.connect();
+  onShutdown(() => producer.disconnect());
+  return producer;
+}
+
+export async function startResultSink() {
+  if (!config.kafka.brokers.length) return;
+  const producer = await connect();
+  const { topic, only_succeeded } = config.kafka;
+  onJobFinished(job => {
+    if (job.status === "canceled" || job.status === "aborted") return;
+    if (only_succeeded && job.status !== "succeeded") return;
+    producer.send({ topic, messages: [{ key: job.id, value: JSON.stringify(event(job)) }] })
+      .catch(err => console.error(`kafka: publishing job ${job.id} failed: ${err.message}`));
+  });
+  console.log(`kafka: publishing finished jobs to ${topic}`);
+}
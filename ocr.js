@@ -0,0 +1,97 @@
+// Pluggable OCR engines. Each engine takes a PNG buffer and returns word boxes
+// in that image's pixel space; runOcr stitches bands back into page space.
+//
+//   ocr.engine = "tesseract" (default)  shells out to the tesseract CLI (ocr.tesseract_bin)
+//   ocr.engine = "http"                 POSTs the PNG to ocr.endpoint, expects { words: [...] }
+
+import { spawn } from "node:child_process";
+import sharp from "sharp";
+import { config } from "./config.js";
+
+const OCR_BAND_HEIGHT = 4000;
+
+function tesseract(png, lang, timeoutMs) {
+  return new Promise((resolve, reject) => {
+    const bin = config.ocr.tesseract_bin;
+    const proc = spawn(bin, ["stdin", "stdout", "-l", lang, "tsv"], { stdio: ["pipe", "pipe", "pipe"] });
+    const timer = setTimeout(() => proc.kill("SIGKILL"), timeoutMs);
+    const out = [];
+    let stderr = "";
+    proc.stdout.on("data", d => out.push(d));
+    proc.stderr.on("data", d => { stderr += d; });
+    proc.on("error", err => { clearTimeout(timer); reject(err); });
+    proc.on("close", code => {
+      clearTimeout(timer);
+      if (code !== 0) return reject(new Error(`tesseract exited ${code}: ${stderr.trim().slice(0, 200)}`));
+      const words = [];
+      // level page_num block_num par_num line_num word_num left top width height conf text
+      for (const line of Buffer.concat(out).toString("utf8").split("\n").slice(1)) {
+        const cols = line.split("\t");
+        if (cols.length < 12 || cols[0] !== "5" || !cols[11].trim()) continue;
+        words.push({
+          text: cols[11],
+          x: +cols[6],
+          y: +cols[7],
+          width: +cols[8],
+          height: +cols[9],
+          confidence: +cols[10],
+          line: `${cols[2]}.${cols[3]}.${cols[4]}`
+        });
+      }
+      resolve(words);
+    });
+    proc.stdin.end(png);
+  });
+}
+
+async function httpEngine(png, lang, timeoutMs) {
+  const resp = await fetch(config.ocr.endpoint, {
+    method: "POST",
+    headers: { "Content-Type": "image/png", "X-OCR-Lang": lang },
+    body: png,
+    signal: AbortSignal.timeout(timeoutMs)
+  });
+  if (!resp.ok) throw new Error(`OCR endpoint responded ${resp.status}`);
+  const { words = [] } = await resp.json();
+  return words;
+}
+
+const ENGINES = { tesseract, http: httpEngine };
+
+// OCR the master image in horizontal bands and assemble a page-space transcript
+export async function runOcr(master, { lang = "eng", timeoutMs = 60000 } = {}) {
+  const name = config.ocr.engine;
+  const engine = ENGINES[name];
+  if (!engine) throw new Error(`unknown OCR engine: ${name}`);
+
+  const meta = await sharp(master, { limitInputPixels: false }).metadata();
+  const words = [];
+  for (let top = 0; top < meta.height; top += OCR_BAND_HEIGHT) {
+    const height = Math.min(OCR_BAND_HEIGHT, meta.height - top);
+    const band = await sharp(master, { limitInputPixels: false })
+      .extract({ left: 0, top, width: meta.width, height })
+      .png()
+      .toBuffer();
+    for (const w of await engine(band, lang, timeoutMs)) {
+      words.push({ ...w, y: w.y + top, line: w.line && `${top}:${w.line}` });
+    }
+  }
+
+  // One transcript line per OCR line, in reading order
+  const lines = [];
+  let current = null;
+  for (const w of words) {
+    if (!current || current.key !== w.line) {
+      current = { key: w.line, words: [] };
+      lines.push(current);
+    }
+    current.words.push(w.text);
+  }
+
+  return {
+    engine: name,
+    lang,
+    text: lines.map(l => l.words.join(" ")).join("\n"),
+    words: words.map(({ line, ...w }) => w)
+  };
+}
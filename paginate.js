@@ -0,0 +1,110 @@
+// paginate: { next_selector, max_pages } — follow "Next" links after the
+// first page and run the extract fields on every page, in one session. The
+// browser clicks (so JS-driven pagers work); the http engine follows the
+// link's href. max_pages counts the first page.
+
+import { extractFields } from "./fields.js";
+import { documentPage, fetchDocument } from "./httpfetch.js";
+
+export const MAX_PAGES = 100;
+
+const HTML_TYPES = ["text/html", "application/xhtml+xml"];
+
+// Combined dataset: per-page results plus each field concatenated across pages
+function combine(pages, specs, stopped) {
+  const fields = {};
+  for (const [name, spec] of Object.entries(specs)) {
+    fields[name] = pages.flatMap(p => (spec.all ? p.fields[name] : p.fields[name] == null ? [] : [p.fields[name]]));
+  }
+  return { pages, fields, page_count: pages.length, stopped };
+}
+
+// In-page: the next control, unless it is missing or disabled
+function nextTarget([nodes]) {
+  const el = nodes[0];
+  if (!el || el.disabled || el.getAttribute("aria-disabled") === "true" || /\bdisabled\b/.test(el.className)) return null;
+  return { href: el.href || el.getAttribute("href") || null };
+}
+
+// In-page: URL plus a hash of the visible text; given an earlier signature,
+// whether the page has changed since
+function pageSignature(prev) {
+  const text = document.body ? document.body.innerText : "";
+  let hash = 0;
+  for (let i = 0; i < text.length; i++) hash = (hash * 31 + text.charCodeAt(i)) | 0;
+  const signature = `${location.href} ${hash}`;
+  return prev === undefined ? signature : signature !== prev;
+}
+
+// firstFields: what was already extracted from the page as it stands
+export async function paginateBrowser(page, { next_selector, max_pages }, specs, firstFields, { timeoutMs, settleMs }) {
+  const pages = [{ index: 0, url: page.url(), fields: firstFields }];
+  let stopped = "max_pages";
+  while (pages.length < max_pages) {
+    const handles = await page.$$(next_selector);
+    try {
+      if (!(await page.evaluate(nextTarget, [handles]))) {
+        stopped = "no_next";
+        break;
+      }
+      // Client-side pagers change the DOM without navigating, so wait for
+      // either; a click that changes nothing ends the run instead of looping
+      const before = await page.evaluate(pageSignature);
+      await handles[0].click({ timeout: timeoutMs });
+      await page.waitForFunction(pageSignature, before, { timeout: timeoutMs });
+      await page.waitForLoadState("domcontentloaded", { timeout: timeoutMs });
+    } catch (err) {
+      stopped = `error: ${err.message.split("\n")[0]}`;
+      break;
+    } finally {
+      await Promise.all(handles.map(h => h.dispose().catch(() => {})));
+    }
+    await page.waitForTimeout(settleMs);
+    const { fields } = await extractFields(page, specs);
+    pages.push({ index: pages.length, url: page.url(), fields });
+  }
+  return combine(pages, specs, stopped);
+}
+
+export async function paginateHttp(page, { next_selector, max_pages }, specs, firstFields, fetchOptions) {
+  const pages = [{ index: 0, url: page.url(), fields: firstFields }];
+  const seen = new Set([page.url()]);
+  let stopped = "max_pages";
+  let current = page;
+  while (pages.length < max_pages) {
+    const next = await current.evaluate(nextTarget, [await current.$$(next_selector)]);
+    if (!next || !next.href) {
+      stopped = "no_next";
+      break;
+    }
+    const url = new URL(next.href, current.url()).href;
+    if (seen.has(url)) {
+      stopped = "repeated_url";
+      break;
+    }
+    seen.add(url);
+    let fetched;
+    try {
+      fetched = await fetchDocument(url, { ...fetchOptions, method: "GET", body: undefined });
+    } catch (err) {
+      stopped = `error: ${err.message}`;
+      break;
+    }
+    // an error page or a non-HTML body has no page data to extract
+    const type = (fetched.headers["content-type"] || "").split(";")[0].trim().toLowerCase();
+    if (fetched.status >= 400) {
+      stopped = `http_${fetched.status}`;
+      break;
+    }
+    if (type && !HTML_TYPES.includes(type)) {
+      stopped = `not_html: ${type}`;
+      break;
+    }
+    if (current !== page) current.close();
+    current = await documentPage(fetched.body.toString("utf8"), fetched.url);
+    const { fields } = await extractFields(current, specs);
+    pages.push({ index: pages.length, url: fetched.url, fields });
+  }
+  if (current !== page) current.close();
+  return combine(pages, specs, stopped);
+}
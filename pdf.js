@@ -0,0 +1,56 @@
+// PDF targets. Headless Chrome turns a PDF navigation into a download (and its
+// viewer would only screenshot as toolbar chrome), so the raw file is returned
+// instead; poppler's CLI tools from pdf.poppler_bin_dir provide the text layer
+// and, when asked for, page rasters.
+
+import { spawn } from "node:child_process";
+import { join } from "node:path";
+import { config } from "./config.js";
+
+function poppler(tool, args, input, timeoutMs) {
+  return new Promise((resolve, reject) => {
+    const bin = config.pdf.poppler_bin_dir ? join(config.pdf.poppler_bin_dir, tool) : tool;
+    const proc = spawn(bin, args, { stdio: ["pipe", "pipe", "pipe"] });
+    const timer = setTimeout(() => proc.kill("SIGKILL"), timeoutMs);
+    const out = [];
+    let stderr = "";
+    proc.stdout.on("data", d => out.push(d));
+    proc.stderr.on("data", d => { stderr += d; });
+    proc.on("error", err => { clearTimeout(timer); reject(err); });
+    proc.on("close", code => {
+      clearTimeout(timer);
+      if (code !== 0) return reject(new Error(`${tool} exited ${code}: ${stderr.trim().slice(0, 200)}`));
+      resolve(Buffer.concat(out));
+    });
+    // poppler may exit before reading all of stdin (e.g. on a damaged file)
+    proc.stdin.on("error", () => {});
+    proc.stdin.end(input);
+  });
+}
+
+export async function pdfInfo(pdf, timeoutMs) {
+  const info = {};
+  for (const line of (await poppler("pdfinfo", ["-"], pdf, timeoutMs)).toString("utf8").split("\n")) {
+    const i = line.indexOf(":");
+    if (i > 0) info[line.slice(0, i).trim()] = line.slice(i + 1).trim();
+  }
+  return { pages: parseInt(info.Pages, 10) || 0, title: info.Title || null, encrypted: /^yes/i.test(info.Encrypted || "") };
+}
+
+// Embedded text, one string per page; scanned PDFs come back empty (use ocr on pages)
+export async function pdfText(pdf, timeoutMs) {
+  const text = (await poppler("pdftotext", ["-layout", "-enc", "UTF-8", "-", "-"], pdf, timeoutMs)).toString("utf8");
+  const pages = text.split("\f");
+  if (pages.length > 1 && pages[pages.length - 1].trim() === "") pages.pop();
+  return pages;
+}
+
+// PNG per page for the first `count` pages at `dpi`
+export async function pdfPages(pdf, { count, dpi, timeoutMs }) {
+  const pages = [];
+  for (let i = 1; i <= count; i++) {
+    pages.push(await poppler("pdftoppm", ["-png", "-r", String(dpi), "-f", String(i), "-l", String(i), "-singlefile", "-"],
+      pdf, timeoutMs));
+  }
+  return pages;
+}
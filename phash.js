@@ -0,0 +1,59 @@
+// Perceptual hashes for cheap visual dedup/drift detection.
+// Both are 64-bit and returned as 16 hex chars; compare with Hamming distance.
+
+import sharp from "sharp";
+
+async function grayscale(input, width, height) {
+  return sharp(input, { limitInputPixels: false })
+    .flatten({ background: "#ffffff" })
+    .grayscale()
+    .resize(width, height, { fit: "fill" })
+    .raw()
+    .toBuffer();
+}
+
+function bitsToHex(bits) {
+  let hex = "";
+  for (let i = 0; i < bits.length; i += 4) {
+    hex += ((bits[i] << 3) | (bits[i + 1] << 2) | (bits[i + 2] << 1) | bits[i + 3]).toString(16);
+  }
+  return hex;
+}
+
+// dHash: is each pixel brighter than its right-hand neighbour on a 9x8 thumbnail
+async function dHash(input) {
+  const px = await grayscale(input, 9, 8);
+  const bits = [];
+  for (let y = 0; y < 8; y++) {
+    for (let x = 0; x < 8; x++) bits.push(px[y * 9 + x] > px[y * 9 + x + 1] ? 1 : 0);
+  }
+  return bitsToHex(bits);
+}
+
+const N = 32;
+const COS = Array.from({ length: N }, (_, k) =>
+  Array.from({ length: N }, (_, n) => Math.cos(((2 * n + 1) * k * Math.PI) / (2 * N)))
+);
+
+// pHash: low-frequency 8x8 block of a 32x32 DCT compared against its median
+async function pHash(input) {
+  const px = await grayscale(input, N, N);
+  const rows = [];
+  for (let y = 0; y < N; y++) {
+    rows.push(COS.slice(0, 8).map(c => c.reduce((sum, v, x) => sum + v * px[y * N + x], 0)));
+  }
+  const coeffs = [];
+  for (let v = 0; v < 8; v++) {
+    for (let u = 0; u < 8; u++) {
+      coeffs.push(COS[v].reduce((sum, c, y) => sum + c * rows[y][u], 0));
+    }
+  }
+  // skip the DC term when picking the threshold
+  const median = [...coeffs.slice(1)].sort((a, b) => a - b)[31];
+  return bitsToHex(coeffs.map(c => (c > median ? 1 : 0)));
+}
+
+export async function perceptualHashes(input) {
+  const [dhash, phash] = await Promise.all([dHash(input), pHash(input)]);
+  return { dhash, phash };
+}
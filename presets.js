@@ -0,0 +1,52 @@
+// Named option bundles ("mobile-dark-fullpage") that a capture request selects
+// with preset: "<name>". Request fields still override the preset's values.
+// Managed through the admin API and persisted to storage.presets_file
+// (PRESETS_FILE) when set, as a JSON object of name -> options.
+
+import { config } from "./config.js";
+import { ScrapeError, sendError } from "./errors.js";
+import { namedStore } from "./records.js";
+
+const presets = namedStore("preset", () => config.storage.presets_file, options => {
+  if (!options || typeof options !== "object" || Array.isArray(options)) {
+    throw new Error("preset must be an object of options");
+  }
+  if ("preset" in options || "url" in options) throw new Error("presets cannot set url or preset");
+});
+
+export function listPresets() {
+  return presets.list().map(([name, options]) => ({ name, options }));
+}
+
+export function getPreset(name) {
+  return presets.get(name);
+}
+
+export function savePreset(name, options) {
+  return presets.save(name, options);
+}
+
+export function deletePreset(name) {
+  return presets.remove(name);
+}
+
+// Request body with its preset's options merged underneath
+export function withPreset(fields = {}) {
+  const { preset, ...rest } = fields;
+  if (preset == null) return rest;
+  const options = getPreset(String(preset));
+  if (!options) throw new ScrapeError("invalid_request", `unknown preset: ${preset}`, 400);
+  return { ...options, ...rest };
+}
+
+// Express middleware for capture endpoints: merge the preset once into
+// req.options, so the queue class, routing and the handler all read the same
+// values; place before dispatch and withSlot
+export function resolvePreset(req, res, next) {
+  try {
+    req.options = withPreset(req.body || {});
+  } catch (err) {
+    return sendError(res, err.status, err.code, err.message);
+  }
+  next();
+}
@@ -0,0 +1,90 @@
+// Named browser fingerprint profiles, selected with profile: "<name>" so a
+// recurring job presents the same identity on every run. Managed through the
+// admin API and persisted to storage.profiles_file (PROFILES_FILE) when set.
+// Explicit request fields (user_agent, locale, timezone) still win.
+
+import { config } from "./config.js";
+import { namedStore } from "./records.js";
+
+// field -> check; everything is optional
+const FIELDS = {
+  user_agent: v => typeof v === "string" && v.length > 0,
+  platform: v => typeof v === "string", // navigator.platform, e.g. "Win32", "MacIntel"
+  languages: v => Array.isArray(v) && v.length > 0 && v.every(l => typeof l === "string"),
+  timezone: v => typeof v === "string",
+  screen: v => v && Number.isInteger(v.width) && Number.isInteger(v.height),
+  hardware_concurrency: v => Number.isInteger(v) && v > 0,
+  device_memory: v => typeof v === "number" && v > 0,
+  webgl_vendor: v => typeof v === "string",
+  webgl_renderer: v => typeof v === "string",
+  fonts: v => Array.isArray(v) && v.every(f => typeof f === "string") // families document.fonts.check reports as present
+};
+
+const profiles = namedStore("profile", () => config.storage.profiles_file, profile => {
+  if (!profile || typeof profile !== "object" || Array.isArray(profile)) throw new Error("profile must be an object");
+  for (const [field, value] of Object.entries(profile)) {
+    if (!FIELDS[field]) throw new Error(`unknown profile field: ${field}`);
+    if (!FIELDS[field](value)) throw new Error(`invalid profile field: ${field}`);
+  }
+});
+
+export function listProfiles() {
+  return profiles.list().map(([name, profile]) => ({ name, profile }));
+}
+
+export function getProfile(name) {
+  return profiles.get(name);
+}
+
+export function saveProfile(name, profile) {
+  return profiles.save(name, profile);
+}
+
+export function deleteProfile(name) {
+  return profiles.remove(name);
+}
+
+// Init script: navigator / WebGL / font answers from the profile
+export function applyFingerprint(fp) {
+  const define = (obj, prop, value) => {
+    try {
+      Object.defineProperty(obj, prop, { get: () => value, configurable: true });
+    } catch (_) {}
+  };
+  const nav = Object.getPrototypeOf(navigator);
+  if (fp.platform != null) define(nav, "platform", fp.platform);
+  if (fp.languages) {
+    define(nav, "languages", Object.freeze([...fp.languages]));
+    define(nav, "language", fp.languages[0]);
+  }
+  if (fp.hardware_concurrency) define(nav, "hardwareConcurrency", fp.hardware_concurrency);
+  if (fp.device_memory) define(nav, "deviceMemory", fp.device_memory);
+  if (fp.screen) {
+    define(screen, "width", fp.screen.width);
+    define(screen, "height", fp.screen.height);
+    define(screen, "availWidth", fp.screen.width);
+    define(screen, "availHeight", fp.screen.height);
+  }
+  if (fp.webgl_vendor != null || fp.webgl_renderer != null) {
+    // WEBGL_debug_renderer_info: UNMASKED_VENDOR_WEBGL / UNMASKED_RENDERER_WEBGL
+    for (const Ctx of [window.WebGLRenderingContext, window.WebGL2RenderingContext].filter(Boolean)) {
+      const getParameter = Ctx.prototype.getParameter;
+      Ctx.prototype.getParameter = function (param) {
+        if (param === 0x9245 && fp.webgl_vendor != null) return fp.webgl_vendor;
+        if (param === 0x9246 && fp.webgl_renderer != null) return fp.webgl_renderer;
+        return getParameter.call(this, param);
+      };
+    }
+  }
+  if (fp.fonts && document.fonts) {
+    // only the profile's families (and generic ones) count as installed
+    const present = new Set([...fp.fonts.map(f => f.toLowerCase()), "serif", "sans-serif", "monospace", "cursive",
+      "fantasy", "system-ui"]);
+    const check = document.fonts.check.bind(document.fonts);
+    document.fonts.check = (font, text) => {
+      const families = font.replace(/^.*?\d+(\.\d+)?(px|pt|em|rem|%)\s*(\/\s*\S+\s*)?/, "").split(",")
+        .map(f => f.trim().replace(/^["']|["']$/g, "").toLowerCase());
+      return families.some(f => present.has(f)) && check(font, text);
+    };
+  }
+}
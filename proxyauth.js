@@ -0,0 +1,159 @@
+// Authenticated proxies. For an HTTP(S) proxy Playwright answers the 407
+// through Fetch.authRequired with proxy.username/password, but Chrome never
+// authenticates to a SOCKS5 proxy at all. Those get a loopback relay instead:
+// Chrome speaks unauthenticated SOCKS5 to it, and it speaks username/password
+// SOCKS5 (RFC 1929) to the real proxy.
+
+import net from "node:net";
+
+const PROTOCOLS = ["http:", "https:", "socks5:", "socks5h:"];
+const HANDSHAKE_TIMEOUT_MS = 30000;
+
+// Throws on a malformed { server, username, password, bypass }
+export function checkProxy(proxy) {
+  if (!proxy || typeof proxy !== "object" || typeof proxy.server !== "string") {
+    throw new Error("proxy must be an object with a server");
+  }
+  let url;
+  try {
+    url = new URL(proxy.server.includes("://") ? proxy.server : `http://${proxy.server}`);
+  } catch (_) {
+    throw new Error(`invalid proxy server: ${proxy.server}`);
+  }
+  if (!PROTOCOLS.includes(url.protocol)) throw new Error(`unsupported proxy scheme: ${url.protocol.slice(0, -1)}`);
+  if (url.username || url.password) throw new Error("proxy credentials go in username/password, not the server URL");
+  if (proxy.username != null && typeof proxy.username !== "string") throw new Error("proxy.username must be a string");
+  if (proxy.password != null && typeof proxy.password !== "string") throw new Error("proxy.password must be a string");
+  if (proxy.username && Buffer.byteLength(proxy.username) > 255) throw new Error("proxy.username is too long");
+  if (proxy.password && Buffer.byteLength(proxy.password) > 255) throw new Error("proxy.password is too long");
+}
+
+// The proxy setting to hand Chrome, plus close() for anything started for it
+export async function browserProxy(proxy) {
+  if (!proxy) return { proxy: undefined, close: () => {} };
+  const url = new URL(proxy.server.includes("://") ? proxy.server : `http://${proxy.server}`);
+  if (!url.protocol.startsWith("socks5") || !proxy.username) return { proxy, close: () => {} };
+  const relay = await socksRelay(url.hostname.replace(/^\[|\]$/g, ""), Number(url.port) || 1080, proxy.username, proxy.password ?? "");
+  return { proxy: { server: `socks5://127.0.0.1:${relay.port}`, bypass: proxy.bypass }, close: relay.close };
+}
+
+// Exact-length reads off a socket during a handshake
+function reader(socket) {
+  let buffered = Buffer.alloc(0);
+  let closed = false;
+  let wake = () => {};
+  const onData = chunk => {
+    buffered = Buffer.concat([buffered, chunk]);
+    wake();
+  };
+  const onClose = () => {
+    closed = true;
+    wake();
+  };
+  socket.on("data", onData);
+  socket.on("close", onClose);
+  return {
+    async read(n) {
+      while (buffered.length < n) {
+        if (closed) throw new Error("connection closed during SOCKS handshake");
+        await new Promise(resolve => { wake = resolve; });
+      }
+      const out = buffered.subarray(0, n);
+      buffered = buffered.subarray(n);
+      return out;
+    },
+    // stop reading; returns whatever arrived past the handshake
+    detach() {
+      socket.off("data", onData);
+      socket.off("close", onClose);
+      return buffered;
+    }
+  };
+}
+
+// SOCKS5 request or reply after the first 4 bytes: address then port
+async function readAddress(read, head) {
+  const atyp = head[3];
+  let addr;
+  if (atyp === 1) addr = await read(4);
+  else if (atyp === 4) addr = await read(16);
+  else if (atyp === 3) {
+    const len = await read(1);
+    addr = Buffer.concat([len, await read(len[0])]);
+  } else throw new Error(`SOCKS address type ${atyp} not supported`);
+  return Buffer.concat([head, addr, await read(2)]);
+}
+
+const FAILURE_REPLY = Buffer.from([5, 1, 0, 1, 0, 0, 0, 0, 0, 0]);
+
+async function relayConnection(client, upstreamHost, upstreamPort, username, password) {
+  const fromClient = reader(client);
+  const greeting = await fromClient.read(2);
+  if (greeting[0] !== 5) throw new Error("not a SOCKS5 client");
+  await fromClient.read(greeting[1]);
+  client.write(Buffer.from([5, 0]));
+  const head = await fromClient.read(4);
+  const request = await readAddress(fromClient.read, head);
+  if (head[1] !== 1) {
+    // only CONNECT; Chrome never asks for BIND or UDP ASSOCIATE
+    client.end(Buffer.from([5, 7, 0, 1, 0, 0, 0, 0, 0, 0]));
+    return;
+  }
+
+  const upstream = net.connect(upstreamPort, upstreamHost);
+  client.on("close", () => upstream.destroy());
+  upstream.on("error", () => client.destroy());
+  const fromUpstream = reader(upstream);
+  upstream.write(Buffer.from([5, 1, 2]));
+  const method = await fromUpstream.read(2);
+  if (method[1] !== 2) throw new Error("SOCKS proxy refused username/password authentication");
+  const user = Buffer.from(username);
+  const pass = Buffer.from(password);
+  upstream.write(Buffer.concat([Buffer.from([1, user.length]), user, Buffer.from([pass.length]), pass]));
+  const auth = await fromUpstream.read(2);
+  if (auth[1] !== 0) throw new Error("SOCKS proxy rejected the credentials");
+  upstream.write(request);
+  const reply = await readAddress(fromUpstream.read, await fromUpstream.read(4));
+  client.write(reply);
+  if (reply[1] !== 0) {
+    client.end();
+    return;
+  }
+
+  // handshake done: splice the two sockets together
+  client.setTimeout(0);
+  const clientRest = fromClient.detach();
+  const upstreamRest = fromUpstream.detach();
+  if (clientRest.length) upstream.write(clientRest);
+  if (upstreamRest.length) client.write(upstreamRest);
+  client.pipe(upstream);
+  upstream.pipe(client);
+}
+
+// A loopback SOCKS5 listener forwarding every connection through the
+// authenticated upstream proxy
+export function socksRelay(upstreamHost, upstreamPort, username, password) {
+  const sockets = new Set();
+  const server = net.createServer(client => {
+    sockets.add(client);
+    client.on("close", () => sockets.delete(client));
+    client.on("error", () => {});
+    client.setTimeout(HANDSHAKE_TIMEOUT_MS, () => client.destroy());
+    relayConnection(client, upstreamHost, upstreamPort, username, password).catch(err => {
+      console.error(`socks relay: ${err.message}`);
+      if (!client.destroyed) client.end(FAILURE_REPLY);
+    });
+  });
+  return new Promise((resolve, reject) => {
+    server.once("error", reject);
+    server.listen(0, "127.0.0.1", () => {
+      resolve({
+        port: server.address().port,
+        close: () => {
+          server.close();
+          for (const socket of sockets) socket.destroy();
+        }
+      });
+    });
+  });
+}
@@ -0,0 +1,119 @@
+// Global capture slots. Requests over settings.max_concurrency wait in FIFO
+// order within their priority class; raising the limit admits waiters at
+// once, lowering it only takes effect as running captures finish, so nothing
+// in flight is dropped.
+//
+// "interactive" (the default) always goes ahead of "batch", except that a
+// batch request waiting settings.batch_promote_ms or longer is admitted
+// before further interactive ones, so a steady stream of UI captures cannot
+// starve a crawl.
+
+import { onSettingsChange, settings } from "./settings.js";
+import { sendError } from "./errors.js";
+import { sendAborted } from "./deadline.js";
+
+export const PRIORITIES = ["interactive", "batch"];
+
+let running = 0;
+const waiting = { interactive: [], batch: [] };
+
+function queued() {
+  return waiting.interactive.length + waiting.batch.length;
+}
+
+function nextWaiter() {
+  const batch = waiting.batch[0];
+  const promoted = batch && Date.now() - batch.since >= settings.batch_promote_ms;
+  return (promoted || !waiting.interactive.length ? waiting.batch : waiting.interactive).shift();
+}
+
+function pump() {
+  while (running < settings.max_concurrency && queued()) {
+    const next = nextWaiter();
+    clearTimeout(next.timer);
+    running++;
+    next.resolve();
+  }
+}
+
+onSettingsChange(pump);
+
+// signal (optional AbortSignal) withdraws a request that is still waiting
+export function acquireSlot(signal, priority = "interactive") {
+  if (signal?.aborted) return Promise.reject(new Error("no longer waiting for a capture slot"));
+  if (running < settings.max_concurrency && queued() === 0) {
+    running++;
+    return Promise.resolve();
+  }
+  const line = waiting[priority];
+  return new Promise((resolve, reject) => {
+    const entry = { resolve, reject, timer: null, since: Date.now() };
+    const leave = message => {
+      clearTimeout(entry.timer);
+      const i = line.indexOf(entry);
+      if (i >= 0) line.splice(i, 1);
+      reject(new Error(message));
+    };
+    entry.timer = setTimeout(() => leave("timed out waiting for a capture slot"), settings.queue_timeout_ms);
+    signal?.addEventListener("abort", () => leave("no longer waiting for a capture slot"), { once: true });
+    line.push(entry);
+  });
+}
+
+export function releaseSlot() {
+  running--;
+  pump();
+}
+
+export function queueStats() {
+  const now = Date.now();
+  const oldest = line => (line.length ? now - line[0].since : 0);
+  return {
+    running,
+    waiting: queued(),
+    waiting_interactive: waiting.interactive.length,
+    waiting_batch: waiting.batch.length,
+    oldest_batch_wait_ms: oldest(waiting.batch),
+    max_concurrency: settings.max_concurrency
+  };
+}
+
+// Express middleware: hold a slot for the lifetime of the response. The
+// request's priority (preset applied, see presets.js resolvePreset) picks the
+// queue class.
+export async function withSlot(req, res, next) {
+  const priority = (req.options ?? req.body)?.priority ?? "interactive";
+  if (!PRIORITIES.includes(priority)) {
+    return sendError(res, 400, "invalid_request", `priority must be one of ${PRIORITIES.join(", ")}`);
+  }
+  // Without deadline.js in front there is no abort signal; a caller that hangs
+  // up must still leave the queue rather than take a slot nobody waits for
+  let signal = res.locals.abort;
+  let hangUp = null;
+  if (!signal) {
+    const controller = new AbortController();
+    hangUp = () => controller.abort();
+    res.once("close", hangUp);
+    signal = controller.signal;
+  }
+  try {
+    await acquireSlot(signal, priority);
+  } catch (err) {
+    // caller gone or out of time (deadline.js): nobody to tell about the queue
+    if (res.locals.abort?.aborted) return sendAborted(res);
+    if (signal.aborted) return;
+    res.set("Retry-After", "10");
+    return sendError(res, 503, "queue_timeout", err.message);
+  } finally {
+    if (hangUp) res.off("close", hangUp);
+  }
+  let released = false;
+  const release = () => {
+    if (released) return;
+    released = true;
+    releaseSlot();
+  };
+  res.on("finish", release);
+  res.on("close", release);
+  next();
+}
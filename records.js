@@ -0,0 +1,45 @@
+// Named records managed through the admin API: option presets and
+// fingerprint profiles. Each store keeps its records in memory and, when its
+// file is configured, persists them as a JSON object of name -> record.
+
+import { existsSync, readFileSync, writeFileSync, renameSync } from "node:fs";
+
+const NAME_PATTERN = /^[a-z0-9][a-z0-9._-]{0,63}$/i;
+
+// kind names the records in errors; fileOf() returns the backing file ("" for
+// memory only); check(record) throws when a record may not be saved
+export function namedStore(kind, fileOf, check) {
+  let records = {};
+  const file = fileOf();
+  if (file && existsSync(file)) records = JSON.parse(readFileSync(file, "utf8"));
+
+  function persist() {
+    const path = fileOf();
+    if (!path) return;
+    const tmp = `${path}.tmp`;
+    writeFileSync(tmp, JSON.stringify(records, null, 2));
+    renameSync(tmp, path);
+  }
+
+  return {
+    list() {
+      return Object.entries(records);
+    },
+    get(name) {
+      return Object.hasOwn(records, name) ? records[name] : null;
+    },
+    save(name, record) {
+      if (!NAME_PATTERN.test(name)) throw new Error(`${kind} names are 1-64 letters, digits, '.', '_' or '-'`);
+      check(record);
+      records[name] = record;
+      persist();
+      return record;
+    },
+    remove(name) {
+      if (!Object.hasOwn(records, name)) return false;
+      delete records[name];
+      persist();
+      return true;
+    }
+  };
+}
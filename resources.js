@@ -0,0 +1,71 @@
+// Per-capture resource usage for capacity planning. Node's CPU and RSS are
+// process-wide, so with concurrent captures they include the neighbours'
+// share; Chrome's numbers come from Performance.getMetrics on the capture's
+// own page and are exact for it.
+
+const RSS_SAMPLE_MS = 200;
+
+// Chrome metric name -> reported key; durations arrive in seconds
+const CHROME_METRICS = {
+  TaskDuration: "task_ms",
+  ScriptDuration: "script_ms",
+  LayoutDuration: "layout_ms",
+  RecalcStyleDuration: "recalc_style_ms",
+  JSHeapUsedSize: "js_heap_used_bytes",
+  JSHeapTotalSize: "js_heap_total_bytes",
+  Nodes: "dom_nodes",
+  Documents: "documents",
+  Frames: "frames",
+  LayoutCount: "layout_count",
+  RecalcStyleCount: "recalc_style_count"
+};
+
+export function watchResources() {
+  const startedAt = process.hrtime.bigint();
+  const cpu = process.cpuUsage();
+  const rss = process.memoryUsage.rss();
+  let peak = rss;
+  const timer = setInterval(() => {
+    peak = Math.max(peak, process.memoryUsage.rss());
+  }, RSS_SAMPLE_MS);
+  timer.unref();
+  const sessions = [];
+
+  return {
+    // Start Chrome's counters on a page's CDP session (again for a followed popup)
+    async attach(session) {
+      await session.send("Performance.enable", { timeDomain: "threadTicks" });
+      sessions.push(session);
+    },
+
+    // counts: capture-specific figures (tiles, segments, pixels) to include
+    async report(counts = {}) {
+      clearInterval(timer);
+      peak = Math.max(peak, process.memoryUsage.rss());
+      const used = process.cpuUsage(cpu);
+      const chrome = {};
+      for (const session of sessions) {
+        const { metrics } = await session.send("Performance.getMetrics").catch(() => ({ metrics: [] }));
+        for (const { name, value } of metrics) {
+          const key = CHROME_METRICS[name];
+          if (!key) continue;
+          const v = key.endsWith("_ms") ? Math.round(value * 1000) : value;
+          // durations and counts add up across pages; sizes take the largest
+          chrome[key] = key.endsWith("_bytes") ? Math.max(chrome[key] || 0, v) : (chrome[key] || 0) + v;
+        }
+      }
+      return {
+        wall_ms: Number((process.hrtime.bigint() - startedAt) / 1000000n),
+        cpu_user_ms: Math.round(used.user / 1000),
+        cpu_system_ms: Math.round(used.system / 1000),
+        peak_rss_delta_bytes: peak - rss,
+        chrome: sessions.length ? chrome : undefined,
+        ...counts
+      };
+    },
+
+    stop() {
+      clearInterval(timer);
+    }
+  };
+}
@@ -0,0 +1,99 @@
+// Retention for what the service keeps after a capture: job history and any
+// stored result files. A background janitor runs every
+// retention.interval_ms and, per tenant, deletes records and results older
+// than ttl_days, beyond the newest max_count, and (results only) the oldest
+// ones past max_bytes. A tenant's own retention block in the tenants file
+// overrides these defaults field by field. 0 means no limit.
+//
+// Result backends take part by registering a store:
+//   { name, list() -> [{ key, tenant, bytes, created_at }], remove(key) }
+
+import { config, onConfigReload } from "./config.js";
+import { pruneJobs } from "./jobs.js";
+import { findTenant } from "./tenants.js";
+
+const stores = [];
+
+export function registerResultStore(store) {
+  stores.push(store);
+}
+
+export function policyFor(tenantId) {
+  const { ttl_days, max_count, max_bytes } = config.retention;
+  return { ttl_days, max_count, max_bytes, ...findTenant(tenantId)?.retention };
+}
+
+// Newest first per tenant; everything past a limit goes
+async function pruneStore(store) {
+  const byTenant = new Map();
+  for (const item of await store.list()) {
+    if (!byTenant.has(item.tenant)) byTenant.set(item.tenant, []);
+    byTenant.get(item.tenant).push(item);
+  }
+  const removed = { count: 0, bytes: 0 };
+  for (const [tenant, items] of byTenant) {
+    const { ttl_days, max_count, max_bytes } = policyFor(tenant);
+    const cutoff = ttl_days ? new Date(Date.now() - ttl_days * 86400000).toISOString() : null;
+    items.sort((a, b) => (a.created_at < b.created_at ? 1 : -1));
+    let kept = 0;
+    let keptBytes = 0;
+    for (const item of items) {
+      const expired = (cutoff && item.created_at < cutoff) || (max_count && kept >= max_count) ||
+        (max_bytes && keptBytes + item.bytes > max_bytes);
+      if (!expired) {
+        kept++;
+        keptBytes += item.bytes;
+        continue;
+      }
+      try {
+        await store.remove(item.key);
+        removed.count++;
+        removed.bytes += item.bytes;
+      } catch (err) {
+        console.error(`retention: removing ${store.name}/${item.key} failed: ${err.message}`);
+      }
+    }
+  }
+  return removed;
+}
+
+let running = null;
+
+// One janitor pass; concurrent callers share the pass in progress
+export function runJanitor() {
+  if (!running) {
+    running = (async () => {
+      const report = { jobs: await pruneJobs(policyFor), results: {} };
+      for (const store of stores) {
+        try {
+          report.results[store.name] = await pruneStore(store);
+        } catch (err) {
+          console.error(`retention: ${store.name}: ${err.message}`);
+        }
+      }
+      const results = Object.values(report.results).reduce((n, r) => n + r.count, 0);
+      if (report.jobs || results) console.log(`retention: removed ${report.jobs} job records, ${results} results`);
+      return report;
+    })().finally(() => {
+      running = null;
+    });
+  }
+  return running;
+}
+
+let timer = null;
+
+function schedule(cfg) {
+  clearInterval(timer);
+  timer = null;
+  if (cfg.retention.interval_ms > 0) {
+    timer = setInterval(() => runJanitor().catch(err => console.error(`retention: ${err.message}`)),
+      cfg.retention.interval_ms);
+    timer.unref();
+  }
+}
+
+export function startJanitor() {
+  schedule(config);
+  onConfigReload(schedule);
+}
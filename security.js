@@ -0,0 +1,84 @@
+// CSP violation, mixed-content and security-state capture during page load.
+// With testCsp, the main document is served with an extra
+// Content-Security-Policy-Report-Only header so a stricter policy can be
+// trialled without breaking the page.
+
+const VIOLATIONS_KEY = "__scrapeCspViolations";
+
+export async function watchSecurity(page, cdp, { testCsp = null } = {}) {
+  const issues = [];
+  const states = [];
+
+  await page.addInitScript(key => {
+    window[key] = [];
+    document.addEventListener("securitypolicyviolation", e => {
+      window[key].push({
+        blocked_uri: e.blockedURI,
+        violated_directive: e.violatedDirective,
+        effective_directive: e.effectiveDirective,
+        original_policy: e.originalPolicy,
+        disposition: e.disposition,
+        source_file: e.sourceFile || null,
+        line: e.lineNumber || null,
+        sample: e.sample || null
+      });
+    }, true);
+  }, VIOLATIONS_KEY);
+
+  cdp.on("Audits.issueAdded", ({ issue }) => {
+    if (issue.code === "ContentSecurityPolicyIssue") {
+      const d = issue.details.contentSecurityPolicyIssueDetails || {};
+      issues.push({
+        type: "csp",
+        blocked_url: d.blockedURL || null,
+        directive: d.violatedDirective,
+        report_only: !!d.isReportOnly,
+        kind: d.contentSecurityPolicyViolationType,
+        source: d.sourceCodeLocation ? `${d.sourceCodeLocation.url}:${d.sourceCodeLocation.lineNumber}` : null
+      });
+    } else if (issue.code === "MixedContentIssue") {
+      const d = issue.details.mixedContentIssueDetails || {};
+      issues.push({
+        type: "mixed_content",
+        insecure_url: d.insecureURL,
+        main_resource_url: d.mainResourceURL,
+        resolution: d.resolutionStatus,
+        resource_type: d.resourceType || null
+      });
+    }
+  });
+  cdp.on("Security.visibleSecurityStateChanged", ({ visibleSecurityState: s }) => {
+    states.push({
+      state: s.securityState,
+      issues: s.securityStateIssueIds || [],
+      certificate: s.certificateSecurityState
+        ? {
+            protocol: s.certificateSecurityState.protocol,
+            issuer: s.certificateSecurityState.issuer,
+            valid_to: new Date(s.certificateSecurityState.validTo * 1000).toISOString()
+          }
+        : null
+    });
+  });
+  await cdp.send("Audits.enable");
+  await cdp.send("Security.enable").catch(() => {});
+
+  if (testCsp) {
+    await page.route("**/*", async route => {
+      const request = route.request();
+      if (request.resourceType() !== "document" || request.frame() !== page.mainFrame()) return route.fallback();
+      const response = await route.fetch();
+      await route.fulfill({
+        response,
+        headers: { ...response.headers(), "content-security-policy-report-only": testCsp }
+      });
+    });
+  }
+
+  return async () => ({
+    tested_policy: testCsp,
+    violations: await page.evaluate(key => window[key] || [], VIOLATIONS_KEY).catch(() => []),
+    issues,
+    security_state: states.length ? states[states.length - 1] : null
+  });
+}
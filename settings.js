@@ -0,0 +1,85 @@
+// Runtime-adjustable service settings. Everything here may be changed through
+// the admin API while captures are running; readers must look values up per
+// use rather than caching them. A config reload resets them to the file values.
+
+import { config, onConfigReload } from "./config.js";
+
+// Hostnames are matched lowercased, so the rules are stored that way
+const lowerRules = rules => rules.map(rule => rule.toLowerCase());
+
+export const settings = {
+  max_concurrency: config.pool.max_concurrency, // captures running at once, all tenants
+  queue_timeout_ms: config.pool.queue_timeout_ms, // how long a capture may wait for a free slot
+  batch_promote_ms: config.pool.batch_promote_ms, // a batch capture waiting this long goes ahead of interactive ones
+  default_timeout_ms: config.limits.default_timeout_ms,
+  max_warm_contexts: config.pool.max_warm_contexts, // use_browser_cache contexts kept in the shared browser
+  reuse_browser: config.pool.reuse_browser, // other captures get a fresh context in the shared browser, not a new Chrome
+  blocked_domains: config.limits.blocked_domains, // subresources aborted during every capture
+  blocked_targets: lowerRules(config.limits.blocked_targets), // hostnames (or ".suffix") that may not be captured at all
+  proxies: config.pool.proxies // [{ server, username?, password?, bypass? }] rotated per browser launch
+};
+
+const VALIDATORS = {
+  max_concurrency: v => Number.isInteger(v) && v > 0,
+  queue_timeout_ms: v => Number.isInteger(v) && v >= 0,
+  batch_promote_ms: v => Number.isInteger(v) && v >= 0,
+  default_timeout_ms: v => Number.isInteger(v) && v > 0,
+  max_warm_contexts: v => Number.isInteger(v) && v >= 0,
+  reuse_browser: v => typeof v === "boolean",
+  blocked_domains: v => Array.isArray(v) && v.every(d => typeof d === "string" && d),
+  blocked_targets: v => Array.isArray(v) && v.every(d => typeof d === "string" && d),
+  proxies: v => Array.isArray(v) && v.every(p => p && typeof p.server === "string")
+};
+
+const listeners = [];
+
+// Register a callback run after settings change (e.g. to resize the queue)
+export function onSettingsChange(fn) {
+  listeners.push(fn);
+}
+
+function checkSettings(patch) {
+  for (const [key, value] of Object.entries(patch)) {
+    if (!(key in VALIDATORS)) throw new Error(`unknown setting: ${key}`);
+    if (!VALIDATORS[key](value)) throw new Error(`invalid value for ${key}`);
+  }
+}
+
+// Validate the whole patch before applying any of it
+export function updateSettings(patch) {
+  checkSettings(patch);
+  Object.assign(settings, patch);
+  if ("blocked_targets" in patch) settings.blocked_targets = lowerRules(patch.blocked_targets);
+  for (const fn of listeners) fn(settings);
+  return settings;
+}
+
+export function isBlockedTarget(hostname) {
+  const host = hostname.toLowerCase();
+  return settings.blocked_targets.some(rule =>
+    rule.startsWith(".") ? host.endsWith(rule) || host === rule.slice(1) : host === rule
+  );
+}
+
+const fromConfig = cfg => ({
+  max_concurrency: cfg.pool.max_concurrency,
+  queue_timeout_ms: cfg.pool.queue_timeout_ms,
+  batch_promote_ms: cfg.pool.batch_promote_ms,
+  max_warm_contexts: cfg.pool.max_warm_contexts,
+  reuse_browser: cfg.pool.reuse_browser,
+  proxies: cfg.pool.proxies,
+  default_timeout_ms: cfg.limits.default_timeout_ms,
+  blocked_domains: cfg.limits.blocked_domains,
+  blocked_targets: cfg.limits.blocked_targets
+});
+
+onConfigReload(cfg => updateSettings(fromConfig(cfg)), cfg => checkSettings(fromConfig(cfg)));
+
+let proxyCursor = 0;
+
+// Round-robin over the proxy pool; undefined when no proxies are configured
+export function nextProxy() {
+  if (settings.proxies.length === 0) return undefined;
+  const proxy = settings.proxies[proxyCursor++ % settings.proxies.length];
+  return { server: proxy.server, username: proxy.username, password: proxy.password, bypass: proxy.bypass };
+}
@@ -0,0 +1,43 @@
+// Shareable links to stored results, signed by the service itself: anyone
+// holding the URL can download the result until it expires, without an API
+// key. The signature is an HMAC-SHA256 over the key and expiry under
+// results.share_secret, so links cannot be forged or extended; rotating the
+// secret revokes every link handed out. Unlike backend-signed URLs these
+// work with every backend, local storage included.
+
+import { createHmac, timingSafeEqual } from "node:crypto";
+import { config } from "./config.js";
+
+export function sharingEnabled() {
+  return !!config.results.share_secret;
+}
+
+function signature(key, expires) {
+  return createHmac("sha256", config.results.share_secret).update(`${key}\n${expires}`).digest("base64url");
+}
+
+// Path (with query) under which a stored key can be fetched until ttlS from now
+export function sharePath(key, ttlS = config.results.share_ttl_s) {
+  const expires = Math.floor(Date.now() / 1000) + ttlS;
+  const path = key.split("/").map(encodeURIComponent).join("/");
+  return {
+    path: `/results/${path}?expires=${expires}&sig=${signature(key, expires)}`,
+    expires_at: new Date(expires * 1000).toISOString()
+  };
+}
+
+// Absolute link: results.public_url when set, else the host the caller used
+export function shareUrl(req, key, ttlS) {
+  const { path, expires_at } = sharePath(key, ttlS);
+  const base = config.results.public_url || `${req.protocol}://${req.get("host")}`;
+  return { url: base.replace(/\/+$/, "") + path, expires_at };
+}
+
+// Whether a presented link is genuine and unexpired
+export function verifyShare(key, expires, sig) {
+  if (!sharingEnabled() || !/^\d+$/.test(expires || "") || typeof sig !== "string") return false;
+  if (Number(expires) * 1000 < Date.now()) return false;
+  const expected = Buffer.from(signature(key, expires));
+  const given = Buffer.from(sig);
+  return given.length === expected.length && timingSafeEqual(given, expected);
+}
@@ -0,0 +1,19 @@
+// Graceful shutdown. Modules holding connections or background work register
+// a hook; on SIGTERM/SIGINT index.js stops accepting requests, runs the hooks
+// newest first (so a queue worker stops before the sinks it feeds) and exits.
+
+const hooks = [];
+
+export function onShutdown(fn) {
+  hooks.push(fn);
+}
+
+export async function runShutdownHooks() {
+  for (const fn of [...hooks].reverse()) {
+    try {
+      await fn();
+    } catch (err) {
+      console.error(`shutdown: ${err.message}`);
+    }
+  }
+}
@@ -0,0 +1,274 @@
+// Result storage. With store: true a capture's output goes to the backend
+// named by results.backend instead of inline in the response:
+//
+//   "local"  files under results.dir (a mounted volume, NFS share, ...)
+//   "s3"     results.bucket; needs @aws-sdk/client-s3 and @aws-sdk/s3-request-presigner
+//   "gcs"    results.bucket; needs @google-cloud/storage
+//   "azure"  container results.bucket; needs @azure/storage-blob and
+//            results.azure_connection_string (AZURE_STORAGE_CONNECTION_STRING)
+//
+// Every backend implements
+//   put(key, body, contentType) -> { key, bytes, path? }
+//   get(key) -> Buffer | null
+//   signUrl(key, ttlS) -> URL string, or null when the backend cannot sign
+//   list() -> [{ key, bytes, created_at }]
+//   remove(key)
+// Keys come from results.path_template below results.prefix; cloud SDKs pick
+// up their credentials the usual way (env, instance metadata, ...).
+
+import { createHash, randomBytes } from "node:crypto";
+import { mkdir, readFile, readdir, rename, stat, unlink, writeFile } from "node:fs/promises";
+import { dirname, join, relative, resolve, sep } from "node:path";
+import { config } from "./config.js";
+
+async function optional(name) {
+  try {
+    return await import(name);
+  } catch (_) {
+    throw new Error(`results.backend = "${config.results.backend}" requires the ${name} package`);
+  }
+}
+
+function localBackend({ dir }) {
+  const root = resolve(dir);
+  const pathOf = key => {
+    const path = resolve(root, key);
+    if (!path.startsWith(root + sep)) throw new Error(`invalid result key: ${key}`);
+    return path;
+  };
+  async function walk(current, out) {
+    for (const entry of await readdir(current, { withFileTypes: true }).catch(() => [])) {
+      const path = join(current, entry.name);
+      if (entry.isDirectory()) await walk(path, out);
+      else if (entry.isFile() && !entry.name.endsWith(".tmp")) {
+        const info = await stat(path);
+        const key = relative(root, path).split(sep).join("/");
+        out.push({ key, bytes: info.size, created_at: info.mtime.toISOString() });
+      }
+    }
+    return out;
+  }
+  return {
+    async put(key, body) {
+      const path = pathOf(key);
+      await mkdir(dirname(path), { recursive: true });
+      // readers never see a half-written file
+      const tmp = `${path}.${randomBytes(6).toString("hex")}.tmp`;
+      await writeFile(tmp, body);
+      await rename(tmp, path);
+      return { key, bytes: body.length, path };
+    },
+    async get(key) {
+      return readFile(pathOf(key)).catch(err => {
+        if (err.code === "ENOENT") return null;
+        throw err;
+      });
+    },
+    async signUrl() {
+      return null;
+    },
+    list: () => walk(root, []),
+    async remove(key) {
+      await unlink(pathOf(key));
+    }
+  };
+}
+
+async function s3Backend({ bucket, region, endpoint }) {
+  const s3 = await optional("@aws-sdk/client-s3");
+  const { getSignedUrl } = await optional("@aws-sdk/s3-request-presigner");
+  const client = new s3.S3Client({
+    region: region || undefined,
+    endpoint: endpoint || undefined,
+    forcePathStyle: !!endpoint // MinIO and friends
+  });
+  return {
+    async put(key, body, contentType) {
+      await client.send(new s3.PutObjectCommand({ Bucket: bucket, Key: key, Body: body, ContentType: contentType }));
+      return { key, bytes: body.length };
+    },
+    async get(key) {
+      try {
+        const out = await client.send(new s3.GetObjectCommand({ Bucket: bucket, Key: key }));
+        return Buffer.from(await out.Body.transformToByteArray());
+      } catch (err) {
+        if (err.name === "NoSuchKey") return null;
+        throw err;
+      }
+    },
+    signUrl: (key, ttlS) =>
+      getSignedUrl(client, new s3.GetObjectCommand({ Bucket: bucket, Key: key }), { expiresIn: ttlS }),
+    async list(prefix) {
+      const out = [];
+      let token;
+      do {
+        const page = await client.send(
+          new s3.ListObjectsV2Command({ Bucket: bucket, Prefix: prefix, ContinuationToken: token })
+        );
+        for (const o of page.Contents || []) {
+          out.push({ key: o.Key, bytes: o.Size, created_at: o.LastModified.toISOString() });
+        }
+        token = page.IsTruncated ? page.NextContinuationToken : undefined;
+      } while (token);
+      return out;
+    },
+    async remove(key) {
+      await client.send(new s3.DeleteObjectCommand({ Bucket: bucket, Key: key }));
+    }
+  };
+}
+
+async function gcsBackend({ bucket }) {
+  const { Storage } = await optional("@google-cloud/storage");
+  const files = new Storage().bucket(bucket);
+  return {
+    async put(key, body, contentType) {
+      await files.file(key).save(body, { contentType, resumable: false });
+      return { key, bytes: body.length };
+    },
+    async get(key) {
+      try {
+        const [data] = await files.file(key).download();
+        return data;
+      } catch (err) {
+        if (err.code === 404) return null;
+        throw err;
+      }
+    },
+    async signUrl(key, ttlS) {
+      const [url] = await files.file(key).getSignedUrl({
+        version: "v4",
+        action: "read",
+        expires: Date.now() + ttlS * 1000
+      });
+      return url;
+    },
+    async list(prefix) {
+      const [found] = await files.getFiles({ prefix });
+      return found.map(f => ({ key: f.name, bytes: Number(f.metadata.size), created_at: f.metadata.timeCreated }));
+    },
+    async remove(key) {
+      await files.file(key).delete();
+    }
+  };
+}
+
+async function azureBackend({ bucket, azure_connection_string }) {
+  const azure = await optional("@azure/storage-blob");
+  if (!azure_connection_string) throw new Error("results.backend = \"azure\" needs results.azure_connection_string");
+  const container = azure.BlobServiceClient.fromConnectionString(azure_connection_string).getContainerClient(bucket);
+  return {
+    async put(key, body, contentType) {
+      await container.getBlockBlobClient(key).uploadData(body, { blobHTTPHeaders: { blobContentType: contentType } });
+      return { key, bytes: body.length };
+    },
+    async get(key) {
+      try {
+        return await container.getBlobClient(key).downloadToBuffer();
+      } catch (err) {
+        if (err.statusCode === 404) return null;
+        throw err;
+      }
+    },
+    // needs an account key in the connection string
+    signUrl: (key, ttlS) => container.getBlobClient(key).generateSasUrl({
+      permissions: azure.BlobSASPermissions.parse("r"),
+      expiresOn: new Date(Date.now() + ttlS * 1000)
+    }),
+    async list(prefix) {
+      const out = [];
+      for await (const blob of container.listBlobsFlat({ prefix })) {
+        const { contentLength, createdOn } = blob.properties;
+        out.push({ key: blob.name, bytes: contentLength, created_at: createdOn.toISOString() });
+      }
+      return out;
+    },
+    async remove(key) {
+      await container.deleteBlob(key);
+    }
+  };
+}
+
+const BACKENDS = { local: localBackend, s3: s3Backend, gcs: gcsBackend, azure: azureBackend };
+
+// results.path_template placeholders. {fanout} spreads files over 65536
+// directories (two levels from the content hash) so none grows huge.
+const PLACEHOLDERS = {
+  tenant: "[^/]+",
+  id: "[^/]+",
+  ext: "[^/]+",
+  host: "[^/]+",
+  hash: "[0-9a-f]{16}",
+  fanout: "[0-9a-f]{2}/[0-9a-f]{2}",
+  date: "\\d{4}-\\d{2}-\\d{2}",
+  time: "\\d{6}"
+};
+
+function checkTemplate(template) {
+  for (const [, name] of template.matchAll(/\{([^}]*)\}/g)) {
+    if (!(name in PLACEHOLDERS)) throw new Error(`results.path_template: unknown placeholder {${name}}`);
+  }
+  if (!/\{(id|hash)\}/.test(template)) throw new Error("results.path_template needs {id} or {hash} to keep keys apart");
+  if (template.startsWith("/") || template.split("/").includes("..")) {
+    throw new Error("results.path_template must be a relative path");
+  }
+}
+
+// The key for one stored artifact, from results.path_template
+export function resultKey({ tenant, id, ext, host, body, at = new Date() }) {
+  const template = config.results.path_template;
+  checkTemplate(template);
+  const hash = createHash("sha256").update(body).digest("hex");
+  const iso = at.toISOString();
+  const values = {
+    tenant,
+    id,
+    ext,
+    host: host.replace(/[^a-z0-9.-]/gi, "_"),
+    hash: hash.slice(0, 16),
+    fanout: `${hash.slice(0, 2)}/${hash.slice(2, 4)}`,
+    date: iso.slice(0, 10),
+    time: iso.slice(11, 19).replace(/:/g, "")
+  };
+  return template.replace(/\{(\w+)\}/g, (_, name) => values[name]);
+}
+
+// Which tenant a stored key belongs to; null when the template has no {tenant}
+export function tenantOfKey(key) {
+  const template = config.results.path_template;
+  const pattern = template.split(/(\{\w+\})/).map(part => {
+    const m = /^\{(\w+)\}$/.exec(part);
+    if (!m) return part.replace(/[.*+?^$()|[\]\\]/g, "\\$&");
+    return m[1] === "tenant" ? "(?<tenant>[^/]+)" : `(?:${PLACEHOLDERS[m[1]]})`;
+  }).join("");
+  return new RegExp(`^${pattern}$`).exec(key)?.groups?.tenant ?? null;
+}
+
+export function storageEnabled() {
+  return !!config.results.backend;
+}
+
+let backendPromise = null;
+
+// The configured backend, with results.prefix applied to every key
+export function resultStorage() {
+  if (!backendPromise) {
+    const factory = BACKENDS[config.results.backend];
+    if (!factory) return Promise.reject(new Error(`unknown results.backend: ${config.results.backend}`));
+    const prefix = config.results.prefix;
+    backendPromise = Promise.resolve(factory(config.results)).then(backend => ({
+      name: config.results.backend,
+      put: async (key, body, contentType) => ({ ...(await backend.put(prefix + key, body, contentType)), key }),
+      get: key => backend.get(prefix + key),
+      signUrl: (key, ttlS = config.results.url_ttl_s) => backend.signUrl(prefix + key, ttlS),
+      list: async () => (await backend.list(prefix))
+        .filter(item => item.key.startsWith(prefix))
+        .map(item => ({ ...item, key: item.key.slice(prefix.length) })),
+      remove: key => backend.remove(prefix + key)
+    }), err => {
+      backendPromise = null;
+      throw err;
+    });
+  }
+  return backendPromise;
+}
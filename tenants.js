@@ -0,0 +1,183 @@
+// Multi-tenant API keys, per-tenant concurrency and monthly quotas.
+//
+// auth.tenants_file (TENANTS_FILE) is a JSON list of
+//   { id, api_keys: [...], client_certs: [...], max_concurrency, monthly_requests,
+//     monthly_pixels, retention: { ttl_days, max_count, max_bytes } }
+// client_certs lists certificate subject CNs or SHA-256 fingerprints
+// ("AB:CD:..."); a client certificate the HTTPS listener verified
+// (server.tls_client_auth) that matches one stands in for an API key.
+// (limits of 0/absent mean unlimited; retention overrides the [retention] defaults). Without it the service stays open and
+// every caller is the "default" tenant. Usage is kept per calendar month (UTC)
+// and persisted to storage.usage_file (USAGE_FILE) when set.
+
+import { existsSync, readFileSync, writeFileSync, renameSync } from "node:fs";
+import { config, onConfigReload } from "./config.js";
+import { sendError } from "./errors.js";
+
+const DEFAULT_TENANT = {
+  id: "default", api_keys: [], client_certs: [], max_concurrency: 0, monthly_requests: 0, monthly_pixels: 0
+};
+
+let tenants = [];
+const byKey = new Map();
+const byCert = new Map();
+const active = new Map();
+let usage = {};
+let saveTimer = null;
+
+export function loadTenants(list) {
+  tenants = list.map(t => ({ ...DEFAULT_TENANT, ...t }));
+  byKey.clear();
+  byCert.clear();
+  for (const t of tenants) {
+    for (const key of t.api_keys) byKey.set(key, t);
+    for (const cert of t.client_certs) byCert.set(cert.toUpperCase(), t);
+  }
+}
+
+function readTenantsFile(cfg) {
+  if (!cfg.auth.tenants_file) return [];
+  const list = JSON.parse(readFileSync(cfg.auth.tenants_file, "utf8"));
+  const strings = v => v === undefined || (Array.isArray(v) && v.every(s => typeof s === "string"));
+  if (!Array.isArray(list) || !list.every(t => t && typeof t === "object" && strings(t.api_keys) &&
+      strings(t.client_certs))) {
+    throw new Error(`${cfg.auth.tenants_file}: expected a list of tenants, api_keys and client_certs lists of strings`);
+  }
+  return list;
+}
+
+loadTenants(readTenantsFile(config));
+onConfigReload(cfg => loadTenants(readTenantsFile(cfg)), readTenantsFile);
+if (config.storage.usage_file && existsSync(config.storage.usage_file)) {
+  usage = JSON.parse(readFileSync(config.storage.usage_file, "utf8"));
+}
+
+export function tenantsEnabled() {
+  return tenants.length > 0;
+}
+
+export function findTenant(id) {
+  return tenants.find(t => t.id === id) || null;
+}
+
+function currentMonth() {
+  return new Date().toISOString().slice(0, 7);
+}
+
+function usageFor(tenantId) {
+  const month = currentMonth();
+  usage[month] ||= {};
+  return (usage[month][tenantId] ||= { requests: 0, pixels: 0, failed: 0, transfer_bytes: 0 });
+}
+
+function persistUsage() {
+  if (!config.storage.usage_file || saveTimer) return;
+  // coalesce bursts of updates into one write
+  saveTimer = setTimeout(() => {
+    saveTimer = null;
+    const tmp = `${config.storage.usage_file}.tmp`;
+    writeFileSync(tmp, JSON.stringify(usage));
+    renameSync(tmp, config.storage.usage_file);
+  }, 1000);
+}
+
+function apiKeyFrom(req) {
+  const auth = req.get("authorization") || "";
+  if (auth.toLowerCase().startsWith("bearer ")) return auth.slice(7).trim();
+  return req.get("x-api-key") || null;
+}
+
+// The client certificate the TLS listener verified against server.tls_client_ca_file;
+// null over plain HTTP, without a certificate, or when verification failed
+export function clientCert(req) {
+  const socket = req.socket;
+  if (!socket.authorized || typeof socket.getPeerCertificate !== "function") return null;
+  const cert = socket.getPeerCertificate();
+  if (!cert || !cert.fingerprint256) return null;
+  return { subject: cert.subject?.CN ?? null, fingerprint256: cert.fingerprint256 };
+}
+
+function tenantOfCert(cert) {
+  if (!cert) return null;
+  return byCert.get(cert.fingerprint256.toUpperCase()) ||
+    (cert.subject && byCert.get(cert.subject.toUpperCase())) || null;
+}
+
+// Resolve the caller's tenant by API key, else by verified client certificate;
+// 401 on unknown callers when tenants are configured
+export function authenticate(req, res, next) {
+  req.client_cert = clientCert(req);
+  if (!tenantsEnabled()) {
+    req.tenant = DEFAULT_TENANT;
+    return next();
+  }
+  const key = apiKeyFrom(req);
+  const tenant = key ? byKey.get(key) : tenantOfCert(req.client_cert);
+  if (!tenant) return sendError(res, 401, "unauthorized", "invalid or missing API key");
+  req.tenant = tenant;
+  next();
+}
+
+// Enforce quotas and the tenant's concurrency cap for one capture
+export function admitCapture(req, res, next) {
+  const tenant = req.tenant;
+  const used = usageFor(tenant.id);
+  if (tenant.monthly_requests && used.requests >= tenant.monthly_requests) {
+    return sendError(res, 429, "quota_exceeded", "monthly request quota exhausted");
+  }
+  if (tenant.monthly_pixels && used.pixels >= tenant.monthly_pixels) {
+    return sendError(res, 429, "quota_exceeded", "monthly pixel quota exhausted");
+  }
+  const running = active.get(tenant.id) || 0;
+  if (tenant.max_concurrency && running >= tenant.max_concurrency) {
+    res.set("Retry-After", "5");
+    return sendError(res, 429, "concurrency_limited", "tenant concurrency limit reached");
+  }
+
+  active.set(tenant.id, running + 1);
+  used.requests++;
+  persistUsage();
+  let done = false;
+  const finish = () => {
+    if (done) return;
+    done = true;
+    active.set(tenant.id, (active.get(tenant.id) || 1) - 1);
+    if (res.statusCode >= 500) {
+      usageFor(tenant.id).failed++;
+      persistUsage();
+    }
+  };
+  res.on("finish", finish);
+  res.on("close", finish);
+  next();
+}
+
+// Pixels are billed once the capture size is known
+export function chargePixels(tenant, pixels) {
+  if (!tenant) return;
+  usageFor(tenant.id).pixels += pixels;
+  persistUsage();
+}
+
+// Bytes downloaded on the tenant's behalf (proxy bandwidth)
+export function chargeTransfer(tenant, bytes) {
+  if (!tenant || !bytes) return;
+  const used = usageFor(tenant.id);
+  used.transfer_bytes = (used.transfer_bytes || 0) + bytes;
+  persistUsage();
+}
+
+export function usageReport(tenant, month = currentMonth()) {
+  const used = { transfer_bytes: 0, ...(usage[month]?.[tenant.id] || { requests: 0, pixels: 0, failed: 0 }) };
+  return {
+    tenant: tenant.id,
+    month,
+    usage: used,
+    limits: {
+      max_concurrency: tenant.max_concurrency || null,
+      monthly_requests: tenant.monthly_requests || null,
+      monthly_pixels: tenant.monthly_pixels || null
+    },
+    in_flight: active.get(tenant.id) || 0
+  };
+}
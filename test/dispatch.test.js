@@ -0,0 +1,30 @@
+import { test } from "node:test";
+import assert from "node:assert/strict";
+import { parseConstraints, requestConstraints, satisfies } from "../dispatch.js";
+
+test("parseConstraints normalizes needs", () => {
+  assert.equal(parseConstraints(null), null);
+  assert.deepEqual(parseConstraints({ region: "eu", needs: "stealth" }), { region: "eu", needs: ["stealth"] });
+  assert.deepEqual(parseConstraints({ chrome: "124" }), { chrome: "124", needs: [] });
+  assert.throws(() => parseConstraints(["eu"]), /must be an object/);
+  assert.throws(() => parseConstraints({ region: "" }), /constraints\.region/);
+  assert.throws(() => parseConstraints({ needs: [1] }), /constraints\.needs/);
+});
+
+test("capture_region folds into region", () => {
+  assert.deepEqual(requestConstraints({ capture_region: "DE" }), { needs: [], region: "de" });
+  assert.deepEqual(requestConstraints({ capture_region: "de", constraints: { region: "DE", needs: ["gpu"] } }),
+    { region: "de", needs: ["gpu"] });
+  assert.throws(() => requestConstraints({ capture_region: "de", constraints: { region: "us" } }), /contradicts/);
+  assert.throws(() => requestConstraints({ capture_region: "de/1" }), /capture_region/);
+  assert.equal(requestConstraints({}), null);
+});
+
+test("satisfies", () => {
+  const tags = ["region:eu", "stealth", "chrome:124"];
+  assert.equal(satisfies(null, []), true);
+  assert.equal(satisfies({ region: "eu", needs: ["stealth"] }, tags), true);
+  assert.equal(satisfies({ region: "us", needs: [] }, tags), false);
+  assert.equal(satisfies({ needs: ["gpu"] }, tags), false);
+  assert.equal(satisfies({ chrome: "124", needs: [] }, tags), true);
+});
@@ -0,0 +1,59 @@
+import { test } from "node:test";
+import assert from "node:assert/strict";
+import { extractFields, fieldSpecs, queryJsonPath } from "../fields.js";
+import { parseNumber } from "../extract.js";
+
+// Just enough of a Playwright page for extractFields: every selector yields values
+const pageOf = values => ({ $$: async () => [], evaluate: async () => values });
+
+test("parseNumber reads common groupings", () => {
+  assert.equal(parseNumber("$1,299.00"), 1299);
+  assert.equal(parseNumber("1.299,00 €"), 1299);
+  assert.equal(parseNumber("CHF 1'299.50"), 1299.5);
+  assert.equal(parseNumber("1,5 kg"), 1.5);
+  assert.equal(parseNumber("1.000.000"), 1000000);
+  assert.equal(parseNumber("-3"), -3);
+  assert.equal(parseNumber("n/a"), null);
+});
+
+test("queryJsonPath", () => {
+  const doc = { "@graph": [{ offers: { price: "9.99" } }, { offers: { price: "19.99" } }], name: "x" };
+  assert.equal(queryJsonPath(doc, "$.name"), "x");
+  assert.equal(queryJsonPath(doc, "$['@graph'][1].offers.price"), "19.99");
+  assert.deepEqual(queryJsonPath(doc, "$['@graph'][*].offers.price"), ["9.99", "19.99"]);
+  assert.deepEqual(queryJsonPath(doc, "$..price"), ["9.99", "19.99"]);
+  assert.equal(queryJsonPath(doc, "$.missing"), undefined);
+  assert.throws(() => queryJsonPath(doc, "name"), /must start with "\$"/);
+});
+
+test("fieldSpecs defaults and validation", () => {
+  const specs = fieldSpecs({ title: "h1", price: { selector: ".p", regex: "([\\d.]+)" } });
+  assert.deepEqual(specs.title,
+    { attribute: "text", all: false, trim: true, group: 0, type: "string", selector: "h1" });
+  assert.equal(specs.price.group, 1);
+  assert.equal(fieldSpecs({ a: { selector: "x", regex: "\\d+" } }).a.group, 0);
+  assert.throws(() => fieldSpecs({ a: { selector: "x", regex: "(" } }), /extract\.a\.regex/);
+  assert.throws(() => fieldSpecs({ a: { selector: "x", type: "money" } }), /extract\.a\.type/);
+  assert.throws(() => fieldSpecs([]), /must be an object/);
+});
+
+test("post-processing: trim, regex group, JSONPath and types", async () => {
+  const specs = fieldSpecs({
+    price: { selector: "x", regex: "Price:\\s*(?<amount>[\\d,.]+)", group: "amount", type: "number" },
+    count: { selector: "x", regex: "\\d+", type: "integer", all: true },
+    json: { selector: "x", json_path: "$.offers.price", type: "number" },
+    flag: { selector: "x", type: "boolean" }
+  });
+  const field = async (name, values) => (await extractFields(pageOf(values), { [name]: specs[name] })).fields[name];
+  assert.equal(await field("price", ["  Price:  1,299.50 "]), 1299.5);
+  assert.deepEqual(await field("count", ["7", "nope", "12"]), [7, 12]);
+  assert.equal(await field("json", ["{\"offers\":{\"price\":\"5\"}}"]), 5);
+  assert.equal(await field("flag", ["Yes"]), true);
+});
+
+test("a runaway regex is cut off and reported per field", async () => {
+  const specs = fieldSpecs({ slow: { selector: "x", regex: "^(a+)+$" } });
+  const { fields, errors } = await extractFields(pageOf(["a".repeat(40) + "b"]), specs);
+  assert.equal(fields.slow, null);
+  assert.match(errors.slow, /regex ran longer than/);
+});
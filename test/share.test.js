@@ -0,0 +1,47 @@
+import { test, afterEach } from "node:test";
+import assert from "node:assert/strict";
+import { config } from "../config.js";
+import { sharePath, verifyShare } from "../share.js";
+
+const secret = config.results.share_secret;
+afterEach(() => {
+  config.results.share_secret = secret;
+});
+
+function link(key, ttlS) {
+  const url = new URL(sharePath(key, ttlS).path, "http://scraper");
+  return {
+    path: decodeURIComponent(url.pathname),
+    expires: url.searchParams.get("expires"),
+    sig: url.searchParams.get("sig")
+  };
+}
+
+test("a fresh link verifies for its key only", () => {
+  config.results.share_secret = "s3cret";
+  const { path, expires, sig } = link("acme/job 1.png", 60);
+  assert.equal(path, "/results/acme/job 1.png");
+  assert.equal(verifyShare("acme/job 1.png", expires, sig), true);
+  assert.equal(verifyShare("acme/job 2.png", expires, sig), false);
+  assert.equal(verifyShare("acme/job 1.png", String(Number(expires) + 1), sig), false);
+  assert.equal(verifyShare("acme/job 1.png", expires, sig.slice(1)), false);
+});
+
+test("expired links, a rotated secret and disabled sharing all fail", () => {
+  config.results.share_secret = "s3cret";
+  const expired = link("k", -10);
+  assert.equal(verifyShare("k", expired.expires, expired.sig), false);
+  const live = link("k", 60);
+  config.results.share_secret = "rotated";
+  assert.equal(verifyShare("k", live.expires, live.sig), false);
+  config.results.share_secret = "";
+  assert.equal(verifyShare("k", live.expires, live.sig), false);
+});
+
+test("malformed parameters are rejected", () => {
+  config.results.share_secret = "s3cret";
+  const { expires, sig } = link("k", 60);
+  assert.equal(verifyShare("k", `${expires}x`, sig), false);
+  assert.equal(verifyShare("k", undefined, sig), false);
+  assert.equal(verifyShare("k", expires, undefined), false);
+});
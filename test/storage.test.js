@@ -0,0 +1,46 @@
+import { test, afterEach } from "node:test";
+import assert from "node:assert/strict";
+import { config } from "../config.js";
+import { resultKey, tenantOfKey } from "../storage.js";
+
+const template = config.results.path_template;
+afterEach(() => {
+  config.results.path_template = template;
+});
+
+const at = new Date("2024-01-02T03:04:05Z");
+const body = Buffer.from("result");
+
+test("resultKey fills every placeholder", () => {
+  config.results.path_template = "{tenant}/{date}/{time}/{host}/{fanout}/{hash}-{id}.{ext}";
+  const key = resultKey({ tenant: "acme", id: "job1", ext: "png", host: "shop.example.com:8443", body, at });
+  assert.match(key, /^acme\/2024-01-02\/030405\/shop\.example\.com_8443\/[0-9a-f]{2}\/[0-9a-f]{2}\//);
+  assert.match(key, /\/[0-9a-f]{16}-job1\.png$/);
+  const [, , , , a, b, file] = key.split("/");
+  assert.equal(file.slice(0, 4), a + b);
+});
+
+test("resultKey rejects bad templates", () => {
+  const cases = [
+    ["{tenant}/{nope}.{ext}", /unknown placeholder/],
+    ["{tenant}.{ext}", /needs \{id\} or \{hash\}/],
+    ["/abs/{id}", /relative path/],
+    ["../{id}", /relative path/]
+  ];
+  for (const [bad, message] of cases) {
+    config.results.path_template = bad;
+    assert.throws(() => resultKey({ tenant: "t", id: "i", ext: "png", host: "h", body, at }), message);
+  }
+});
+
+test("tenantOfKey reads the tenant back out of a key", () => {
+  config.results.path_template = "{date}/{tenant}/{fanout}/{hash}.{ext}";
+  const key = resultKey({ tenant: "acme", id: "job1", ext: "zip", host: "h", body, at });
+  assert.equal(tenantOfKey(key), "acme");
+  assert.equal(tenantOfKey("not/a/matching/key"), null);
+});
+
+test("tenantOfKey is null without {tenant}", () => {
+  config.results.path_template = "{host}/{id}.{ext}";
+  assert.equal(tenantOfKey("example.com/job1.png"), null);
+});
@@ -0,0 +1,44 @@
+import { test } from "node:test";
+import assert from "node:assert/strict";
+import { parseToml } from "../toml.js";
+
+test("tables, dotted keys and scalar values", () => {
+  const parsed = parseToml(`
+# comment
+title = "scraper"  # trailing comment
+[server]
+port = 8090
+ratio = 0.5
+tls = false
+a.b = "dotted"
+`);
+  assert.deepEqual(parsed, { title: "scraper", server: { port: 8090, ratio: 0.5, tls: false, a: { b: "dotted" } } });
+});
+
+test("multi-line arrays, inline tables and arrays of tables", () => {
+  const parsed = parseToml(`
+[pool]
+proxies = [
+  { server = "http://a:1", username = "u" },
+  { server = "http://b:2" },
+]
+[[dispatch.peers]]
+url = "http://eu:8090"
+tags = ["region:eu"]
+[[dispatch.peers]]
+url = "http://us:8090"
+`);
+  assert.deepEqual(parsed.pool.proxies, [{ server: "http://a:1", username: "u" }, { server: "http://b:2" }]);
+  assert.deepEqual(parsed.dispatch.peers, [{ url: "http://eu:8090", tags: ["region:eu"] }, { url: "http://us:8090" }]);
+});
+
+test("string escapes", () => {
+  assert.equal(parseToml(String.raw`s = "a\"b\n\tc"`).s, "a\"b\n\tc");
+  assert.equal(parseToml("s = 'C:\\raw'").s, "C:\\raw");
+});
+
+test("errors name the line", () => {
+  assert.throws(() => parseToml("a = 1\na = 2"), /line 2: duplicate key a/);
+  assert.throws(() => parseToml("a = \"open"), /line 1: unterminated string/);
+  assert.throws(() => parseToml("a = 1\nb = [1 2]"), /line 2/);
+});
@@ -0,0 +1,49 @@
+import { test } from "node:test";
+import assert from "node:assert/strict";
+import { gunzipSync } from "node:zlib";
+import { createWarc } from "../warc.js";
+
+const exchange = {
+  url: "https://example.com/page?q=1",
+  method: "GET",
+  requestHeaders: { "user-agent": "test" },
+  postData: null,
+  status: 200,
+  statusText: "OK",
+  responseHeaders: { "content-type": "text/html", "content-encoding": "gzip", ":status": "200" },
+  body: Buffer.from("<html>hi</html>"),
+  date: "2024-01-02T03:04:05.000Z"
+};
+
+// gunzip handles the concatenated members in one go
+function records(warc) {
+  return gunzipSync(warc).toString("latin1").split(/\r\n\r\n(?=WARC\/1\.1\r\n)/);
+}
+
+test("writes warcinfo, then response and request per exchange", () => {
+  const out = records(createWarc([exchange], { software: "scraper/1", filename: "x.warc.gz", date: exchange.date }));
+  assert.equal(out.length, 3);
+  assert.match(out[0], /^WARC\/1\.1\r\nWARC-Type: warcinfo\r\n/);
+  assert.match(out[0], /WARC-Filename: x\.warc\.gz/);
+  assert.match(out[0], /software: scraper\/1/);
+  assert.match(out[1], /WARC-Type: response/);
+  assert.match(out[1], /WARC-Target-URI: https:\/\/example\.com\/page\?q=1/);
+  assert.match(out[2], /WARC-Type: request/);
+  assert.match(out[2], /GET \/page\?q=1 HTTP\/1\.1\r\nHost: example\.com\r\n/);
+  const responseId = /WARC-Record-ID: (<urn:uuid:[^>]+>)/.exec(out[1])[1];
+  assert.ok(out[2].includes(`WARC-Concurrent-To: ${responseId}`));
+});
+
+test("drops headers that no longer describe the decoded body", () => {
+  const [, response] = records(createWarc([exchange], { software: "s", filename: "f" }));
+  assert.match(response, /HTTP\/1\.1 200 OK\r\ncontent-type: text\/html\r\nContent-Length: 15\r\n\r\n<html>hi<\/html>/);
+  assert.doesNotMatch(response, /content-encoding|:status/);
+});
+
+test("block lengths match the blocks", () => {
+  for (const record of records(createWarc([exchange], { software: "s", filename: "f" }))) {
+    const [head, ...rest] = record.split("\r\n\r\n");
+    const length = Number(/Content-Length: (\d+)/.exec(head)[1]);
+    assert.equal(Buffer.byteLength(rest.join("\r\n\r\n").replace(/\r\n\r\n$/, ""), "latin1"), length);
+  }
+});
@@ -0,0 +1,73 @@
+import { test } from "node:test";
+import assert from "node:assert/strict";
+import { crc32 } from "node:zlib";
+import { buildXmpPacket, embedXmp } from "../xmp.js";
+
+const packet = buildXmpPacket({
+  url: "https://example.com/?a=1&b=<2>",
+  captured_at: "2024-01-02T03:04:05.000Z",
+  viewport: { width: 1280, height: 800 },
+  software: "scraper/1"
+});
+
+function pngChunks(buf) {
+  const chunks = [];
+  for (let offset = 8; offset < buf.length;) {
+    const len = buf.readUInt32BE(offset);
+    const type = buf.toString("latin1", offset + 4, offset + 8);
+    const data = buf.subarray(offset + 8, offset + 8 + len);
+    const crc = buf.readUInt32BE(offset + 8 + len);
+    chunks.push({ type, data, crc, typeAndData: buf.subarray(offset + 4, offset + 8 + len) });
+    offset += 12 + len;
+  }
+  return chunks;
+}
+
+function chunk(type, data = Buffer.alloc(0)) {
+  const out = Buffer.alloc(12 + data.length);
+  out.writeUInt32BE(data.length, 0);
+  out.write(type, 4, "latin1");
+  data.copy(out, 8);
+  out.writeUInt32BE(crc32(out.subarray(4, 8 + data.length)), 8 + data.length);
+  return out;
+}
+
+test("packet escapes values", () => {
+  assert.ok(packet.includes("dc:source=\"https://example.com/?a=1&amp;b=&lt;2&gt;\""));
+  assert.ok(packet.includes("xmp:CreateDate=\"2024-01-02T03:04:05.000Z\""));
+  assert.ok(packet.includes("scrape:ViewportWidth=\"1280\""));
+});
+
+test("PNG: iTXt chunk with a valid CRC goes ahead of the first IDAT", () => {
+  const png = Buffer.concat([
+    Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]),
+    chunk("IHDR", Buffer.alloc(13)),
+    chunk("IDAT", Buffer.from([1, 2, 3])),
+    chunk("IEND")
+  ]);
+  const chunks = pngChunks(embedXmp(png, "png", packet));
+  assert.deepEqual(chunks.map(c => c.type), ["IHDR", "iTXt", "IDAT", "IEND"]);
+  const itxt = chunks[1];
+  assert.equal(itxt.crc, crc32(itxt.typeAndData));
+  assert.ok(itxt.data.toString("utf8").startsWith("XML:com.adobe.xmp\0"));
+  assert.ok(itxt.data.toString("utf8").endsWith(packet));
+});
+
+test("JPEG: APP1 XMP segment after the leading APPn segments", () => {
+  const app0 = Buffer.from([0xff, 0xe0, 0x00, 0x04, 0x4a, 0x46]);
+  const jpeg = Buffer.concat([Buffer.from([0xff, 0xd8]), app0, Buffer.from([0xff, 0xdb, 0x00, 0x02, 0xff, 0xd9])]);
+  const out = embedXmp(jpeg, "jpeg", packet);
+  assert.deepEqual(out.subarray(0, 8), Buffer.concat([Buffer.from([0xff, 0xd8]), app0]));
+  assert.deepEqual([out[8], out[9]], [0xff, 0xe1]);
+  const length = out.readUInt16BE(10);
+  const segment = out.subarray(12, 10 + length).toString("utf8");
+  assert.ok(segment.startsWith("http://ns.adobe.com/xap/1.0/\0"));
+  assert.ok(segment.endsWith(packet));
+  assert.deepEqual(out.subarray(10 + length), Buffer.from([0xff, 0xdb, 0x00, 0x02, 0xff, 0xd9]));
+});
+
+test("other formats and non-PNG bytes pass through", () => {
+  const buf = Buffer.from("RIFF....WEBP");
+  assert.equal(embedXmp(buf, "webp", packet), buf);
+  assert.equal(embedXmp(buf, "png", packet), buf);
+});
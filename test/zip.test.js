@@ -0,0 +1,57 @@
+import { test } from "node:test";
+import assert from "node:assert/strict";
+import { crc32, inflateRawSync } from "node:zlib";
+import { createZip } from "../zip.js";
+
+// Entries by name, read back through the central directory
+function readZip(buf) {
+  const end = buf.lastIndexOf(Buffer.from([0x50, 0x4b, 0x05, 0x06]));
+  const count = buf.readUInt16LE(end + 10);
+  let offset = buf.readUInt32LE(end + 16);
+  const out = {};
+  for (let i = 0; i < count; i++) {
+    assert.equal(buf.readUInt32LE(offset), 0x02014b50);
+    const method = buf.readUInt16LE(offset + 10);
+    const crc = buf.readUInt32LE(offset + 16);
+    const size = buf.readUInt32LE(offset + 20);
+    const nameLength = buf.readUInt16LE(offset + 28);
+    const local = buf.readUInt32LE(offset + 42);
+    const name = buf.toString("utf8", offset + 46, offset + 46 + nameLength);
+    assert.equal(buf.readUInt32LE(local), 0x04034b50);
+    const start = local + 30 + buf.readUInt16LE(local + 26);
+    const body = buf.subarray(start, start + size);
+    const data = method === 8 ? inflateRawSync(body) : body;
+    assert.equal(crc32(data), crc);
+    out[name] = { method, data };
+    offset += 46 + nameLength;
+  }
+  return out;
+}
+
+test("round-trips text and binary entries", () => {
+  const png = Buffer.from([0x89, 0x50, 0x4e, 0x47, 1, 2, 3]);
+  const entries = readZip(createZip([
+    { name: "metadata.json", data: JSON.stringify({ url: "https://example.com" }) },
+    { name: "tiles/tile-000.png", data: png },
+    { name: "ünïcode.txt", data: "x".repeat(1000) }
+  ]));
+  assert.deepEqual(Object.keys(entries), ["metadata.json", "tiles/tile-000.png", "ünïcode.txt"]);
+  assert.equal(entries["metadata.json"].data.toString(), "{\"url\":\"https://example.com\"}");
+  assert.deepEqual(entries["tiles/tile-000.png"].data, png);
+  assert.equal(entries["ünïcode.txt"].data.toString(), "x".repeat(1000));
+});
+
+test("stores already-compressed formats and deflates the rest", () => {
+  const entries = readZip(createZip([
+    { name: "screenshot.jpg", data: Buffer.alloc(100) },
+    { name: "page.html", data: "<p>".repeat(100) }
+  ]));
+  assert.equal(entries["screenshot.jpg"].method, 0);
+  assert.equal(entries["page.html"].method, 8);
+});
+
+test("an empty archive is just the end record", () => {
+  const zip = createZip([]);
+  assert.equal(zip.length, 22);
+  assert.equal(zip.readUInt32LE(0), 0x06054b50);
+});
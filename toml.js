@@ -0,0 +1,171 @@
+// TOML subset parser for the service config: tables, arrays of tables, dotted
+// keys, strings, numbers, booleans, (multi-line) arrays and inline tables.
+// Dates and multi-line strings are not supported.
+
+class Parser {
+  constructor(src) {
+    this.src = src;
+    this.pos = 0;
+    this.line = 1;
+  }
+
+  fail(msg) {
+    throw new Error(`config line ${this.line}: ${msg}`);
+  }
+
+  peek() {
+    return this.src[this.pos];
+  }
+
+  next() {
+    const c = this.src[this.pos++];
+    if (c === "\n") this.line++;
+    return c;
+  }
+
+  // Spaces/tabs; with newlines, also blank lines and comments
+  skip(newlines = false) {
+    while (this.pos < this.src.length) {
+      const c = this.peek();
+      if (c === " " || c === "\t" || c === "\r") this.next();
+      else if (c === "#") while (this.pos < this.src.length && this.peek() !== "\n") this.next();
+      else if (newlines && c === "\n") this.next();
+      else break;
+    }
+  }
+
+  key() {
+    const parts = [];
+    do {
+      this.skip();
+      const c = this.peek();
+      if (c === '"' || c === "'") parts.push(this.string());
+      else {
+        const m = /^[A-Za-z0-9_-]+/.exec(this.src.slice(this.pos));
+        if (!m) this.fail("expected a key");
+        this.pos += m[0].length;
+        parts.push(m[0]);
+      }
+      this.skip();
+    } while (this.peek() === "." && this.next());
+    return parts;
+  }
+
+  string() {
+    const quote = this.next();
+    let out = "";
+    while (true) {
+      const c = this.next();
+      if (c === undefined || c === "\n") this.fail("unterminated string");
+      if (c === quote) return out;
+      if (c === "\\" && quote === '"') {
+        const e = this.next();
+        const map = { n: "\n", t: "\t", r: "\r", '"': '"', "\\": "\\", b: "\b", f: "\f" };
+        if (e in map) out += map[e];
+        else if (e === "u" || e === "U") {
+          const len = e === "u" ? 4 : 8;
+          out += String.fromCodePoint(parseInt(this.src.slice(this.pos, this.pos + len), 16));
+          this.pos += len;
+        } else this.fail(`bad escape \\${e}`);
+      } else out += c;
+    }
+  }
+
+  value() {
+    this.skip();
+    const c = this.peek();
+    if (c === '"' || c === "'") return this.string();
+    if (c === "[") {
+      this.next();
+      const arr = [];
+      while (true) {
+        this.skip(true);
+        if (this.peek() === "]") { this.next(); return arr; }
+        arr.push(this.value());
+        this.skip(true);
+        if (this.peek() === ",") this.next();
+        else if (this.peek() !== "]") this.fail("expected , or ] in array");
+      }
+    }
+    if (c === "{") {
+      this.next();
+      const table = {};
+      this.skip();
+      if (this.peek() === "}") { this.next(); return table; }
+      while (true) {
+        const k = this.key();
+        if (this.next() !== "=") this.fail("expected =");
+        assign(table, k, this.value(), this);
+        this.skip();
+        const d = this.next();
+        if (d === "}") return table;
+        if (d !== ",") this.fail("expected , or } in inline table");
+      }
+    }
+    const m = /^[^\s,\]}#]+/.exec(this.src.slice(this.pos));
+    if (!m) this.fail("expected a value");
+    this.pos += m[0].length;
+    const raw = m[0];
+    if (raw === "true") return true;
+    if (raw === "false") return false;
+    const num = raw.replace(/_/g, "");
+    if (/^[+-]?(\d+|0x[0-9a-f]+|0o[0-7]+|0b[01]+)$/i.test(num)) return Number(num);
+    if (/^[+-]?(\d+\.?\d*([eE][+-]?\d+)?|inf|nan)$/.test(num)) {
+      return num.endsWith("inf") ? (num.startsWith("-") ? -Infinity : Infinity) : Number(num);
+    }
+    this.fail(`unsupported value ${raw}`);
+  }
+}
+
+function assign(table, path, value, parser) {
+  let t = table;
+  for (const part of path.slice(0, -1)) {
+    t[part] ??= {};
+    if (typeof t[part] !== "object" || Array.isArray(t[part])) parser.fail(`${part} is not a table`);
+    t = t[part];
+  }
+  const last = path[path.length - 1];
+  if (last in t) parser.fail(`duplicate key ${path.join(".")}`);
+  t[last] = value;
+}
+
+function tableAt(root, path, parser, arrayOfTables) {
+  let t = root;
+  path.forEach((part, i) => {
+    const isLast = i === path.length - 1;
+    if (isLast && arrayOfTables) {
+      t[part] ??= [];
+      if (!Array.isArray(t[part])) parser.fail(`${part} is not an array of tables`);
+      t[part].push({});
+      t = t[part][t[part].length - 1];
+      return;
+    }
+    t[part] ??= {};
+    t = Array.isArray(t[part]) ? t[part][t[part].length - 1] : t[part];
+  });
+  return t;
+}
+
+export function parseToml(src) {
+  const p = new Parser(src);
+  const root = {};
+  let current = root;
+  while (true) {
+    p.skip(true);
+    if (p.pos >= src.length) return root;
+    if (p.peek() === "[") {
+      p.next();
+      const array = p.peek() === "[";
+      if (array) p.next();
+      const path = p.key();
+      if (p.next() !== "]" || (array && p.next() !== "]")) p.fail("unterminated table header");
+      current = tableAt(root, path, p, array);
+    } else {
+      const k = p.key();
+      if (p.next() !== "=") p.fail("expected =");
+      assign(current, k, p.value(), p);
+    }
+    p.skip();
+    if (p.pos < src.length && p.peek() !== "\n") p.fail("expected end of line");
+  }
+}
@@ -0,0 +1,61 @@
+// OpenTelemetry tracing. Enabled when tracing.enabled is set or the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT / OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables
+// are present; exporters, sampling and resource attributes are then configured
+// by the usual OTEL_* environment variables read by @opentelemetry/sdk-node.
+// Without the OpenTelemetry packages installed every helper is a no-op.
+
+import { config } from "./config.js";
+import { onShutdown } from "./shutdown.js";
+
+const wanted = config.tracing.enabled ||
+  !!(process.env.OTEL_EXPORTER_OTLP_ENDPOINT || process.env.OTEL_EXPORTER_OTLP_TRACES_ENDPOINT);
+
+let api = null;
+let tracer = null;
+
+if (wanted) {
+  try {
+    api = await import("@opentelemetry/api");
+    const { NodeSDK } = await import("@opentelemetry/sdk-node");
+    const sdk = new NodeSDK({ serviceName: process.env.OTEL_SERVICE_NAME || config.tracing.service_name });
+    sdk.start();
+    onShutdown(() => sdk.shutdown()); // flush the last spans
+    tracer = api.trace.getTracer("website-scraper");
+  } catch (err) {
+    console.error(`tracing disabled: ${err.message}`);
+    api = null;
+  }
+}
+
+// Express middleware: a server span per request, continuing the caller's
+// trace from its traceparent header. Pipeline stages become child spans.
+export function traceRequest(req, res, next) {
+  if (!tracer) return next();
+  const parent = api.propagation.extract(api.context.active(), req.headers);
+  const span = tracer.startSpan(`${req.method} ${req.path}`, {
+    kind: api.SpanKind.SERVER,
+    attributes: { "http.request.method": req.method, "url.path": req.path }
+  }, parent);
+  const ctx = api.trace.setSpan(parent, span);
+  res.locals.trace = { ctx, span, stage: null };
+  res.on("close", () => {
+    traceStage(res, null);
+    span.setAttribute("http.response.status_code", res.statusCode);
+    if (res.statusCode >= 500) span.setStatus({ code: api.SpanStatusCode.ERROR, message: res.locals.job?.error });
+    span.end();
+  });
+  api.context.with(ctx, next);
+}
+
+// End the current stage span and start the next one (null just ends it);
+// stages run sequentially so one open span per request is enough
+export function traceStage(res, name, attributes = {}) {
+  const trace = res.locals.trace;
+  if (!trace) return;
+  if (trace.stage) trace.stage.end();
+  trace.stage = name ? tracer.startSpan(name, { attributes }, trace.ctx) : null;
+}
+
+export function traceAttributes(res, attributes) {
+  res.locals.trace?.span.setAttributes(attributes);
+}
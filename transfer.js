@@ -0,0 +1,80 @@
+// Bytes over the wire per capture, from the DevTools Network domain:
+// encodedDataLength is what actually crossed the network (headers plus the
+// still-compressed body), so it is what a metered proxy bills. Cache and
+// service-worker hits count as requests but not bytes.
+
+const LARGEST = 10;
+
+function typeName(type) {
+  return (type || "Other").toLowerCase();
+}
+
+export function watchTransfer() {
+  const requests = new Map(); // requestId -> { url, type }
+  const finished = [];
+
+  const record = (url, type, bytes, cached) => {
+    if (!/^https?:/.test(url)) return;
+    finished.push({ url, type: typeName(type), bytes: cached ? 0 : Math.max(0, Math.round(bytes)), cached });
+  };
+
+  return {
+    // Feed events from a page's CDP session; more sessions (popups) add to the same totals
+    async attach(session) {
+      session.on("Network.requestWillBeSent", ({ requestId, type, request, redirectResponse }) => {
+        // a redirect reuses the requestId; the hop being replaced is complete
+        const previous = requests.get(requestId);
+        if (redirectResponse && previous) record(previous.url, previous.type, redirectResponse.encodedDataLength, false);
+        requests.set(requestId, { url: request.url, type, cached: false });
+      });
+      session.on("Network.responseReceived", ({ requestId, type, response }) => {
+        const entry = requests.get(requestId);
+        if (!entry) return;
+        entry.type = type || entry.type;
+        entry.cached = !!(response.fromDiskCache || response.fromServiceWorker || response.fromPrefetchCache);
+      });
+      session.on("Network.requestServedFromCache", ({ requestId }) => {
+        const entry = requests.get(requestId);
+        if (entry) entry.cached = true;
+      });
+      session.on("Network.loadingFinished", ({ requestId, encodedDataLength }) => {
+        const entry = requests.get(requestId);
+        if (!entry) return;
+        requests.delete(requestId);
+        record(entry.url, entry.type, encodedDataLength, entry.cached);
+      });
+      session.on("Network.loadingFailed", ({ requestId, type }) => {
+        const entry = requests.get(requestId);
+        if (!entry) return;
+        requests.delete(requestId);
+        record(entry.url, type || entry.type, 0, false);
+      });
+      await session.send("Network.enable");
+    },
+
+    summary() {
+      return summarize(finished);
+    }
+  };
+}
+
+// { total_bytes, requests, cached, by_type: { script: { requests, bytes } }, largest: [...] }
+export function summarize(entries) {
+  const byType = {};
+  let total = 0;
+  for (const { type, bytes } of entries) {
+    const t = (byType[type] ||= { requests: 0, bytes: 0 });
+    t.requests++;
+    t.bytes += bytes;
+    total += bytes;
+  }
+  return {
+    total_bytes: total,
+    requests: entries.length,
+    cached: entries.filter(e => e.cached).length,
+    by_type: Object.fromEntries(Object.entries(byType).sort((a, b) => b[1].bytes - a[1].bytes)),
+    largest: [...entries].sort((a, b) => b.bytes - a.bytes).slice(0, LARGEST)
+      .filter(e => e.bytes > 0)
+      .map(({ url, type, bytes }) => ({ url, type, bytes }))
+  };
+}
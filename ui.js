@@ -0,0 +1,124 @@
+// Embedded operator dashboard served at /ui. Static HTML that polls the admin
+// API (token kept in localStorage) for queue/pool status, running jobs with
+// their current stage, recent history with thumbnails and the error rate.
+
+export const dashboardHtml = `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>website-scraper</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<style>
+  body { font: 14px/1.4 system-ui, sans-serif; margin: 0; background: #f5f6f8; color: #1d2330; }
+  header { background: #1d2330; color: #fff; padding: 12px 20px; display: flex; gap: 16px; align-items: center; }
+  header h1 { font-size: 16px; margin: 0; flex: 1; }
+  main { padding: 20px; display: grid; gap: 20px; }
+  section { background: #fff; border-radius: 6px; padding: 16px; box-shadow: 0 1px 2px rgba(0,0,0,.08); }
+  h2 { font-size: 13px; text-transform: uppercase; letter-spacing: .05em; color: #667; margin: 0 0 12px; }
+  .stats { display: flex; gap: 32px; flex-wrap: wrap; }
+  .stat b { display: block; font-size: 24px; }
+  table { width: 100%; border-collapse: collapse; }
+  th, td { text-align: left; padding: 6px 8px; border-bottom: 1px solid #eee; vertical-align: top; }
+  td.url { max-width: 420px; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+  .succeeded { color: #1a7f37; } .failed, .aborted { color: #cf222e; } .running { color: #9a6700; }
+  .thumbs { display: flex; gap: 12px; flex-wrap: wrap; }
+  .thumbs figure { margin: 0; width: 160px; }
+  .thumbs img { width: 160px; height: 240px; object-fit: cover; border: 1px solid #ddd; border-radius: 4px; }
+  .thumbs figcaption { font-size: 11px; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+  input { padding: 4px 8px; }
+  .error { color: #cf222e; }
+</style>
+</head>
+<body>
+<header>
+  <h1>website-scraper</h1>
+  <input id="token" type="password" placeholder="admin token">
+  <span id="updated"></span>
+</header>
+<main>
+  <div id="error" class="error"></div>
+  <section>
+    <h2>Pool</h2>
+    <div class="stats" id="stats"></div>
+  </section>
+  <section>
+    <h2>Running</h2>
+    <table><thead><tr><th>Job</th><th>Tenant</th><th>URL</th><th>Stage</th><th>Elapsed</th></tr></thead>
+    <tbody id="running"></tbody></table>
+  </section>
+  <section>
+    <h2>Recent captures</h2>
+    <div class="thumbs" id="thumbs"></div>
+  </section>
+  <section>
+    <h2>History</h2>
+    <table><thead><tr><th>Finished</th><th>Tenant</th><th>URL</th><th>Status</th><th>Duration</th><th>Error</th></tr></thead>
+    <tbody id="history"></tbody></table>
+  </section>
+</main>
+<script>
+const tokenInput = document.getElementById("token");
+tokenInput.value = localStorage.getItem("scraperAdminToken") || "";
+tokenInput.addEventListener("change", () => { localStorage.setItem("scraperAdminToken", tokenInput.value); refresh(); });
+
+const esc = s => String(s ?? "").replace(/[&<>"]/g, c => ({ "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;" })[c]);
+const thumbUrls = new Map();
+
+async function api(path, asBlob) {
+  const resp = await fetch(path, { headers: { Authorization: "Bearer " + tokenInput.value } });
+  if (!resp.ok) throw new Error(path + ": HTTP " + resp.status);
+  return asBlob ? resp.blob() : (await resp.json()).data;
+}
+
+async function thumb(id) {
+  if (!thumbUrls.has(id)) {
+    thumbUrls.set(id, api("/admin/thumbnails/" + id, true).then(b => URL.createObjectURL(b)).catch(() => null));
+  }
+  return thumbUrls.get(id);
+}
+
+async function refresh() {
+  try {
+    const [status, jobs] = await Promise.all([api("/admin/status"), api("/admin/jobs?limit=100")]);
+    const finished = jobs.jobs.filter(j => j.status !== "running");
+    const failed = finished.filter(j => j.status !== "succeeded").length;
+    const stats = {
+      "running": status.queue.running + " / " + status.queue.max_concurrency,
+      "queued": status.queue.waiting,
+      "warm contexts": (status.warm_contexts || []).length,
+      ["error rate (last " + finished.length + ")"]: finished.length ? Math.round(100 * failed / finished.length) + "%" : "–"
+    };
+    document.getElementById("stats").innerHTML = Object.entries(stats)
+      .map(([k, v]) => '<div class="stat"><b>' + esc(v) + "</b>" + esc(k) + "</div>").join("");
+
+    const now = Date.now();
+    document.getElementById("running").innerHTML = jobs.running.map(j =>
+      "<tr><td>" + esc(j.id.slice(0, 8)) + "</td><td>" + esc(j.tenant) + '</td><td class="url">' + esc(j.url) +
+      '</td><td class="running">' + esc(j.stage || "queued") + "</td><td>" +
+      Math.round((now - Date.parse(j.started_at)) / 1000) + "s</td></tr>").join("") ||
+      '<tr><td colspan="5">idle</td></tr>';
+
+    document.getElementById("history").innerHTML = finished.map(j =>
+      "<tr><td>" + esc((j.finished_at || "").replace("T", " ").slice(0, 19)) + "</td><td>" + esc(j.tenant) +
+      '</td><td class="url" title="' + esc(j.url) + '">' + esc(j.url) + '</td><td class="' + esc(j.status) + '">' +
+      esc(j.status) + "</td><td>" + esc(j.duration_ms) + " ms</td><td>" + esc(j.error) + "</td></tr>").join("");
+
+    const recent = finished.filter(j => j.status === "succeeded").slice(0, 12);
+    const urls = await Promise.all(recent.map(j => thumb(j.id)));
+    document.getElementById("thumbs").innerHTML = recent.map((j, i) => urls[i]
+      ? '<figure><img src="' + urls[i] + '"><figcaption title="' + esc(j.url) + '">' + esc(j.url) + "</figcaption></figure>"
+      : "").join("");
+
+    document.getElementById("error").textContent = "";
+    document.getElementById("updated").textContent = new Date().toLocaleTimeString();
+  } catch (err) {
+    document.getElementById("error").textContent = err.message;
+  }
+}
+
+refresh();
+setInterval(refresh, 3000);
+</script>
+</body>
+</html>
+`;
@@ -0,0 +1,93 @@
+// WARC 1.1 writer. Each record is gzipped on its own so the result is a
+// standard .warc.gz that pywb / Wayback tooling can index and replay.
+
+import { createHash, randomUUID } from "node:crypto";
+import { gzipSync } from "node:zlib";
+
+const BASE32 = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567";
+
+function base32(buf) {
+  let bits = 0, value = 0, out = "";
+  for (const byte of buf) {
+    value = (value << 8) | byte;
+    bits += 8;
+    while (bits >= 5) {
+      out += BASE32[(value >>> (bits - 5)) & 31];
+      bits -= 5;
+    }
+  }
+  if (bits > 0) out += BASE32[(value << (5 - bits)) & 31];
+  return out;
+}
+
+const sha1 = buf => `sha1:${base32(createHash("sha1").update(buf).digest())}`;
+
+// Headers that no longer describe the decoded body we were handed
+const HOP_HEADERS = new Set(["content-encoding", "transfer-encoding", "content-length"]);
+
+function httpBlock(startLine, headers, body) {
+  const lines = [startLine];
+  for (const [name, value] of Object.entries(headers)) {
+    // HTTP/2 pseudo-headers (":authority" etc.) have no HTTP/1.1 equivalent
+    if (HOP_HEADERS.has(name.toLowerCase()) || name.startsWith(":")) continue;
+    for (const v of String(value).split("\n")) lines.push(`${name}: ${v}`);
+  }
+  if (body) lines.push(`Content-Length: ${body.length}`);
+  return Buffer.concat([Buffer.from(lines.join("\r\n") + "\r\n\r\n", "latin1"), body || Buffer.alloc(0)]);
+}
+
+function record(type, fields, block) {
+  const head = [
+    "WARC/1.1",
+    `WARC-Type: ${type}`,
+    `WARC-Record-ID: <urn:uuid:${fields.id || randomUUID()}>`,
+    `WARC-Date: ${fields.date}`,
+    ...Object.entries(fields.extra || {}).map(([k, v]) => `${k}: ${v}`),
+    `WARC-Block-Digest: ${sha1(block)}`,
+    `Content-Type: ${fields.contentType}`,
+    `Content-Length: ${block.length}`
+  ].join("\r\n");
+  return gzipSync(Buffer.concat([Buffer.from(head + "\r\n\r\n", "utf8"), block, Buffer.from("\r\n\r\n")]));
+}
+
+// exchanges: [{ url, method, requestHeaders, postData, status, statusText, responseHeaders, body, date }]
+export function createWarc(exchanges, { software, filename, date = new Date().toISOString() }) {
+  const out = [];
+  const info = Buffer.from(`software: ${software}\r\nformat: WARC File Format 1.1\r\n`, "utf8");
+  out.push(record("warcinfo", {
+    date,
+    contentType: "application/warc-fields",
+    extra: { "WARC-Filename": filename }
+  }, info));
+
+  for (const ex of exchanges) {
+    const target = new URL(ex.url);
+    const responseId = randomUUID();
+    const body = ex.body || Buffer.alloc(0);
+    const responseBlock = httpBlock(`HTTP/1.1 ${ex.status} ${ex.statusText || ""}`.trimEnd(), ex.responseHeaders, body);
+    out.push(record("response", {
+      id: responseId,
+      date: ex.date,
+      contentType: "application/http;msgtype=response",
+      extra: {
+        "WARC-Target-URI": ex.url,
+        "WARC-Payload-Digest": sha1(body)
+      }
+    }, responseBlock));
+
+    const postData = ex.postData ? Buffer.from(ex.postData) : null;
+    const hasHost = Object.keys(ex.requestHeaders).some(k => k.toLowerCase() === "host");
+    const requestHeaders = hasHost ? ex.requestHeaders : { Host: target.host, ...ex.requestHeaders };
+    const requestBlock = httpBlock(`${ex.method} ${target.pathname}${target.search} HTTP/1.1`, requestHeaders, postData);
+    out.push(record("request", {
+      date: ex.date,
+      contentType: "application/http;msgtype=request",
+      extra: {
+        "WARC-Target-URI": ex.url,
+        "WARC-Concurrent-To": `<urn:uuid:${responseId}>`
+      }
+    }, requestBlock));
+  }
+
+  return Buffer.concat(out);
+}
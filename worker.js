@@ -0,0 +1,296 @@
+// Worker mode: with worker.source set the process also takes capture requests
+// from a message queue. Each message body is a /scrape request (JSON); it is
+// replayed against this process's own /scrape over a loopback listener, so
+// authentication, quotas, job history, result storage and the Kafka sink all
+// apply exactly as for HTTP callers. Unless the request says otherwise,
+// store defaults to true when result storage is configured — nobody reads the
+// response body. Outcomes: success acks the message, a retryable failure asks
+// for redelivery, anything else is logged and dropped.
+//
+//   "nats"    a durable JetStream pull consumer (needs the nats package)
+//   "sqs"     an SQS queue, long-polled (needs @aws-sdk/client-sqs)
+//   "pubsub"  a Google Pub/Sub subscription (needs @google-cloud/pubsub)
+//
+// A source is a factory (worker config) -> async iterable of messages:
+//   { id, body() -> object, apiKey, ack(), retry(), reject(), heartbeat() }
+// Iteration is paused while max_in_flight messages are being handled, so a
+// pull-based source only fetches what it can start on. The iterable may also
+// have stop() (end iteration, no more pulls) and close() (release the
+// connection once the last ack is out); on shutdown the worker stops the
+// source, waits for its in-flight captures, then closes it. registerSource
+// adds more.
+
+import http from "node:http";
+import { config } from "./config.js";
+import { localTags, requestConstraints, satisfies } from "./dispatch.js";
+import { withPreset } from "./presets.js";
+import { onShutdown } from "./shutdown.js";
+import { storageEnabled } from "./storage.js";
+
+const RETRY_DELAY_MS = 30000;
+const RESTART_MAX_MS = 60000;
+const HEARTBEAT_MS = 10000;
+
+async function natsSource({ nats_servers, nats_stream, nats_consumer, nats_subject, max_in_flight }) {
+  let nats;
+  try {
+    nats = await import("nats");
+  } catch (_) {
+    throw new Error("worker.source = \"nats\" requires the nats package");
+  }
+  const nc = await nats.connect({ servers: nats_servers });
+  const jsm = await nc.jetstreamManager();
+  // durable: redeliveries and the read position survive worker restarts
+  await jsm.consumers.info(nats_stream, nats_consumer).catch(() => jsm.consumers.add(nats_stream, {
+    durable_name: nats_consumer,
+    ack_policy: nats.AckPolicy.Explicit,
+    filter_subject: nats_subject || undefined
+  }));
+  const consumer = await nc.jetstream().consumers.get(nats_stream, nats_consumer);
+  const messages = await consumer.consume({ max_messages: max_in_flight });
+  const source = (async function* () {
+    for await (const m of messages) {
+      yield {
+        id: `${nats_stream}/${m.seq}`,
+        body: () => m.json(),
+        apiKey: m.headers?.get("X-Api-Key") || null,
+        ack: () => m.ack(),
+        retry: () => m.nak(RETRY_DELAY_MS),
+        reject: () => m.term(),
+        heartbeat: () => m.working() // push the ack deadline out during long captures
+      };
+    }
+  })();
+  return Object.assign(source, {
+    stop: () => messages.stop(),
+    close: () => nc.drain()
+  });
+}
+
+async function sqsSource({ sqs_queue_url: queueUrl, sqs_region, max_in_flight }) {
+  let sqs;
+  try {
+    sqs = await import("@aws-sdk/client-sqs");
+  } catch (_) {
+    throw new Error("worker.source = \"sqs\" requires the @aws-sdk/client-sqs package");
+  }
+  if (!queueUrl) throw new Error("worker.source = \"sqs\" needs worker.sqs_queue_url");
+  const client = new sqs.SQSClient({ region: sqs_region || undefined });
+  const visibility = (m, seconds) => client.send(new sqs.ChangeMessageVisibilityCommand({
+    QueueUrl: queueUrl, ReceiptHandle: m.ReceiptHandle, VisibilityTimeout: seconds
+  }));
+  const remove = m => client.send(new sqs.DeleteMessageCommand({ QueueUrl: queueUrl, ReceiptHandle: m.ReceiptHandle }));
+  // cuts the 20 s long poll short on stop
+  const polling = new AbortController();
+  const source = (async function* () {
+    while (!polling.signal.aborted) {
+      let received;
+      try {
+        received = await client.send(new sqs.ReceiveMessageCommand({
+          QueueUrl: queueUrl,
+          MaxNumberOfMessages: Math.min(10, max_in_flight),
+          WaitTimeSeconds: 20,
+          MessageAttributeNames: ["X-Api-Key"]
+        }), { abortSignal: polling.signal });
+      } catch (err) {
+        if (polling.signal.aborted) return;
+        throw err;
+      }
+      const { Messages = [] } = received;
+      for (const m of Messages) {
+        yield {
+          id: m.MessageId,
+          body: () => JSON.parse(m.Body),
+          apiKey: m.MessageAttributes?.["X-Api-Key"]?.StringValue || null,
+          ack: () => remove(m),
+          retry: () => visibility(m, RETRY_DELAY_MS / 1000),
+          // a redrive policy on the queue is the place for poison messages
+          reject: () => remove(m),
+          heartbeat: () => visibility(m, (HEARTBEAT_MS * 3) / 1000).catch(() => {})
+        };
+      }
+    }
+  })();
+  return Object.assign(source, {
+    stop: () => polling.abort(),
+    close: () => client.destroy()
+  });
+}
+
+async function pubsubSource({ pubsub_subscription, max_in_flight }) {
+  let PubSub;
+  try {
+    ({ PubSub } = await import("@google-cloud/pubsub"));
+  } catch (_) {
+    throw new Error("worker.source = \"pubsub\" requires the @google-cloud/pubsub package");
+  }
+  if (!pubsub_subscription) throw new Error("worker.source = \"pubsub\" needs worker.pubsub_subscription");
+  // streaming pull pushes messages at us; flow control keeps the backlog at
+  // max_in_flight and the client library extends leases by itself
+  const subscription = new PubSub().subscription(pubsub_subscription, {
+    flowControl: { maxMessages: max_in_flight, allowExcessMessages: false }
+  });
+  const pending = [];
+  let wake = null;
+  let failure = null;
+  let stopped = false;
+  const notify = () => {
+    if (wake) wake();
+    wake = null;
+  };
+  const onMessage = m => {
+    pending.push(m);
+    notify();
+  };
+  subscription.on("message", onMessage);
+  subscription.on("error", err => {
+    failure = err;
+    notify();
+  });
+  const source = (async function* () {
+    while (!stopped) {
+      if (failure) throw failure;
+      if (!pending.length) {
+        await new Promise(resolve => (wake = resolve));
+        continue;
+      }
+      const m = pending.shift();
+      yield {
+        id: m.id,
+        body: () => JSON.parse(m.data.toString("utf8")),
+        apiKey: m.attributes?.["X-Api-Key"] || null,
+        ack: () => m.ack(),
+        retry: () => m.nack(), // redelivered per the subscription's retry policy
+        reject: () => m.ack(),
+        heartbeat: () => {}
+      };
+    }
+  })();
+  return Object.assign(source, {
+    stop() {
+      stopped = true;
+      subscription.removeListener("message", onMessage);
+      for (const m of pending.splice(0)) m.nack();
+      notify();
+    },
+    // flushes outstanding acks before the stream goes
+    close: () => subscription.close()
+  });
+}
+
+const SOURCES = { nats: natsSource, sqs: sqsSource, pubsub: pubsubSource };
+
+// Make another queue available as worker.source = name
+export function registerSource(name, factory) {
+  SOURCES[name] = factory;
+}
+
+// A listener on an ephemeral loopback port serving the same app, so queued
+// requests skip TLS and client-certificate checks of the public listener
+function loopback(app) {
+  return new Promise((resolve, reject) => {
+    const server = http.createServer(app);
+    server.once("error", reject);
+    server.listen(0, "127.0.0.1", () => resolve(`http://127.0.0.1:${server.address().port}`));
+  });
+}
+
+async function handle(base, message) {
+  let body;
+  try {
+    body = message.body();
+    if (!body || typeof body !== "object" || Array.isArray(body)) throw new Error("not a JSON object");
+  } catch (err) {
+    console.error(`worker: ${message.id}: unreadable request: ${err.message}`);
+    return message.reject();
+  }
+  let constraints;
+  try {
+    constraints = requestConstraints(withPreset(body));
+  } catch (err) {
+    console.error(`worker: ${message.id}: ${err.message}`);
+    return message.reject();
+  }
+  // leave it on the queue for a worker with the right tags
+  if (!satisfies(constraints, localTags())) return message.retry();
+  if (body.store === undefined && storageEnabled()) body.store = true;
+  const apiKey = message.apiKey || config.worker.api_key;
+  const heartbeat = setInterval(() => message.heartbeat(), HEARTBEAT_MS);
+  try {
+    const res = await fetch(`${base}/scrape`, {
+      method: "POST",
+      headers: { "Content-Type": "application/json", ...(apiKey ? { "X-Api-Key": apiKey } : {}) },
+      body: JSON.stringify(body)
+    });
+    if (res.ok) {
+      await res.arrayBuffer();
+      return message.ack();
+    }
+    const failure = await res.json().catch(() => ({}));
+    console.error(`worker: ${message.id}: ${res.status} ${failure.code || ""} ${failure.error || ""}`.trim());
+    return failure.retryable ? message.retry() : message.reject();
+  } catch (err) {
+    console.error(`worker: ${message.id}: ${err.message}`);
+    return message.retry();
+  } finally {
+    clearInterval(heartbeat);
+  }
+}
+
+// Take at most worker.max_in_flight messages at a time off the source
+export async function startWorker(app) {
+  const { source } = config.worker;
+  if (!source) return;
+  const factory = SOURCES[source];
+  if (!factory) throw new Error(`unknown worker.source: ${source}`);
+  const base = await loopback(app);
+  const inFlight = new Set();
+  let messages = null;
+  let stopping = false;
+  let wake = null; // ends a restart backoff early on shutdown
+  // A source that fails or ends (broker restart, expired credentials, ...)
+  // is reopened with backoff; intake must not silently stop for good
+  const running = (async () => {
+    for (let failures = 0; !stopping;) {
+      try {
+        messages = await factory(config.worker);
+        console.log(`worker: taking capture requests from ${source}`);
+        for await (const message of messages) {
+          failures = 0;
+          // pulled just as the stop came: give it back untouched
+          if (stopping) {
+            await message.retry();
+            break;
+          }
+          const done = handle(base, message).finally(() => inFlight.delete(done));
+          inFlight.add(done);
+          if (inFlight.size >= config.worker.max_in_flight) await Promise.race(inFlight);
+        }
+        if (!stopping) throw new Error("source ended");
+      } catch (err) {
+        if (stopping) break;
+        failures++;
+        const wait = Math.min(RESTART_MAX_MS, 1000 * 2 ** failures);
+        console.error(`worker: ${source}: ${err.message}; reopening in ${wait}ms`);
+        // in-flight acks still go through the old connection
+        await Promise.all(inFlight);
+        await Promise.resolve(messages?.close?.()).catch(() => {});
+        messages = null;
+        await new Promise(resolve => {
+          wake = resolve;
+          setTimeout(resolve, wait);
+        });
+      }
+    }
+    await Promise.all(inFlight);
+  })();
+  onShutdown(async () => {
+    stopping = true;
+    wake?.();
+    await messages?.stop?.();
+    await running;
+    await messages?.close?.();
+    console.log(`worker: ${source} intake stopped`);
+  });
+  await running;
+}